@@ -16,7 +16,9 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"strings"
 	"time"
@@ -24,24 +26,32 @@ import (
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	ic "istio.io/client-go/pkg/clientset/versioned"
-	icinformer "istio.io/client-go/pkg/informers/externalversions/networking/v1alpha3"
+	iclisters "istio.io/client-go/pkg/listers/networking/v1alpha3"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamiclister"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 
 	"github.com/tetratelabs/istio-cloud-map/pkg/cloudmap"
 	"github.com/tetratelabs/istio-cloud-map/pkg/consul"
 	"github.com/tetratelabs/istio-cloud-map/pkg/control"
+	"github.com/tetratelabs/istio-cloud-map/pkg/export"
+	"github.com/tetratelabs/istio-cloud-map/pkg/infer"
+	"github.com/tetratelabs/istio-cloud-map/pkg/networking"
+	"github.com/tetratelabs/istio-cloud-map/pkg/overlay"
 	"github.com/tetratelabs/istio-cloud-map/pkg/provider"
 	"github.com/tetratelabs/istio-cloud-map/pkg/serviceentry"
+	"github.com/tetratelabs/istio-cloud-map/pkg/vip"
 	"github.com/tetratelabs/log"
 )
 
 const (
-	apiGroup      = "networking.istio.io"
-	apiVersion    = "v1alpha3"
-	apiType       = apiGroup + "/" + apiVersion
 	kind          = "ServiceEntry"
 	allNamespaces = ""
 	resyncPeriod  = 30
@@ -55,8 +65,26 @@ var (
 	awsRegion       string
 	awsID           string
 	awsSecret       string
+	awsListNs       []string
+	awsQueueURL     string
+	awsResync       time.Duration
 	consulEndpoint  string
 	consulNamespace string
+	consulOpts      consul.Options
+	exportNamespace string
+	exportSource    string
+	exportSelector  string
+	healthAddress   string
+	protocolTable   string
+	vipCIDR         string
+	mixedEndpoints  string
+	seRules         string
+	overlays        string
+	drPolicies      string
+	istioAPIVersion string
+	workloadEntries bool
+	weNetworkLabel  string
+	weAccountLabel  string
 )
 
 func serve() (serve *cobra.Command) {
@@ -67,6 +95,9 @@ func serve() (serve *cobra.Command) {
 		Short:   "Starts the Istio Cloud Map Operator server",
 		Example: "istio-cloud-map serve --id 123",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if !contains(control.MixedStrategies, mixedEndpoints) {
+				return errors.Errorf("unknown mixed endpoints strategy %q, must be one of %v", mixedEndpoints, control.MixedStrategies)
+			}
 			cfg, err := clientcmd.BuildConfigFromFlags("", kubeConfig)
 			if err != nil {
 				return errors.Wrapf(err, "failed to create a kube client from the config %q", kubeConfig)
@@ -75,6 +106,11 @@ func serve() (serve *cobra.Command) {
 			if err != nil {
 				return errors.Wrap(err, "failed to create an istio client from the k8s rest config")
 			}
+			api, err := networking.New(ic, istioAPIVersion)
+			if err != nil {
+				return err
+			}
+			log.Infof("Using %s/%s", networking.Group, api.Version)
 
 			t := true
 			sessionUUID := uuid.NewUUID()
@@ -96,12 +132,24 @@ func serve() (serve *cobra.Command) {
 				}
 			}
 
+			if len(protocolTable) > 0 {
+				table, err := infer.LoadProtocolTable(protocolTable)
+				if err != nil {
+					return err
+				}
+				infer.SetProtocolTable(table)
+				log.Infof("Inferring protocols with the table in %q", protocolTable)
+			}
+
 			watcher, err := getWatcher()
 			if err != nil {
 				return err
 			}
 
 			go watcher.Run(ctx)
+			if len(healthAddress) > 0 {
+				go serveHealth(watcher)
+			}
 			istio := serviceentry.New(owner)
 			if debug {
 				istio = serviceentry.NewLoggingStore(istio, log.Infof)
@@ -111,15 +159,84 @@ func serve() (serve *cobra.Command) {
 			// we get the service entry for namespace `namespace` for the synchronizer to publish service entries in to
 			// (if we use an `allNamespaces` client here we can't publish). Listening for ServiceEntries is done with
 			// the informer, which uses allNamespace.
-			write := ic.NetworkingV1alpha3().ServiceEntries(findNamespace(namespace))
-			sync := control.NewSynchronizer(owner, istio, watcher.Store(), watcher.Prefix(), write)
+			write := api.ServiceEntries(findNamespace(namespace))
+			syncOpts := control.Options{MixedStrategy: mixedEndpoints}
+			if len(vipCIDR) > 0 {
+				if syncOpts.VIPs, err = vip.NewAllocator(vipCIDR); err != nil {
+					return err
+				}
+			}
+			if len(seRules) > 0 {
+				if syncOpts.Rules, err = infer.LoadServiceEntryRules(seRules); err != nil {
+					return err
+				}
+				log.Infof("Applying the ServiceEntry rules in %q", seRules)
+			}
+			if len(overlays) > 0 {
+				if syncOpts.Overlays, err = overlay.Load(overlays); err != nil {
+					return err
+				}
+				log.Infof("Applying the ServiceEntry overlays in %q", overlays)
+			}
+			if len(drPolicies) > 0 {
+				policies, err := infer.LoadDestinationRules(drPolicies)
+				if err != nil {
+					return err
+				}
+				drInformer := api.DestinationRuleInformer(findNamespace(namespace), 5*time.Second,
+					cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+				go drInformer.Run(ctx.Done())
+				// the synchronizer must see the DestinationRules there are, or it tries to create them again
+				if !cache.WaitForCacheSync(ctx.Done(), drInformer.HasSynced) {
+					return errors.New("stopped before the DestinationRules were listed")
+				}
+				syncOpts.DestinationRules = &control.DestinationRuleOptions{
+					Policies: policies,
+					Client:   api.DestinationRules(findNamespace(namespace)),
+					Lister:   iclisters.NewDestinationRuleLister(drInformer.GetIndexer()).DestinationRules(findNamespace(namespace)),
+				}
+				log.Infof("Generating DestinationRules with the policies in %q", drPolicies)
+			}
+			var dc dynamic.Interface
+			if workloadEntries {
+				if err := networking.ServesWorkloadEntries(ic.Discovery()); err != nil {
+					return err
+				}
+				if dc, err = dynamic.NewForConfig(cfg); err != nil {
+					return errors.Wrap(err, "failed to create a dynamic client from the k8s rest config")
+				}
+				// ServiceEntries selecting WorkloadEntries are written, and read, through the dynamic client too
+				write = api.SelectingServiceEntries(dc, findNamespace(namespace))
+				weInformer := networking.WorkloadEntryInformer(dc, findNamespace(namespace), 5*time.Second,
+					cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+				go weInformer.Run(ctx.Done())
+				// the synchronizer must see the WorkloadEntries there are, or it tries to create them again
+				if !cache.WaitForCacheSync(ctx.Done(), weInformer.HasSynced) {
+					return errors.New("stopped before the WorkloadEntries were listed")
+				}
+				syncOpts.WorkloadEntries = &control.WorkloadEntryOptions{
+					WorkloadEntries: infer.WorkloadEntries{NetworkLabel: weNetworkLabel, ServiceAccountLabel: weAccountLabel},
+					Client:          dc.Resource(networking.WorkloadEntries).Namespace(findNamespace(namespace)),
+					Lister:          dynamiclister.New(weInformer.GetIndexer(), networking.WorkloadEntries).Namespace(findNamespace(namespace)),
+				}
+				log.Info("Generating WorkloadEntries for the instances of hosts with IP endpoints")
+			}
+			sync := control.NewSynchronizer(owner, istio, watcher.Store(), watcher.Prefix(), write, syncOpts)
 			go sync.Run(ctx)
 
-			informer := icinformer.NewServiceEntryInformer(ic, allNamespaces, 5*time.Second,
-				// taken from https://github.com/istio/istio/blob/release-1.5/pilot/pkg/bootstrap/namespacecontroller.go
-				cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+			// taken from https://github.com/istio/istio/blob/release-1.5/pilot/pkg/bootstrap/namespacecontroller.go
+			indexers := cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}
+			informer := api.ServiceEntryInformer(allNamespaces, 5*time.Second, indexers)
+			if workloadEntries {
+				informer = api.SelectingServiceEntryInformer(dc, allNamespaces, 5*time.Second, indexers)
+			}
 			serviceentry.AttachHandler(istio, informer)
-			log.Infof("Watching %s.%s across all namespaces with resync period %d and id %q", apiType, kind, resyncPeriod, id)
+			if len(exportNamespace) > 0 {
+				if err := startExporter(ctx, cfg, owner, informer); err != nil {
+					return err
+				}
+			}
+			log.Infof("Watching %s.%s across all namespaces with resync period %d and id %q", networking.Group+"/"+api.Version, kind, resyncPeriod, id)
 			informer.Run(ctx.Done())
 			return nil
 		},
@@ -141,21 +258,232 @@ func serve() (serve *cobra.Command) {
 	serve.PersistentFlags().StringVar(&awsSecret, "aws-secret-access-key", "",
 		"AWS Secret Access Key to use to connect to Cloud Map. Use flags for both this and --aws-access-key-id OR use "+
 			"the environment variables AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY. Flags and env vars cannot be mixed.")
+	serve.PersistentFlags().StringSliceVar(&awsListNs, "aws-list-instances-namespaces", nil,
+		"Cloud Map namespaces whose instances are discovered with ListInstances and GetInstancesHealthStatus instead of "+
+			"DiscoverInstances, returning every instance and all of its attributes. Use \"*\" for all namespaces.")
+	serve.PersistentFlags().StringVar(&awsQueueURL, "aws-sqs-queue-url", "",
+		"SQS queue receiving Cloud Map API events from EventBridge. If set, only the services named in events are "+
+			"re-discovered and the full sync runs every --aws-resync-interval instead of every 5 seconds.")
+	serve.PersistentFlags().DurationVar(&awsResync, "aws-resync-interval", 5*time.Minute,
+		"How often to fully sync Cloud Map when consuming events from --aws-sqs-queue-url.")
 	serve.PersistentFlags().StringVar(&consulEndpoint, "consul-endpoint", "",
 		"Consul's endpoint to query service catalog. This must include its scheme http// or https//. (e.g. http://localhost:8500)")
 	serve.PersistentFlags().StringVar(&consulNamespace, "consul-namespace", "",
 		"Consul's namespace to search service catalog")
+	serve.PersistentFlags().BoolVar(&consulOpts.UseHealthAPI, "consul-use-health-api", false,
+		"If true, discovers Consul instances with the Health API so that instances with critical checks are left out "+
+			"and each endpoint is labelled with its check status.")
+	serve.PersistentFlags().BoolVar(&consulOpts.IncludeWarning, "consul-include-warning", true,
+		"If true, instances whose worst check is a warning are still discovered when --consul-use-health-api is set.")
+	serve.PersistentFlags().StringVar(&consulOpts.Token, "consul-token", "",
+		"ACL token to query Consul with. Use this OR the environment variable CONSUL_HTTP_TOKEN")
+	serve.PersistentFlags().StringVar(&consulOpts.TokenFile, "consul-token-file", "",
+		"File containing the ACL token to query Consul with, which is re-read when it changes. "+
+			"Use this OR the environment variable CONSUL_HTTP_TOKEN_FILE")
+	serve.PersistentFlags().StringVar(&consulOpts.CAFile, "consul-ca-file", "",
+		"CA certificate to verify Consul's certificate with, which is re-read when it changes. "+
+			"Use this OR the environment variable CONSUL_CACERT")
+	serve.PersistentFlags().StringVar(&consulOpts.CertFile, "consul-cert-file", "",
+		"Client certificate to present to Consul, which is re-read when it changes. "+
+			"Use this OR the environment variable CONSUL_CLIENT_CERT")
+	serve.PersistentFlags().StringVar(&consulOpts.KeyFile, "consul-key-file", "",
+		"Key of --consul-cert-file, which is re-read when it changes. Use this OR the environment variable CONSUL_CLIENT_KEY")
+	serve.PersistentFlags().StringVar(&consulOpts.TLSServerName, "consul-tls-server-name", "",
+		"Name to verify Consul's certificate against, if not the host of --consul-endpoint. "+
+			"Use this OR the environment variable CONSUL_TLS_SERVER_NAME")
+	serve.PersistentFlags().StringVar(&consulOpts.AddressType, "consul-address-type", "",
+		fmt.Sprintf("Tagged address instances are reached at, one of %v. If empty, or an instance has no such address, "+
+			"its service address is used, falling back to its node's address.", consul.AddressTypes))
+	serve.PersistentFlags().StringArrayVar(&consulOpts.HostTemplates, "consul-host-template",
+		[]string{consul.DefaultHostTemplate}, "Go template naming the host of each Consul service, executed with its "+
+			".Service, .Namespace, .Partition, .Datacenter and .Tags (e.g. {{.Service}}.service.{{.Datacenter}}.consul). "+
+			"Repeat the flag to add alias hosts.")
+	serve.PersistentFlags().IntVar(&consulOpts.Workers, "consul-workers", consul.DefaultWorkers,
+		"How many Consul services' instances are fetched at once when they're first seen. The blocking queries then "+
+			"watching each service for changes are bounded by --consul-max-watches instead.")
+	serve.PersistentFlags().IntVar(&consulOpts.MaxWatches, "consul-max-watches", consul.DefaultMaxWatches,
+		"How many blocking queries watching Consul services for changes are in flight at once. With --consul-workers, "+
+			"it must stay below the connections the agent allows a client (limits.http_max_conns_per_client, 200 by "+
+			"default); beyond it, services take turns being watched for up to --consul-wait-time.")
+	serve.PersistentFlags().StringVar(&consulOpts.Datacenter, "consul-datacenter", "",
+		"Consul datacenter to discover services in; defaults to the datacenter of the agent at --consul-endpoint")
+	serve.PersistentFlags().StringSliceVar(&consulOpts.Datacenters, "consul-datacenters", nil,
+		"Consul datacenters to discover services in, overriding --consul-datacenter. Use \"*\" for every datacenter "+
+			"in the federation. A datacenter that can't be reached keeps the services last discovered in it.")
+	serve.PersistentFlags().StringSliceVar(&consulOpts.RequiredTags, "consul-required-tags", nil,
+		"Only Consul instances with all of these tags are discovered.")
+	serve.PersistentFlags().StringSliceVar(&consulOpts.ForbiddenTags, "consul-forbidden-tags", nil,
+		"Consul instances with any of these tags are not discovered.")
+	serve.PersistentFlags().StringToStringVar(&consulOpts.Meta, "consul-meta", nil,
+		"Only Consul instances with all of these service meta key/value pairs are discovered (e.g. mesh=true).")
+	serve.PersistentFlags().StringSliceVar(&consulOpts.IncludeServices, "consul-include-services", nil,
+		"Regular expressions; if set, only Consul services whose names match one of them are discovered.")
+	serve.PersistentFlags().StringSliceVar(&consulOpts.ExcludeServices, "consul-exclude-services", nil,
+		"Regular expressions; Consul services whose names match any of them are not discovered (e.g. ^consul$).")
+	serve.PersistentFlags().StringVar(&consulOpts.Filter, "consul-filter", "",
+		"Consul filter expression selecting the instances of services, evaluated by Consul against catalog services, "+
+			"or health entries with --consul-use-health-api (e.g. 'ServiceMeta.mesh != \"false\"').")
+	serve.PersistentFlags().StringSliceVar(&consulOpts.Namespaces, "consul-namespaces", nil,
+		"Glob patterns choosing the Consul Enterprise namespaces to discover services in, overriding --consul-namespace "+
+			"(e.g. \"team-*\").")
+	serve.PersistentFlags().StringSliceVar(&consulOpts.ExcludeNamespaces, "consul-exclude-namespaces", nil,
+		"Glob patterns of Consul namespaces matching --consul-namespaces to leave out.")
+	serve.PersistentFlags().StringSliceVar(&consulOpts.Partitions, "consul-partitions", nil,
+		"Glob patterns choosing the Consul Enterprise admin partitions to discover services in. If empty, services are "+
+			"discovered in the partition of the ACL token.")
+	serve.PersistentFlags().StringSliceVar(&consulOpts.ExcludePartitions, "consul-exclude-partitions", nil,
+		"Glob patterns of Consul admin partitions matching --consul-partitions to leave out.")
+	serve.PersistentFlags().StringSliceVar(&consulOpts.GatewayDatacenters, "consul-gateway-datacenters", nil,
+		"Consul datacenters, or \"*\" for all, whose services are reached through the datacenter's mesh gateways "+
+			"rather than at their own addresses. Sidecar proxies and gateways are never discovered as services of their own. "+
+			"Mesh gateways are discovered whatever the Consul service and instance filters select.")
+	serve.PersistentFlags().BoolVar(&consulOpts.UseWeights, "consul-use-weights", false,
+		"If true, endpoints are weighted with their Consul instance's passing weight, or warning weight if its worst "+
+			"check is a warning.")
+	serve.PersistentFlags().StringSliceVar(&consulOpts.LocalityKeys, "consul-locality-keys", nil,
+		"Consul node meta keys holding the region, zone and sub-zone of the node's instances, in that order "+
+			"(e.g. region,zone,rack). Nodes without the region key are in the locality of their datacenter.")
+	serve.PersistentFlags().StringSliceVar(&consulOpts.LabelKeys, "consul-label-keys", nil,
+		"Consul node meta keys copied to the labels of the endpoints of the node's instances.")
+	serve.PersistentFlags().StringToStringVar(&consulOpts.Localities, "consul-localities", nil,
+		"Maps Consul datacenters to the locality of their endpoints (e.g. dc1=us-east1/us-east1-a). When discovering "+
+			"more than one datacenter, endpoints of datacenters that aren't mapped are in the region named after the datacenter.")
+	serve.PersistentFlags().StringVar(&consulOpts.ProtocolMetaKey, "consul-protocol-meta-key", consul.DefaultProtocolMetaKey,
+		"Consul service meta key declaring the protocol of an instance's port (e.g. protocol=grpc). Empty to ignore meta.")
+	serve.PersistentFlags().StringVar(&consulOpts.ProtocolTagPrefix, "consul-protocol-tag-prefix", consul.DefaultProtocolTagPrefix,
+		"Prefix of the Consul tag declaring the protocol of an instance's port (e.g. istio-protocol:http2), used if "+
+			"the meta key isn't set. Empty to ignore tags.")
+	serve.PersistentFlags().BoolVar(&consulOpts.UseServiceDefaults, "consul-use-service-defaults", false,
+		"If true, the protocol of a Consul service's service-defaults config entry is used for instances declaring none "+
+			"in their meta or tags. Without any, the protocol is inferred from the port number.")
+	serve.PersistentFlags().DurationVar(&consulOpts.WaitTime, "consul-wait-time", consul.DefaultWaitTime,
+		"How long blocking queries to Consul wait for a change before returning.")
+	serve.PersistentFlags().DurationVar(&consulOpts.TickInterval, "consul-tick-interval", consul.DefaultTickInterval,
+		"How often the Consul catalogs are listed to discover new and removed services.")
+	serve.PersistentFlags().DurationVar(&consulOpts.MaxBackoff, "consul-max-backoff", consul.DefaultMaxBackoff,
+		"Most we wait to retry after consecutive failures to query Consul. Retries start after --consul-tick-interval "+
+			"and double with each failure, with jitter.")
+	serve.PersistentFlags().StringVar(&consulOpts.Consistency, "consul-consistency", "default",
+		fmt.Sprintf("Consistency mode of queries to Consul, one of %v: \"stale\" lets any server answer, \"consistent\" "+
+			"has the leader confirm it still leads, and \"cached\" is answered from the agent's cache.", consul.ConsistencyModes))
+	serve.PersistentFlags().StringVar(&protocolTable, "protocol-table", "",
+		"If provided, a YAML file of rules mapping port numbers or ranges to the protocol of ports that don't declare "+
+			"one, tried before the defaults, and overriding the protocol of ports of matching hosts.")
+	serve.PersistentFlags().StringVar(&vipCIDR, "vip-cidr", "",
+		"If provided, every ServiceEntry is allocated a stable virtual IP from this IPv4 CIDR (e.g. 240.240.0.0/16) "+
+			"as its address, recorded in its "+vip.Annotation+" annotation. Addresses of deleted ServiceEntries are reused.")
+	serve.PersistentFlags().StringVar(&mixedEndpoints, "mixed-endpoints", control.MixedDNS,
+		fmt.Sprintf("How hosts with both IP and hostname endpoints are published, one of %v: \"%s\" publishes "+
+			"every endpoint in a DNS ServiceEntry, \"%s\" only the endpoints of the more common type, \"%s\" the IP "+
+			"endpoints under the host and the hostname endpoints under its alias prefixed with %q, and \"%s\" a "+
+			"ServiceEntry with NONE resolution and no endpoints.", control.MixedStrategies, control.MixedDNS,
+			control.MixedDropMinority, control.MixedSplit, control.SplitAliasPrefix, control.MixedNone))
+	serve.PersistentFlags().StringVar(&seRules, "service-entry-rules", "",
+		"If provided, a YAML file of rules setting the location, exportTo and subjectAltNames of the ServiceEntries "+
+			"of hosts matched by provider, namespace or host glob. The first matching rule applies.")
+	serve.PersistentFlags().StringVar(&overlays, "overlays", "",
+		"If provided, a YAML file of strategic-merge patches, or Go templates rendering them from the provider's "+
+			"metadata, applied to the ServiceEntries of hosts matching a glob once they're generated.")
+	serve.PersistentFlags().StringVar(&drPolicies, "destination-rules", "",
+		"If provided, a YAML file of traffic policies by provider, namespace, host glob or service attributes. Hosts "+
+			"a policy applies to, or whose services have the attribute tls=true, get a DestinationRule alongside their "+
+			"ServiceEntry.")
+	serve.PersistentFlags().StringVar(&istioAPIVersion, "istio-api-version", networking.Auto,
+		fmt.Sprintf("Version of the %s API ServiceEntries and DestinationRules are watched and written in, one of %v, "+
+			"or %q for the newest the API server serves.", networking.Group, networking.Versions, networking.Auto))
+	serve.PersistentFlags().BoolVar(&workloadEntries, "workload-entries", false,
+		"If true, the instances of hosts whose endpoints are all IPs are published as WorkloadEntries, one per "+
+			"instance, which their mesh-internal ServiceEntry selects in place of inline endpoints. Needs Istio 1.6 or later.")
+	serve.PersistentFlags().StringVar(&weNetworkLabel, "workload-network-label", "",
+		"Endpoint label naming the network of WorkloadEntries whose instance doesn't say which network it's in.")
+	serve.PersistentFlags().StringVar(&weAccountLabel, "workload-service-account-label", "",
+		"Endpoint label naming the service account WorkloadEntries run as (e.g. a label copied by --consul-label-keys).")
+	serve.PersistentFlags().StringVar(&healthAddress, "health-address", "",
+		"If provided, the address to serve the health of the provider on at /healthz (e.g. :8081). It's unhealthy, "+
+			"with status 503, when the provider couldn't be queried the last time it was synced.")
+	serve.PersistentFlags().StringVar(&exportNamespace, "aws-export-namespace", "",
+		"If provided, the Cloud Map namespace that services running in the mesh are registered into.")
+	serve.PersistentFlags().StringVar(&exportSource, "export-source", exportServices,
+		"What to register into --aws-export-namespace: \""+exportServices+"\" registers the ready endpoints of "+
+			"Kubernetes Services as <name>.<namespace>, \""+exportServiceEntries+"\" registers the endpoints of "+
+			"ServiceEntries under each of their hosts.")
+	serve.PersistentFlags().StringVar(&exportSelector, "export-selector", "cloudmap.istio.io/export=true",
+		"Label selector choosing the Services or ServiceEntries to register into --aws-export-namespace.")
 	return serve
 }
 
+const (
+	exportServices       = "services"
+	exportServiceEntries = "serviceentries"
+)
+
+// startExporter starts registering the selected Services or ServiceEntries into Cloud Map
+func startExporter(ctx context.Context, cfg *rest.Config, owner v1.OwnerReference, seInformer cache.SharedIndexInformer) error {
+	selector, err := labels.Parse(exportSelector)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse export selector %q", exportSelector)
+	}
+
+	var source export.Source
+	var synced []cache.InformerSynced
+	switch exportSource {
+	case exportServices:
+		kc, err := kubernetes.NewForConfig(cfg)
+		if err != nil {
+			return errors.Wrap(err, "failed to create a kubernetes client from the k8s rest config")
+		}
+		// the endpoints controller copies a Service's labels to its Endpoints, so one selector filters both
+		factory := informers.NewSharedInformerFactoryWithOptions(kc, 30*time.Second,
+			informers.WithTweakListOptions(func(o *v1.ListOptions) { o.LabelSelector = selector.String() }))
+		svcs, eps := factory.Core().V1().Services(), factory.Core().V1().Endpoints()
+		synced = []cache.InformerSynced{svcs.Informer().HasSynced, eps.Informer().HasSynced}
+		source = export.NewServiceSource(svcs.Lister(), eps.Lister(), labels.Everything(), synced...)
+		factory.Start(ctx.Done())
+	case exportServiceEntries:
+		synced = []cache.InformerSynced{seInformer.HasSynced}
+		source = export.NewServiceEntrySource(iclisters.NewServiceEntryLister(seInformer.GetIndexer()), selector, owner, synced...)
+	default:
+		return errors.Errorf("unknown export source %q, must be one of %q or %q", exportSource, exportServices, exportServiceEntries)
+	}
+
+	exporter, err := cloudmap.NewExporter(source, exportNamespace, id, awsRegion, awsID, awsSecret)
+	if err != nil {
+		return errors.Wrap(err, "failed to set up the Cloud Map exporter")
+	}
+	log.Infof("Exporting %s matching %q into Cloud Map namespace %q", exportSource, selector, exportNamespace)
+	// the ServiceEntry informer is only started once we return, so we wait for the caches without blocking
+	go func() {
+		if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+			return
+		}
+		exporter.Run(ctx)
+	}()
+	return nil
+}
+
+// serveHealth serves the health of the watcher at /healthz on --health-address
+func serveHealth(watcher provider.Watcher) {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", provider.HealthHandler(watcher))
+	log.Infof("Serving health at %s/healthz", healthAddress)
+	if err := http.ListenAndServe(healthAddress, mux); err != nil {
+		log.Errorf("error serving health: %v", err)
+	}
+}
+
 func getWatcher() (provider.Watcher, error) {
 	store := provider.NewStore()
 	log.Info("Initializing Watchers")
-	cmWatcher, awsErr := cloudmap.NewWatcher(store, awsRegion, awsID, awsSecret)
+	cmWatcher, awsErr := cloudmap.NewWatcher(store, awsRegion, awsID, awsSecret, cloudmap.Options{
+		ListInstancesNamespaces: awsListNs,
+		QueueURL:                awsQueueURL,
+		ResyncInterval:          awsResync,
+		Owner:                   id,
+	})
 	if awsErr == nil {
 		log.Infof("Cloud Map Watcher initialized in %q", awsRegion)
 	}
-	consulWatcher, consulErr := consul.NewWatcher(store, consulEndpoint, consulNamespace)
+	consulWatcher, consulErr := consul.NewWatcher(store, consulEndpoint, consulNamespace, consulOpts)
 	if consulErr == nil {
 		log.Infof("Consul Watcher initialized at %s", consulEndpoint)
 	}
@@ -190,6 +518,15 @@ func main() {
 	}
 }
 
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
 func findNamespace(namespace string) string {
 	if len(namespace) > 0 {
 		log.Infof("using namespace flag to publish service entries into %q", namespace)
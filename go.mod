@@ -4,6 +4,7 @@ go 1.14
 
 require (
 	github.com/aws/aws-sdk-go v1.30.1
+	github.com/gogo/protobuf v1.3.0
 	github.com/golang/groupcache v0.0.0-20200121045136-8c9f03a8e57e // indirect
 	github.com/golang/protobuf v1.3.3
 	github.com/hashicorp/consul/api v1.6.0
@@ -20,6 +21,8 @@ require (
 	istio.io/api v0.0.0-20200316215140-da46fe8e25be
 	istio.io/client-go v0.0.0-20200316192452-065c59267750
 	istio.io/gogo-genproto v0.0.0-20200130224810-a0338448499a // indirect
+	k8s.io/api v0.17.4
 	k8s.io/apimachinery v0.17.4
 	k8s.io/client-go v0.17.4
+	sigs.k8s.io/yaml v1.1.0
 )
@@ -0,0 +1,249 @@
+package cloudmap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/servicediscovery"
+	"github.com/aws/aws-sdk-go/service/servicediscovery/servicediscoveryiface"
+	"github.com/pkg/errors"
+
+	"github.com/tetratelabs/istio-cloud-map/pkg/export"
+	"github.com/tetratelabs/log"
+)
+
+// ownerAttribute is the custom attribute marking the instances we registered, and so are allowed to deregister.
+// Custom attributes can't start with "AWS_".
+const ownerAttribute = "ISTIO_CLOUD_MAP_OWNER"
+
+// Exporter registers the instances of services running in the mesh into a Cloud Map namespace
+type Exporter struct {
+	cloudmap  servicediscoveryiface.ServiceDiscoveryAPI
+	source    export.Source
+	namespace string // name of the Cloud Map namespace we register into
+	owner     string
+	interval  time.Duration
+}
+
+// NewExporter returns an Exporter registering the instances in source into the Cloud Map namespace with the given name.
+// Instances are marked as owned by owner; instances with any other owner, or none, are never modified.
+func NewExporter(source export.Source, namespace, owner, region, id, secret string) (*Exporter, error) {
+	if len(namespace) == 0 {
+		return nil, errors.New("Cloud Map namespace to export to must be specified")
+	}
+	session, err := newSession(region, id, secret)
+	if err != nil {
+		return nil, err
+	}
+	return &Exporter{
+		cloudmap:  servicediscovery.New(session),
+		source:    source,
+		namespace: namespace,
+		owner:     owner,
+		interval:  time.Second * 30,
+	}, nil
+}
+
+// Run the exporter until the context is cancelled
+func (e *Exporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.sync()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (e *Exporter) sync() {
+	ns, err := e.findNamespace()
+	if err != nil {
+		log.Errorf("unable to export to Cloud Map: %v", err)
+		return
+	}
+	services, err := e.listServices(ns)
+	if err != nil {
+		log.Errorf("unable to export to Cloud Map: %v", err)
+		return
+	}
+
+	// until the source has synced, services missing from it may not have gone away, so we only register
+	synced := e.source.HasSynced()
+	if !synced {
+		log.Infof("not deregistering instances from Cloud Map until the services to export are known")
+	}
+	desired := e.source.Instances()
+	for name, instances := range desired {
+		svc, ok := services[name]
+		if !ok {
+			if svc, err = e.createService(ns, name); err != nil {
+				log.Errorf("error creating Cloud Map service %q in %q: %v", name, e.namespace, err)
+				continue
+			}
+		}
+		if err := e.syncService(svc, instances, synced); err != nil {
+			log.Errorf("error exporting %q to Cloud Map: %v", name, err)
+		}
+	}
+	if !synced {
+		return
+	}
+	// deregister what we registered into services that are no longer exported; we never delete the services themselves
+	for name, svc := range services {
+		if _, ok := desired[name]; ok {
+			continue
+		}
+		if err := e.syncService(svc, nil, true); err != nil {
+			log.Errorf("error cleaning up exported instances of %q in Cloud Map: %v", name, err)
+		}
+	}
+}
+
+func (e *Exporter) findNamespace() (*servicediscovery.NamespaceSummary, error) {
+	var found *servicediscovery.NamespaceSummary
+	err := e.cloudmap.ListNamespacesPages(&servicediscovery.ListNamespacesInput{},
+		func(out *servicediscovery.ListNamespacesOutput, _ bool) bool {
+			for _, ns := range out.Namespaces {
+				if aws.StringValue(ns.Name) == e.namespace {
+					found = ns
+					return false
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return nil, errors.Wrap(err, "error retrieving namespace list from Cloud Map")
+	}
+	if found == nil {
+		return nil, errors.Errorf("Cloud Map namespace %q not found", e.namespace)
+	}
+	return found, nil
+}
+
+// listServices returns the services in the namespace keyed by name
+func (e *Exporter) listServices(ns *servicediscovery.NamespaceSummary) (map[string]*servicediscovery.ServiceSummary, error) {
+	services := make(map[string]*servicediscovery.ServiceSummary)
+	err := e.cloudmap.ListServicesPages(&servicediscovery.ListServicesInput{
+		Filters: []*servicediscovery.ServiceFilter{{
+			Name:      &serviceFilterNamespaceID,
+			Values:    []*string{ns.Id},
+			Condition: &filterConditionEquals,
+		}},
+	}, func(out *servicediscovery.ListServicesOutput, _ bool) bool {
+		for _, svc := range out.Services {
+			services[aws.StringValue(svc.Name)] = svc
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error retrieving service list from Cloud Map for namespace %q", e.namespace)
+	}
+	return services, nil
+}
+
+func (e *Exporter) createService(ns *servicediscovery.NamespaceSummary, name string) (*servicediscovery.ServiceSummary, error) {
+	in := &servicediscovery.CreateServiceInput{
+		Name:        aws.String(name),
+		NamespaceId: ns.Id,
+		Description: aws.String(exportedDescription(e.owner)),
+	}
+	// services in DNS namespaces must say which records to create; we only register IPv4 instances
+	if aws.StringValue(ns.Type) != servicediscovery.NamespaceTypeHttp {
+		in.DnsConfig = &servicediscovery.DnsConfig{
+			RoutingPolicy: aws.String(servicediscovery.RoutingPolicyMultivalue),
+			DnsRecords: []*servicediscovery.DnsRecord{{
+				Type: aws.String(servicediscovery.RecordTypeA),
+				TTL:  aws.Int64(60),
+			}},
+		}
+	}
+	out, err := e.cloudmap.CreateService(in)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("created Cloud Map service %q in %q", name, e.namespace)
+	return &servicediscovery.ServiceSummary{Id: out.Service.Id, Name: out.Service.Name}, nil
+}
+
+// syncService registers the instances missing from the service and, if deregister is set, deregisters those we own
+// that are no longer wanted
+func (e *Exporter) syncService(svc *servicediscovery.ServiceSummary, instances []export.Instance, deregister bool) error {
+	current := make(map[string]map[string]string)
+	err := e.cloudmap.ListInstancesPages(&servicediscovery.ListInstancesInput{ServiceId: svc.Id},
+		func(out *servicediscovery.ListInstancesOutput, _ bool) bool {
+			for _, inst := range out.Instances {
+				current[aws.StringValue(inst.Id)] = aws.StringValueMap(inst.Attributes)
+			}
+			return true
+		})
+	if err != nil {
+		return errors.Wrapf(err, "error listing instances of %q", aws.StringValue(svc.Name))
+	}
+
+	wanted := make(map[string]map[string]string, len(instances))
+	for _, inst := range instances {
+		if ip := net.ParseIP(inst.Address); ip == nil || ip.To4() == nil {
+			log.Infof("skipping export of %s:%d to %q, only IPv4 addresses are supported", inst.Address, inst.Port, aws.StringValue(svc.Name))
+			continue
+		}
+		wanted[instanceID(inst)] = map[string]string{
+			"AWS_INSTANCE_IPV4": inst.Address,
+			"AWS_INSTANCE_PORT": strconv.Itoa(int(inst.Port)),
+			ownerAttribute:      e.owner,
+		}
+	}
+
+	for id, attrs := range wanted {
+		if existing, ok := current[id]; ok {
+			if existing[ownerAttribute] != e.owner {
+				log.Infof("not exporting instance %q of %q, it was registered by someone else", id, aws.StringValue(svc.Name))
+				continue
+			}
+			if reflect.DeepEqual(existing, attrs) {
+				continue
+			}
+		}
+		if _, err := e.cloudmap.RegisterInstance(&servicediscovery.RegisterInstanceInput{
+			ServiceId:  svc.Id,
+			InstanceId: aws.String(id),
+			Attributes: aws.StringMap(attrs),
+		}); err != nil {
+			log.Errorf("error registering instance %q of %q: %v", id, aws.StringValue(svc.Name), err)
+			continue
+		}
+		log.Infof("registered instance %q of %q", id, aws.StringValue(svc.Name))
+	}
+
+	for id, attrs := range current {
+		if _, ok := wanted[id]; ok || attrs[ownerAttribute] != e.owner || !deregister {
+			continue
+		}
+		if _, err := e.cloudmap.DeregisterInstance(&servicediscovery.DeregisterInstanceInput{
+			ServiceId:  svc.Id,
+			InstanceId: aws.String(id),
+		}); err != nil {
+			log.Errorf("error deregistering instance %q of %q: %v", id, aws.StringValue(svc.Name), err)
+			continue
+		}
+		log.Infof("deregistered instance %q of %q", id, aws.StringValue(svc.Name))
+	}
+	return nil
+}
+
+// exportedDescription describes the services the Exporter marked by owner creates
+func exportedDescription(owner string) string {
+	return fmt.Sprintf("exported by %s", owner)
+}
+
+func instanceID(inst export.Instance) string {
+	return fmt.Sprintf("%s-%d", inst.Address, inst.Port)
+}
@@ -0,0 +1,204 @@
+package cloudmap
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/servicediscovery"
+
+	"github.com/tetratelabs/istio-cloud-map/pkg/export"
+)
+
+type mockExportAPI struct {
+	servicediscovery.ServiceDiscovery
+
+	namespaces []*servicediscovery.NamespaceSummary
+	services   []*servicediscovery.ServiceSummary
+	instances  map[string][]*servicediscovery.InstanceSummary // keyed by service ID
+
+	created      []*servicediscovery.CreateServiceInput
+	registered   []string // "<service ID>/<instance ID>"
+	deregistered []string
+}
+
+func (m *mockExportAPI) ListNamespacesPages(_ *servicediscovery.ListNamespacesInput,
+	fn func(*servicediscovery.ListNamespacesOutput, bool) bool) error {
+	fn(&servicediscovery.ListNamespacesOutput{Namespaces: m.namespaces}, true)
+	return nil
+}
+
+func (m *mockExportAPI) ListServicesPages(_ *servicediscovery.ListServicesInput,
+	fn func(*servicediscovery.ListServicesOutput, bool) bool) error {
+	fn(&servicediscovery.ListServicesOutput{Services: m.services}, true)
+	return nil
+}
+
+func (m *mockExportAPI) ListInstancesPages(lii *servicediscovery.ListInstancesInput,
+	fn func(*servicediscovery.ListInstancesOutput, bool) bool) error {
+	fn(&servicediscovery.ListInstancesOutput{Instances: m.instances[*lii.ServiceId]}, true)
+	return nil
+}
+
+func (m *mockExportAPI) CreateService(csi *servicediscovery.CreateServiceInput) (*servicediscovery.CreateServiceOutput, error) {
+	m.created = append(m.created, csi)
+	return &servicediscovery.CreateServiceOutput{
+		Service: &servicediscovery.Service{Id: aws.String("srv-" + *csi.Name), Name: csi.Name},
+	}, nil
+}
+
+func (m *mockExportAPI) RegisterInstance(rii *servicediscovery.RegisterInstanceInput) (*servicediscovery.RegisterInstanceOutput, error) {
+	m.registered = append(m.registered, *rii.ServiceId+"/"+*rii.InstanceId)
+	return &servicediscovery.RegisterInstanceOutput{}, nil
+}
+
+func (m *mockExportAPI) DeregisterInstance(dii *servicediscovery.DeregisterInstanceInput) (*servicediscovery.DeregisterInstanceOutput, error) {
+	m.deregistered = append(m.deregistered, *dii.ServiceId+"/"+*dii.InstanceId)
+	return &servicediscovery.DeregisterInstanceOutput{}, nil
+}
+
+type staticSource map[string][]export.Instance
+
+func (s staticSource) Instances() map[string][]export.Instance {
+	return s
+}
+
+func (s staticSource) HasSynced() bool {
+	return true
+}
+
+// unsyncedSource is a source whose listers haven't been filled yet
+type unsyncedSource struct {
+	staticSource
+}
+
+func (s unsyncedSource) HasSynced() bool {
+	return false
+}
+
+func ownedInstance(id, ip, port, owner string) *servicediscovery.InstanceSummary {
+	attrs := map[string]*string{"AWS_INSTANCE_IPV4": aws.String(ip), "AWS_INSTANCE_PORT": aws.String(port)}
+	if owner != "" {
+		attrs[ownerAttribute] = aws.String(owner)
+	}
+	return &servicediscovery.InstanceSummary{Id: aws.String(id), Attributes: attrs}
+}
+
+func TestExporter_sync(t *testing.T) {
+	namespaces := []*servicediscovery.NamespaceSummary{
+		{Id: aws.String("ns-1"), Name: aws.String("mesh.local"), Type: aws.String(servicediscovery.NamespaceTypeDnsPrivate)},
+	}
+	web := &servicediscovery.ServiceSummary{Id: aws.String("srv-web"), Name: aws.String("web.default")}
+	gone := &servicediscovery.ServiceSummary{Id: aws.String("srv-gone"), Name: aws.String("gone.default")}
+
+	tests := []struct {
+		name             string
+		source           staticSource
+		services         []*servicediscovery.ServiceSummary
+		instances        map[string][]*servicediscovery.InstanceSummary
+		wantCreated      []string
+		wantRegistered   []string
+		wantDeregistered []string
+	}{
+		{
+			name:           "creates missing services and registers their instances",
+			source:         staticSource{"web.default": {{Address: "10.0.0.1", Port: 8080}}},
+			wantCreated:    []string{"web.default"},
+			wantRegistered: []string{"srv-web.default/10.0.0.1-8080"},
+		},
+		{
+			name:      "leaves instances that are already registered alone",
+			source:    staticSource{"web.default": {{Address: "10.0.0.1", Port: 8080}}},
+			services:  []*servicediscovery.ServiceSummary{web},
+			instances: map[string][]*servicediscovery.InstanceSummary{"srv-web": {ownedInstance("10.0.0.1-8080", "10.0.0.1", "8080", "us")}},
+		},
+		{
+			name:     "deregisters our instances that have gone away",
+			source:   staticSource{"web.default": {{Address: "10.0.0.1", Port: 8080}}},
+			services: []*servicediscovery.ServiceSummary{web, gone},
+			instances: map[string][]*servicediscovery.InstanceSummary{
+				"srv-web":  {ownedInstance("10.0.0.1-8080", "10.0.0.1", "8080", "us"), ownedInstance("10.0.0.2-8080", "10.0.0.2", "8080", "us")},
+				"srv-gone": {ownedInstance("10.0.0.3-80", "10.0.0.3", "80", "us")},
+			},
+			wantDeregistered: []string{"srv-gone/10.0.0.3-80", "srv-web/10.0.0.2-8080"},
+		},
+		{
+			name:     "never touches instances registered by someone else",
+			source:   staticSource{"web.default": {{Address: "10.0.0.1", Port: 8080}}},
+			services: []*servicediscovery.ServiceSummary{web, gone},
+			instances: map[string][]*servicediscovery.InstanceSummary{
+				"srv-web":  {ownedInstance("10.0.0.1-8080", "10.0.0.9", "9090", "")},
+				"srv-gone": {ownedInstance("10.0.0.3-80", "10.0.0.3", "80", "them")},
+			},
+		},
+		{
+			name:           "skips addresses that aren't IPv4",
+			source:         staticSource{"web.default": {{Address: "::1", Port: 8080}, {Address: "10.0.0.1", Port: 8080}}},
+			services:       []*servicediscovery.ServiceSummary{web},
+			wantRegistered: []string{"srv-web/10.0.0.1-8080"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &mockExportAPI{namespaces: namespaces, services: tt.services, instances: tt.instances}
+			e := &Exporter{cloudmap: mockAPI, source: tt.source, namespace: "mesh.local", owner: "us"}
+			e.sync()
+
+			var created []string
+			for _, c := range mockAPI.created {
+				created = append(created, *c.Name)
+				if c.DnsConfig == nil {
+					t.Errorf("service %q created in a DNS namespace without a DNS config", *c.Name)
+				}
+			}
+			sort.Strings(mockAPI.deregistered)
+			if !reflect.DeepEqual(created, tt.wantCreated) {
+				t.Errorf("created services %v, want %v", created, tt.wantCreated)
+			}
+			if !reflect.DeepEqual(mockAPI.registered, tt.wantRegistered) {
+				t.Errorf("registered instances %v, want %v", mockAPI.registered, tt.wantRegistered)
+			}
+			if !reflect.DeepEqual(mockAPI.deregistered, tt.wantDeregistered) {
+				t.Errorf("deregistered instances %v, want %v", mockAPI.deregistered, tt.wantDeregistered)
+			}
+		})
+	}
+
+	t.Run("deregisters nothing until the source has synced", func(t *testing.T) {
+		mockAPI := &mockExportAPI{
+			namespaces: namespaces,
+			services:   []*servicediscovery.ServiceSummary{web, gone},
+			instances: map[string][]*servicediscovery.InstanceSummary{
+				"srv-web":  {ownedInstance("10.0.0.2-8080", "10.0.0.2", "8080", "us")},
+				"srv-gone": {ownedInstance("10.0.0.3-80", "10.0.0.3", "80", "us")},
+			},
+		}
+		source := unsyncedSource{staticSource{"web.default": {{Address: "10.0.0.1", Port: 8080}}}}
+		e := &Exporter{cloudmap: mockAPI, source: source, namespace: "mesh.local", owner: "us"}
+		e.sync()
+		if len(mockAPI.deregistered) != 0 {
+			t.Errorf("deregistered instances %v before the source synced, want none", mockAPI.deregistered)
+		}
+		if want := []string{"srv-web/10.0.0.1-8080"}; !reflect.DeepEqual(mockAPI.registered, want) {
+			t.Errorf("registered instances %v, want %v", mockAPI.registered, want)
+		}
+
+		mockAPI.registered = nil
+		e.source = unsyncedSource{}
+		e.sync()
+		if len(mockAPI.deregistered) != 0 || len(mockAPI.registered) != 0 {
+			t.Errorf("an empty source that hasn't synced registered %v and deregistered %v, want neither",
+				mockAPI.registered, mockAPI.deregistered)
+		}
+	})
+
+	t.Run("does nothing if the namespace doesn't exist", func(t *testing.T) {
+		mockAPI := &mockExportAPI{namespaces: namespaces}
+		e := &Exporter{cloudmap: mockAPI, source: staticSource{"web.default": {{Address: "10.0.0.1", Port: 8080}}}, namespace: "other", owner: "us"}
+		e.sync()
+		if len(mockAPI.created) != 0 || len(mockAPI.registered) != 0 {
+			t.Errorf("expected no calls, created %v and registered %v", mockAPI.created, mockAPI.registered)
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package cloudmap
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+
+	"github.com/tetratelabs/log"
+)
+
+// Cloud Map API calls that change the instances of a single, already existing, service.
+// Any other event (creating or deleting services or namespaces, for example) causes a full sync.
+var instanceEvents = map[string]bool{
+	"RegisterInstance":                 true,
+	"DeregisterInstance":               true,
+	"UpdateInstanceCustomHealthStatus": true,
+}
+
+// event is the part of a Cloud Map API call, delivered by EventBridge as a CloudTrail event, that we care about
+type event struct {
+	Source string `json:"source"`
+	Detail struct {
+		EventName         string `json:"eventName"`
+		RequestParameters struct {
+			ServiceID string `json:"serviceId"`
+		} `json:"requestParameters"`
+	} `json:"detail"`
+}
+
+// serviceIDFromEvent returns the ID of the service changed by the event in body,
+// or the empty string if the event doesn't identify a single service.
+func serviceIDFromEvent(body string) string {
+	var e event
+	if err := json.Unmarshal([]byte(body), &e); err != nil {
+		log.Errorf("error parsing Cloud Map notification %q: %v", body, err)
+		return ""
+	}
+	if e.Source != "aws.servicediscovery" || !instanceEvents[e.Detail.EventName] {
+		return ""
+	}
+	return e.Detail.RequestParameters.ServiceID
+}
+
+// receive long polls the queue until the context is cancelled, sending the IDs of the services
+// named in each batch of events on changes and then deleting the batch from the queue.
+func (w *watcher) receive(ctx context.Context, changes chan<- []string) {
+	for ctx.Err() == nil {
+		out, err := w.queue.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            &w.queueURL,
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(20),
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Errorf("error receiving Cloud Map notifications from %q: %v", w.queueURL, err)
+			// back off so we don't spin on a queue we can't read; the resync still keeps the store fresh
+			select {
+			case <-time.After(w.interval):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		if len(out.Messages) == 0 {
+			continue
+		}
+
+		ids := make([]string, 0, len(out.Messages))
+		entries := make([]*sqs.DeleteMessageBatchRequestEntry, 0, len(out.Messages))
+		for i, m := range out.Messages {
+			ids = append(ids, serviceIDFromEvent(aws.StringValue(m.Body)))
+			entries = append(entries, &sqs.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(i)),
+				ReceiptHandle: m.ReceiptHandle,
+			})
+		}
+		select {
+		case changes <- ids:
+		case <-ctx.Done():
+			return
+		}
+		if _, err := w.queue.DeleteMessageBatchWithContext(ctx, &sqs.DeleteMessageBatchInput{
+			QueueUrl: &w.queueURL,
+			Entries:  entries,
+		}); err != nil {
+			log.Errorf("error deleting Cloud Map notifications from %q: %v", w.queueURL, err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package cloudmap
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/servicediscovery"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"istio.io/api/networking/v1alpha3"
+
+	"github.com/tetratelabs/istio-cloud-map/pkg/provider"
+)
+
+// fakeSQS hands out each of its batches once, then blocks like an empty long poll until the context is done
+type fakeSQS struct {
+	sqsiface.SQSAPI
+
+	m       sync.Mutex
+	batches [][]*sqs.Message
+	deleted []*string
+}
+
+func (f *fakeSQS) ReceiveMessageWithContext(ctx aws.Context, _ *sqs.ReceiveMessageInput, _ ...request.Option) (
+	*sqs.ReceiveMessageOutput, error) {
+	f.m.Lock()
+	if len(f.batches) > 0 {
+		batch := f.batches[0]
+		f.batches = f.batches[1:]
+		f.m.Unlock()
+		return &sqs.ReceiveMessageOutput{Messages: batch}, nil
+	}
+	f.m.Unlock()
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (f *fakeSQS) DeleteMessageBatchWithContext(_ aws.Context, in *sqs.DeleteMessageBatchInput, _ ...request.Option) (
+	*sqs.DeleteMessageBatchOutput, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	for _, e := range in.Entries {
+		f.deleted = append(f.deleted, e.ReceiptHandle)
+	}
+	return &sqs.DeleteMessageBatchOutput{}, nil
+}
+
+func registerEvent(serviceID string) string {
+	return `{"source":"aws.servicediscovery","detail-type":"AWS API Call via CloudTrail",` +
+		`"detail":{"eventName":"RegisterInstance","requestParameters":{"serviceId":"` + serviceID + `","instanceId":"i-1"}}}`
+}
+
+func Test_serviceIDFromEvent(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "instance registration", body: registerEvent("srv-1"), want: "srv-1"},
+		{
+			name: "instance deregistration",
+			body: `{"source":"aws.servicediscovery","detail":{"eventName":"DeregisterInstance","requestParameters":{"serviceId":"srv-2"}}}`,
+			want: "srv-2",
+		},
+		{
+			name: "service deletion needs a full sync",
+			body: `{"source":"aws.servicediscovery","detail":{"eventName":"DeleteService","requestParameters":{"id":"srv-2"}}}`,
+		},
+		{
+			name: "other sources need a full sync",
+			body: `{"source":"aws.ec2","detail":{"eventName":"RegisterInstance","requestParameters":{"serviceId":"srv-2"}}}`,
+		},
+		{name: "malformed events need a full sync", body: "bang"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serviceIDFromEvent(tt.body); got != tt.want {
+				t.Errorf("serviceIDFromEvent() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatcher_receive(t *testing.T) {
+	queue := &fakeSQS{batches: [][]*sqs.Message{{
+		{Body: aws.String(registerEvent("srv-1")), ReceiptHandle: aws.String("r-1")},
+		{Body: aws.String("bang"), ReceiptHandle: aws.String("r-2")},
+	}}}
+	w := &watcher{queue: queue, queueURL: "queue", interval: time.Millisecond}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan []string)
+	go w.receive(ctx, changes)
+
+	select {
+	case ids := <-changes:
+		if want := []string{"srv-1", ""}; !reflect.DeepEqual(ids, want) {
+			t.Errorf("receive() sent %v, want %v", ids, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("receive() never sent the changed services")
+	}
+	// deletion happens after the IDs are handed off
+	deadline := time.Now().Add(time.Second)
+	for {
+		queue.m.Lock()
+		deleted := len(queue.deleted)
+		queue.m.Unlock()
+		if deleted == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected both messages to be deleted, got %d", deleted)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWatcher_refreshServices(t *testing.T) {
+	serviceID := "srv-1"
+	svc := &servicediscovery.ServiceSummary{Id: &serviceID, Name: &subdomain}
+	ns := &servicediscovery.NamespaceSummary{Id: &hostname, Name: &hostname}
+	other := map[string][]*v1alpha3.ServiceEntry_Endpoint{"other.tetrate.io": {inferedIPv42Endpoint}}
+
+	tests := []struct {
+		name string
+		ids  []string
+		want map[string][]*v1alpha3.ServiceEntry_Endpoint
+	}{
+		{
+			name: "known service is refreshed and other hosts kept",
+			ids:  []string{serviceID},
+			want: map[string][]*v1alpha3.ServiceEntry_Endpoint{
+				"other.tetrate.io": {inferedIPv42Endpoint},
+				"demo.tetrate.io":  {inferedIPv41Endpoint},
+			},
+		},
+		{
+			name: "unknown service triggers a full sync",
+			ids:  []string{"srv-unknown"},
+			want: map[string][]*v1alpha3.ServiceEntry_Endpoint{"demo.tetrate.io": {inferedIPv41Endpoint}},
+		},
+		{
+			name: "unidentified change triggers a full sync",
+			ids:  []string{""},
+			want: map[string][]*v1alpha3.ServiceEntry_Endpoint{"demo.tetrate.io": {inferedIPv41Endpoint}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &mockSDAPI{
+				ListNsResult:   goldenPathListNamespaces,
+				ListSvcResult:  goldenPathListServices,
+				DiscInstResult: goldenPathDiscoverInstances,
+			}
+			w := &watcher{
+				cloudmap: mockAPI,
+				store:    provider.NewStore(),
+				services: map[string]service{serviceID: {svc: svc, ns: ns}},
+			}
+			w.store.Set(other)
+			w.refreshServices(tt.ids)
+			if !reflect.DeepEqual(w.store.Hosts(), tt.want) {
+				t.Errorf("Watcher.store = %v, want %v", w.store.Hosts(), tt.want)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -12,6 +13,8 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/servicediscovery"
 	"github.com/aws/aws-sdk-go/service/servicediscovery/servicediscoveryiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 	"github.com/pkg/errors"
 	"istio.io/api/networking/v1alpha3"
 
@@ -28,8 +31,52 @@ var filterConditionEquals = servicediscovery.FilterConditionEq
 // https://pkg.go.dev/github.com/aws/aws-sdk-go/aws/credentials?tab=doc#NewStaticCredentials
 const emptyToken = ""
 
+// Options configures how the watcher discovers Cloud Map instances
+type Options struct {
+	// ListInstancesNamespaces are the names of the namespaces whose instances are discovered with ListInstances
+	// and GetInstancesHealthStatus rather than DiscoverInstances; "*" selects every namespace.
+	ListInstancesNamespaces []string
+
+	// QueueURL is the SQS queue that EventBridge delivers Cloud Map change events to. When set the watcher
+	// re-discovers only the services named in events, and falls back to a full sync every ResyncInterval.
+	QueueURL       string
+	ResyncInterval time.Duration
+
+	// Owner is the ID the Exporter marks the instances it registers with. Those instances, and the services it created
+	// and registers nothing else into, are services of the mesh, so they're never imported back into it.
+	Owner string
+}
+
 // NewWatcher returns a Cloud Map watcher
-func NewWatcher(store provider.Store, region, id, secret string) (provider.Watcher, error) {
+func NewWatcher(store provider.Store, region, id, secret string, opts Options) (provider.Watcher, error) {
+	session, err := newSession(region, id, secret)
+	if err != nil {
+		return nil, err
+	}
+	listNamespaces := make(map[string]bool, len(opts.ListInstancesNamespaces))
+	for _, ns := range opts.ListInstancesNamespaces {
+		listNamespaces[ns] = true
+	}
+	w := &watcher{
+		cloudmap:       servicediscovery.New(session),
+		store:          store,
+		interval:       time.Second * 5,
+		listNamespaces: listNamespaces,
+		owner:          opts.Owner,
+	}
+	if len(opts.QueueURL) > 0 {
+		if opts.ResyncInterval <= 0 {
+			return nil, errors.New("resync interval must be positive when consuming Cloud Map notifications")
+		}
+		w.queue = sqs.New(session)
+		w.queueURL = opts.QueueURL
+		w.resyncInterval = opts.ResyncInterval
+	}
+	return w, nil
+}
+
+// newSession returns an AWS session for the region using the static credentials, if set, or the environment
+func newSession(region, id, secret string) (*session.Session, error) {
 	if len(region) == 0 {
 		var ok bool
 		if region, ok = os.LookupEnv("AWS_REGION"); !ok {
@@ -44,21 +91,36 @@ func NewWatcher(store provider.Store, region, id, secret string) (provider.Watch
 		creds = credentials.NewStaticCredentials(id, secret, emptyToken)
 	}
 
-	session, err := session.NewSession(&aws.Config{
+	s, err := session.NewSession(&aws.Config{
 		Credentials: creds,
 		Region:      aws.String(region),
 	})
 	if err != nil {
 		return nil, errors.Wrap(err, "error setting up AWS session")
 	}
-	return &watcher{cloudmap: servicediscovery.New(session), store: store, interval: time.Second * 5}, nil
+	return s, nil
 }
 
 // watcher polls Cloud Map and caches a list of services and their instances
 type watcher struct {
-	cloudmap servicediscoveryiface.ServiceDiscoveryAPI
-	store    provider.Store
-	interval time.Duration
+	cloudmap       servicediscoveryiface.ServiceDiscoveryAPI
+	store          provider.Store
+	interval       time.Duration
+	listNamespaces map[string]bool // namespace names discovered via ListInstances; "*" means all
+	owner          string          // ID of the Exporter, whose instances we don't import
+
+	// optional notification mode; nil queue means we only poll
+	queue          sqsiface.SQSAPI
+	queueURL       string
+	resyncInterval time.Duration
+	services       map[string]service // maps Cloud Map service ID->service as of the last full sync
+}
+
+// service is a Cloud Map service along with the namespace it belongs to
+type service struct {
+	svc        *servicediscovery.ServiceSummary
+	ns         *servicediscovery.NamespaceSummary
+	attributes map[string]string // attributes every instance shares
 }
 
 var _ provider.Watcher = &watcher{}
@@ -73,7 +135,14 @@ func (w *watcher) Prefix() string {
 
 // Run the watcher until the context is cancelled
 func (w *watcher) Run(ctx context.Context) {
-	ticker := time.NewTicker(w.interval)
+	interval := w.interval
+	var changes chan []string // stays nil, and so is never selected, unless we consume notifications
+	if w.queue != nil {
+		interval = w.resyncInterval
+		changes = make(chan []string)
+		go w.receive(ctx, changes)
+	}
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	// Initial sync on startup
@@ -82,6 +151,8 @@ func (w *watcher) Run(ctx context.Context) {
 		select {
 		case <-ticker.C:
 			w.refreshStore()
+		case ids := <-changes:
+			w.refreshServices(ids)
 		case <-ctx.Done():
 			return
 		}
@@ -98,8 +169,9 @@ func (w *watcher) refreshStore() {
 	}
 	// We want to continue to use existing store on error
 	tempStore := map[string][]*v1alpha3.ServiceEntry_Endpoint{}
+	services := map[string]service{}
 	for _, ns := range nsResp.Namespaces {
-		hosts, err := w.hostsForNamespace(ns)
+		hosts, err := w.hostsForNamespace(ns, services)
 		if err != nil {
 			log.Errorf("unable to refresh Cloud Map cache due to error, using existing cache: %v", err)
 			return
@@ -110,10 +182,59 @@ func (w *watcher) refreshStore() {
 		}
 	}
 	log.Info("Cloud Map store sync successful")
+	w.store.SetMeta(hostsMeta(services))
 	w.store.Set(tempStore)
+	w.services = services
 }
 
-func (w *watcher) hostsForNamespace(ns *servicediscovery.NamespaceSummary) (map[string][]*v1alpha3.ServiceEntry_Endpoint, error) {
+// hostsMeta describes the services behind the hosts
+func hostsMeta(services map[string]service) map[string]provider.HostMeta {
+	meta := make(map[string]provider.HostMeta, len(services))
+	for id, s := range services {
+		meta[fmt.Sprintf("%v.%v", *s.svc.Name, *s.ns.Name)] = provider.HostMeta{
+			Provider:   "cloudmap",
+			Namespace:  aws.StringValue(s.ns.Name),
+			Service:    aws.StringValue(s.svc.Name),
+			Meta:       map[string]string{"namespaceId": aws.StringValue(s.ns.Id), "serviceId": id},
+			Attributes: s.attributes,
+		}
+	}
+	return meta
+}
+
+// refreshServices re-discovers the instances of the services with the given IDs, leaving all other hosts untouched.
+// An empty or unknown ID means we can't tell what changed, so we fall back to a full sync.
+func (w *watcher) refreshServices(ids []string) {
+	hosts := w.store.Hosts()
+	for _, id := range ids {
+		s, ok := w.services[id]
+		if !ok {
+			log.Infof("notified of a change to unknown Cloud Map service %q, syncing everything", id)
+			w.refreshStore()
+			return
+		}
+		eps, attributes, err := w.endpointsForService(s.svc, s.ns)
+		if err != nil {
+			log.Errorf("unable to refresh Cloud Map service %q, keeping existing endpoints: %v", id, err)
+			continue
+		}
+		host := fmt.Sprintf("%v.%v", *s.svc.Name, *s.ns.Name)
+		if eps == nil {
+			delete(w.services, id)
+			delete(hosts, host)
+			continue
+		}
+		s.attributes = attributes
+		w.services[id] = s
+		log.Infof("%v Endpoints found for %q", len(eps), host)
+		hosts[host] = eps
+	}
+	w.store.SetMeta(hostsMeta(w.services))
+	w.store.Set(hosts)
+}
+
+// hostsForNamespace returns the hosts of every service in the namespace, recording the services it sees by ID.
+func (w *watcher) hostsForNamespace(ns *servicediscovery.NamespaceSummary, services map[string]service) (map[string][]*v1alpha3.ServiceEntry_Endpoint, error) {
 	hosts := map[string][]*v1alpha3.ServiceEntry_Endpoint{}
 	svcResp, err := w.cloudmap.ListServices(&servicediscovery.ListServicesInput{
 		Filters: []*servicediscovery.ServiceFilter{
@@ -129,30 +250,135 @@ func (w *watcher) hostsForNamespace(ns *servicediscovery.NamespaceSummary) (map[
 	}
 	for _, svc := range svcResp.Services {
 		host := fmt.Sprintf("%v.%v", *svc.Name, *ns.Name)
-		eps, err := w.endpointsForService(svc, ns)
+		eps, attributes, err := w.endpointsForService(svc, ns)
 		if err != nil {
 			return nil, err
 		}
+		if eps == nil {
+			continue
+		}
 		log.Infof("%v Endpoints found for %q", len(eps), host)
 		hosts[host] = eps
+		if id := aws.StringValue(svc.Id); len(id) > 0 {
+			services[id] = service{svc: svc, ns: ns, attributes: attributes}
+		}
 	}
 	return hosts, nil
 }
 
-func (w *watcher) endpointsForService(svc *servicediscovery.ServiceSummary, ns *servicediscovery.NamespaceSummary) ([]*v1alpha3.ServiceEntry_Endpoint, error) {
-	// TODO: use health filter?
-	instOutput, err := w.cloudmap.DiscoverInstances(&servicediscovery.DiscoverInstancesInput{ServiceName: svc.Name, NamespaceName: ns.Name})
+// endpointsForService returns the endpoints of the service's instances, and the attributes they all share. Instances
+// we exported are left out, and if the service has no others, it's one of ours and there are no endpoints at all.
+func (w *watcher) endpointsForService(svc *servicediscovery.ServiceSummary, ns *servicediscovery.NamespaceSummary) ([]*v1alpha3.ServiceEntry_Endpoint, map[string]string, error) {
+	var instances []*servicediscovery.HttpInstanceSummary
+	var err error
+	if w.listNamespaces["*"] || w.listNamespaces[*ns.Name] {
+		instances, err = w.listInstances(svc, ns)
+	} else {
+		instances, err = w.discoverInstances(svc, ns)
+	}
 	if err != nil {
-		return nil, errors.Wrapf(err, "error retrieving instance list from Cloud Map for %q in %q", *svc.Name, *ns.Name)
+		return nil, nil, err
+	}
+	var exported int
+	if instances, exported = w.imported(instances); len(instances) == 0 && (exported > 0 || w.exported(svc)) {
+		log.Debugf("skipping Cloud Map service %v.%v, it's exported from the mesh", *svc.Name, *ns.Name)
+		return nil, nil, nil
+	}
+	attributes := make([]map[string]string, 0, len(instances))
+	for _, inst := range instances {
+		attributes = append(attributes, aws.StringValueMap(inst.Attributes))
 	}
 	// Inject host based instance if there are no instances
-	if len(instOutput.Instances) == 0 {
+	if len(instances) == 0 {
 		host := fmt.Sprintf("%v.%v", *svc.Name, *ns.Name)
-		instOutput.Instances = []*servicediscovery.HttpInstanceSummary{
+		instances = []*servicediscovery.HttpInstanceSummary{
 			&servicediscovery.HttpInstanceSummary{Attributes: map[string]*string{"AWS_INSTANCE_CNAME": &host}},
 		}
 	}
-	return instancesToEndpoints(instOutput.Instances), nil
+	return instancesToEndpoints(instances), provider.SharedAttributes(attributes...), nil
+}
+
+// imported returns the instances that weren't exported by us, and how many were
+func (w *watcher) imported(instances []*servicediscovery.HttpInstanceSummary) ([]*servicediscovery.HttpInstanceSummary, int) {
+	if len(w.owner) == 0 {
+		return instances, 0
+	}
+	out := make([]*servicediscovery.HttpInstanceSummary, 0, len(instances))
+	for _, inst := range instances {
+		if aws.StringValue(inst.Attributes[ownerAttribute]) != w.owner {
+			out = append(out, inst)
+		}
+	}
+	return out, len(instances) - len(out)
+}
+
+// exported reports whether the service was created by our Exporter
+func (w *watcher) exported(svc *servicediscovery.ServiceSummary) bool {
+	return len(w.owner) > 0 && aws.StringValue(svc.Description) == exportedDescription(w.owner)
+}
+
+// discoverInstances uses the data-plane DiscoverInstances API, which only returns healthy instances
+func (w *watcher) discoverInstances(svc *servicediscovery.ServiceSummary, ns *servicediscovery.NamespaceSummary) ([]*servicediscovery.HttpInstanceSummary, error) {
+	instOutput, err := w.cloudmap.DiscoverInstances(&servicediscovery.DiscoverInstancesInput{ServiceName: svc.Name, NamespaceName: ns.Name})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error retrieving instance list from Cloud Map for %q in %q", *svc.Name, *ns.Name)
+	}
+	return instOutput.Instances, nil
+}
+
+// listInstances pages through every instance registered to the service, dropping those Cloud Map doesn't report as
+// healthy: like DiscoverInstances, instances whose health checks haven't passed yet, which are UNKNOWN, are left out.
+// The instances are returned in the same shape as DiscoverInstances so both modes share the endpoint conversion.
+func (w *watcher) listInstances(svc *servicediscovery.ServiceSummary, ns *servicediscovery.NamespaceSummary) ([]*servicediscovery.HttpInstanceSummary, error) {
+	health, err := w.instancesHealth(svc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error retrieving instance health from Cloud Map for %q in %q", *svc.Name, *ns.Name)
+	}
+
+	var instances []*servicediscovery.HttpInstanceSummary
+	err = w.cloudmap.ListInstancesPages(&servicediscovery.ListInstancesInput{ServiceId: svc.Id},
+		func(out *servicediscovery.ListInstancesOutput, _ bool) bool {
+			for _, inst := range out.Instances {
+				status, ok := health[aws.StringValue(inst.Id)]
+				if ok && status != servicediscovery.HealthStatusHealthy {
+					log.Infof("skipping %v instance %v of %v.%v", strings.ToLower(status), aws.StringValue(inst.Id), *svc.Name, *ns.Name)
+					continue
+				}
+				var healthStatus *string
+				if ok {
+					healthStatus = aws.String(status)
+				}
+				instances = append(instances, &servicediscovery.HttpInstanceSummary{
+					InstanceId:    inst.Id,
+					ServiceName:   svc.Name,
+					NamespaceName: ns.Name,
+					Attributes:    inst.Attributes,
+					HealthStatus:  healthStatus,
+				})
+			}
+			return true
+		})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing instances from Cloud Map for %q in %q", *svc.Name, *ns.Name)
+	}
+	return instances, nil
+}
+
+// instancesHealth returns the health status of each of the service's instances keyed by instance ID.
+// Services without a health check have no status, so we don't ask for one.
+func (w *watcher) instancesHealth(svc *servicediscovery.ServiceSummary) (map[string]string, error) {
+	health := map[string]string{}
+	if svc.HealthCheckConfig == nil && svc.HealthCheckCustomConfig == nil {
+		return health, nil
+	}
+	err := w.cloudmap.GetInstancesHealthStatusPages(&servicediscovery.GetInstancesHealthStatusInput{ServiceId: svc.Id},
+		func(out *servicediscovery.GetInstancesHealthStatusOutput, _ bool) bool {
+			for id, status := range out.Status {
+				health[id] = aws.StringValue(status)
+			}
+			return true
+		})
+	return health, err
 }
 
 func instancesToEndpoints(instances []*servicediscovery.HttpInstanceSummary) []*v1alpha3.ServiceEntry_Endpoint {
@@ -185,5 +411,5 @@ func instanceToEndpoint(instance *servicediscovery.HttpInstanceSummary) *v1alpha
 		log.Errorf("error converting Port string %v to int: %v", *port, err)
 	}
 	log.Infof("no port found for address %v, assuming http (80) and https (443)", address)
-	return &v1alpha3.ServiceEntry_Endpoint{Address: address, Ports: map[string]uint32{"http": 80, "https": 443}}
+	return infer.EndpointWithPorts(address, 80, 443)
 }
@@ -6,6 +6,7 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/servicediscovery"
 	"istio.io/api/networking/v1alpha3"
 
@@ -21,6 +22,10 @@ type mockSDAPI struct {
 	ListSvcErr     error
 	DiscInstResult *servicediscovery.DiscoverInstancesOutput
 	DiscInstErr    error
+	ListInstPages  []*servicediscovery.ListInstancesOutput
+	ListInstErr    error
+	HealthResult   *servicediscovery.GetInstancesHealthStatusOutput
+	HealthErr      error
 }
 
 func (m *mockSDAPI) ListNamespaces(lni *servicediscovery.ListNamespacesInput) (
@@ -47,14 +52,39 @@ func (m *mockSDAPI) DiscoverInstances(dii *servicediscovery.DiscoverInstancesInp
 	return m.DiscInstResult, m.DiscInstErr
 }
 
+func (m *mockSDAPI) ListInstancesPages(lii *servicediscovery.ListInstancesInput,
+	fn func(*servicediscovery.ListInstancesOutput, bool) bool) error {
+	if lii.ServiceId == nil {
+		return errors.New("Service ID was not provided")
+	}
+	for i, page := range m.ListInstPages {
+		if !fn(page, i == len(m.ListInstPages)-1) {
+			break
+		}
+	}
+	return m.ListInstErr
+}
+
+func (m *mockSDAPI) GetInstancesHealthStatusPages(gihsi *servicediscovery.GetInstancesHealthStatusInput,
+	fn func(*servicediscovery.GetInstancesHealthStatusOutput, bool) bool) error {
+	if gihsi.ServiceId == nil {
+		return errors.New("Service ID was not provided")
+	}
+	if m.HealthResult != nil {
+		fn(m.HealthResult, true)
+	}
+	return m.HealthErr
+}
+
 // various strings to allow pointer usage
 var ipv41, ipv42, subdomain, hostname, portStr, httpPortStr = "8.8.8.8", "9.9.9.9", "demo", "tetrate.io", "9999", "80"
 var cname = fmt.Sprintf("%v.%v", subdomain, hostname)
+var owner = "istio-cloud-map-operator"
 
 // golden path responses
-var inferedIPv41Endpoint = &v1alpha3.ServiceEntry_Endpoint{Address: ipv41, Ports: map[string]uint32{"http": 80, "https": 443}}
-var inferedIPv42Endpoint = &v1alpha3.ServiceEntry_Endpoint{Address: ipv42, Ports: map[string]uint32{"http": 80, "https": 443}}
-var inferedHostEndpoint = &v1alpha3.ServiceEntry_Endpoint{Address: cname, Ports: map[string]uint32{"http": 80, "https": 443}}
+var inferedIPv41Endpoint = &v1alpha3.ServiceEntry_Endpoint{Address: ipv41, Ports: map[string]uint32{"http-80": 80, "https-443": 443}}
+var inferedIPv42Endpoint = &v1alpha3.ServiceEntry_Endpoint{Address: ipv42, Ports: map[string]uint32{"http-80": 80, "https-443": 443}}
+var inferedHostEndpoint = &v1alpha3.ServiceEntry_Endpoint{Address: cname, Ports: map[string]uint32{"http-80": 80, "https-443": 443}}
 
 var goldenPathListNamespaces = &servicediscovery.ListNamespacesOutput{
 	Namespaces: []*servicediscovery.NamespaceSummary{
@@ -145,6 +175,34 @@ func TestWatcher_hostsForNamespace(t *testing.T) {
 			},
 			want: map[string][]*v1alpha3.ServiceEntry_Endpoint{"demo.tetrate.io": []*v1alpha3.ServiceEntry_Endpoint{inferedHostEndpoint}},
 		},
+		{
+			name:       "leaves out instances we exported",
+			ns:         &servicediscovery.NamespaceSummary{Id: &hostname, Name: &hostname},
+			listSvcRes: goldenPathListServices,
+			discInstRes: &servicediscovery.DiscoverInstancesOutput{Instances: []*servicediscovery.HttpInstanceSummary{
+				{Attributes: map[string]*string{"AWS_INSTANCE_IPV4": &ipv41}},
+				{Attributes: map[string]*string{"AWS_INSTANCE_IPV4": &ipv42, ownerAttribute: &owner}},
+			}},
+			want: map[string][]*v1alpha3.ServiceEntry_Endpoint{"demo.tetrate.io": []*v1alpha3.ServiceEntry_Endpoint{inferedIPv41Endpoint}},
+		},
+		{
+			name:       "skips services whose instances we all exported",
+			ns:         &servicediscovery.NamespaceSummary{Id: &hostname, Name: &hostname},
+			listSvcRes: goldenPathListServices,
+			discInstRes: &servicediscovery.DiscoverInstancesOutput{Instances: []*servicediscovery.HttpInstanceSummary{
+				{Attributes: map[string]*string{"AWS_INSTANCE_IPV4": &ipv42, ownerAttribute: &owner}},
+			}},
+			want: map[string][]*v1alpha3.ServiceEntry_Endpoint{},
+		},
+		{
+			name: "skips services we created to export into",
+			ns:   &servicediscovery.NamespaceSummary{Id: &hostname, Name: &hostname},
+			listSvcRes: &servicediscovery.ListServicesOutput{Services: []*servicediscovery.ServiceSummary{
+				{Name: &subdomain, Description: aws.String(exportedDescription(owner))},
+			}},
+			discInstRes: &servicediscovery.DiscoverInstancesOutput{},
+			want:        map[string][]*v1alpha3.ServiceEntry_Endpoint{},
+		},
 		{
 			name:        "errors if DiscoverInstances errors",
 			ns:          &servicediscovery.NamespaceSummary{Id: &hostname, Name: &hostname},
@@ -165,8 +223,8 @@ func TestWatcher_hostsForNamespace(t *testing.T) {
 				DiscInstResult: tt.discInstRes, DiscInstErr: tt.discInstErr,
 				ListSvcResult: tt.listSvcRes, ListSvcErr: tt.listSvcErr,
 			}
-			w := &watcher{cloudmap: mockAPI}
-			got, err := w.hostsForNamespace(tt.ns)
+			w := &watcher{cloudmap: mockAPI, owner: owner}
+			got, err := w.hostsForNamespace(tt.ns, map[string]service{})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Watcher.hostsForNamespace() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -214,7 +272,87 @@ func TestWatcher_EndpointsForService(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			mockAPI := &mockSDAPI{DiscInstResult: tt.discInstRes, DiscInstErr: tt.discInstErr}
 			w := &watcher{cloudmap: mockAPI}
-			got, err := w.endpointsForService(tt.svc, tt.ns)
+			got, _, err := w.endpointsForService(tt.svc, tt.ns)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Watcher.endpointsForService() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Watcher.endpointsForService() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatcher_listInstances(t *testing.T) {
+	instID1, instID2, healthy, unhealthy, unknown := "i-1", "i-2", servicediscovery.HealthStatusHealthy,
+		servicediscovery.HealthStatusUnhealthy, servicediscovery.HealthStatusUnknown
+	pages := []*servicediscovery.ListInstancesOutput{
+		{Instances: []*servicediscovery.InstanceSummary{{Id: &instID1, Attributes: map[string]*string{"AWS_INSTANCE_IPV4": &ipv41}}}},
+		{Instances: []*servicediscovery.InstanceSummary{{Id: &instID2, Attributes: map[string]*string{"AWS_INSTANCE_IPV4": &ipv42}}}},
+	}
+	tests := []struct {
+		name      string
+		svc       *servicediscovery.ServiceSummary
+		pages     []*servicediscovery.ListInstancesOutput
+		listErr   error
+		health    *servicediscovery.GetInstancesHealthStatusOutput
+		healthErr error
+		want      []*v1alpha3.ServiceEntry_Endpoint
+		wantErr   bool
+	}{
+		{
+			name:  "Returns instances from every page",
+			svc:   &servicediscovery.ServiceSummary{Id: &subdomain, Name: &subdomain},
+			pages: pages,
+			want:  []*v1alpha3.ServiceEntry_Endpoint{inferedIPv41Endpoint, inferedIPv42Endpoint},
+		},
+		{
+			name:  "Drops unhealthy instances",
+			svc:   &servicediscovery.ServiceSummary{Id: &subdomain, Name: &subdomain, HealthCheckCustomConfig: &servicediscovery.HealthCheckCustomConfig{}},
+			pages: pages,
+			health: &servicediscovery.GetInstancesHealthStatusOutput{
+				Status: map[string]*string{instID1: &healthy, instID2: &unhealthy},
+			},
+			want: []*v1alpha3.ServiceEntry_Endpoint{inferedIPv41Endpoint},
+		},
+		{
+			name:  "Drops instances whose health is unknown",
+			svc:   &servicediscovery.ServiceSummary{Id: &subdomain, Name: &subdomain, HealthCheckConfig: &servicediscovery.HealthCheckConfig{}},
+			pages: pages,
+			health: &servicediscovery.GetInstancesHealthStatusOutput{
+				Status: map[string]*string{instID1: &unknown, instID2: &healthy},
+			},
+			want: []*v1alpha3.ServiceEntry_Endpoint{inferedIPv42Endpoint},
+		},
+		{
+			name:  "Ignores health for services without health checks",
+			svc:   &servicediscovery.ServiceSummary{Id: &subdomain, Name: &subdomain},
+			pages: pages,
+			health: &servicediscovery.GetInstancesHealthStatusOutput{
+				Status: map[string]*string{instID1: &healthy, instID2: &unhealthy},
+			},
+			want: []*v1alpha3.ServiceEntry_Endpoint{inferedIPv41Endpoint, inferedIPv42Endpoint},
+		},
+		{
+			name:    "Errors if ListInstances errors",
+			svc:     &servicediscovery.ServiceSummary{Id: &subdomain, Name: &subdomain},
+			listErr: errors.New("bang"),
+			wantErr: true,
+		},
+		{
+			name:      "Errors if GetInstancesHealthStatus errors",
+			svc:       &servicediscovery.ServiceSummary{Id: &subdomain, Name: &subdomain, HealthCheckCustomConfig: &servicediscovery.HealthCheckCustomConfig{}},
+			pages:     pages,
+			healthErr: errors.New("bang"),
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAPI := &mockSDAPI{ListInstPages: tt.pages, ListInstErr: tt.listErr, HealthResult: tt.health, HealthErr: tt.healthErr}
+			w := &watcher{cloudmap: mockAPI, listNamespaces: map[string]bool{hostname: true}}
+			got, _, err := w.endpointsForService(tt.svc, &servicediscovery.NamespaceSummary{Name: &hostname})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Watcher.endpointsForService() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -292,28 +430,28 @@ func Test_instanceToEndpoint(t *testing.T) {
 			instance: &servicediscovery.HttpInstanceSummary{
 				Attributes: map[string]*string{"AWS_INSTANCE_IPV4": &ipv41, "AWS_INSTANCE_PORT": &httpPortStr},
 			},
-			want: &v1alpha3.ServiceEntry_Endpoint{Address: ipv41, Ports: map[string]uint32{"http": 80}},
+			want: &v1alpha3.ServiceEntry_Endpoint{Address: ipv41, Ports: map[string]uint32{"http-80": 80}},
 		},
 		{
 			name: "Endpoint from AWS_INSTANCE_CNAME instance with AWS_INSTANCE_PORT set to known proto",
 			instance: &servicediscovery.HttpInstanceSummary{
 				Attributes: map[string]*string{"AWS_INSTANCE_CNAME": &cname, "AWS_INSTANCE_PORT": &httpPortStr},
 			},
-			want: &v1alpha3.ServiceEntry_Endpoint{Address: cname, Ports: map[string]uint32{"http": 80}},
+			want: &v1alpha3.ServiceEntry_Endpoint{Address: cname, Ports: map[string]uint32{"http-80": 80}},
 		},
 		{
 			name: "Endpoint from AWS_INSTANCE_IPV4 instance with AWS_INSTANCE_PORT set to unknown proto",
 			instance: &servicediscovery.HttpInstanceSummary{
 				Attributes: map[string]*string{"AWS_INSTANCE_IPV4": &ipv41, "AWS_INSTANCE_PORT": &portStr},
 			},
-			want: &v1alpha3.ServiceEntry_Endpoint{Address: ipv41, Ports: map[string]uint32{"tcp": 9999}},
+			want: &v1alpha3.ServiceEntry_Endpoint{Address: ipv41, Ports: map[string]uint32{"tcp-9999": 9999}},
 		},
 		{
 			name: "Endpoint from AWS_INSTANCE_CNAME instance with AWS_INSTANCE_PORT set to unknown proto",
 			instance: &servicediscovery.HttpInstanceSummary{
 				Attributes: map[string]*string{"AWS_INSTANCE_CNAME": &cname, "AWS_INSTANCE_PORT": &portStr},
 			},
-			want: &v1alpha3.ServiceEntry_Endpoint{Address: cname, Ports: map[string]uint32{"tcp": 9999}},
+			want: &v1alpha3.ServiceEntry_Endpoint{Address: cname, Ports: map[string]uint32{"tcp-9999": 9999}},
 		},
 		{
 			name: "Endpoint infering http and https from AWS_INSTANCE_IPV4 instance without a port",
@@ -0,0 +1,30 @@
+package consul
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff is how long to wait before retrying after consecutive failures: the base, doubled with each failure up to
+// max, of which up to half is random so that failures at the same time don't lead to retries at the same time
+type backoff struct {
+	base, max time.Duration
+	failures  uint
+}
+
+// next returns how long to wait after one more failure
+func (b *backoff) next() time.Duration {
+	d := b.max
+	if b.failures < 32 { // beyond, the shift overflows
+		if exp := b.base << b.failures; exp > 0 && exp < b.max {
+			d = exp
+		}
+	}
+	b.failures++
+	return d - time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// reset after a success
+func (b *backoff) reset() {
+	b.failures = 0
+}
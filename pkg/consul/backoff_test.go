@@ -0,0 +1,27 @@
+package consul
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := &backoff{base: time.Second, max: 10 * time.Second}
+	// each wait is between half and all of the base doubled with every failure, up to the max
+	for _, want := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		want *= time.Second
+		if got := b.next(); got < want/2 || got > want {
+			t.Errorf("after %d failures waited %v, want between %v and %v", b.failures, got, want/2, want)
+		}
+	}
+
+	b.reset()
+	if got := b.next(); got > time.Second {
+		t.Errorf("after a reset waited %v, want at most %v", got, time.Second)
+	}
+
+	b.failures = 100
+	if got := b.next(); got < 5*time.Second || got > 10*time.Second {
+		t.Errorf("after many failures waited %v, want between 5s and 10s", got)
+	}
+}
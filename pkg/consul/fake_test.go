@@ -0,0 +1,184 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// fakeConsul serves the parts of the Consul HTTP API the watcher uses from memory. Blocking queries time out quickly.
+type fakeConsul struct {
+	*httptest.Server
+
+	m        sync.Mutex
+	index    uint64
+	catalogs map[scope]map[string][]*api.CatalogService // maps scope->service->instances
+	kinds    map[string]api.ServiceKind                 // maps service->kind, if not typical
+	defaults map[string]string                          // maps service->protocol of its service-defaults
+	failing  map[string]bool                            // datacenters that return errors
+	filters  []string                                   // filter expressions of queries for services' instances
+	queries  []url.Values                               // query parameters of every request
+}
+
+func newFakeConsul() *fakeConsul {
+	f := &fakeConsul{
+		index:    1,
+		catalogs: map[scope]map[string][]*api.CatalogService{},
+		kinds:    map[string]api.ServiceKind{},
+		defaults: map[string]string{},
+		failing:  map[string]bool{},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+// set the instances of the service in the scope, bumping the index. Empty fields of the scope are the defaults.
+func (f *fakeConsul) set(s scope, name string, instances ...*api.CatalogService) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	s = defaultScope(s)
+	if f.catalogs[s] == nil {
+		f.catalogs[s] = map[string][]*api.CatalogService{}
+	}
+	if len(instances) == 0 {
+		delete(f.catalogs[s], name)
+		if len(f.catalogs[s]) == 0 {
+			delete(f.catalogs, s) // the namespace goes with its last service
+		}
+	} else {
+		f.catalogs[s][name] = instances
+	}
+	f.index++
+}
+
+// remove every scope of the datacenter
+func (f *fakeConsul) remove(dc string) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	for s := range f.catalogs {
+		if s.datacenter == dc {
+			delete(f.catalogs, s)
+		}
+	}
+	f.index++
+}
+
+func (f *fakeConsul) fail(dc string, failing bool) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.failing[dc] = failing
+	f.index++
+}
+
+func defaultScope(s scope) scope {
+	if s.datacenter == "" {
+		s.datacenter = "dc1"
+	}
+	if s.partition == "" {
+		s.partition = "default"
+	}
+	if s.namespace == "" {
+		s.namespace = "default"
+	}
+	return s
+}
+
+func (f *fakeConsul) serve(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	index, _ := strconv.ParseUint(q.Get("index"), 10, 64)
+	for deadline := time.Now().Add(100 * time.Millisecond); time.Now().Before(deadline); {
+		f.m.Lock()
+		changed := f.index > index
+		f.m.Unlock()
+		if changed {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.queries = append(f.queries, q)
+
+	s := defaultScope(scope{datacenter: q.Get("dc"), partition: q.Get("partition"), namespace: q.Get("ns")})
+	if f.failing[s.datacenter] {
+		http.Error(w, fmt.Sprintf("No path to datacenter %s", s.datacenter), http.StatusInternalServerError)
+		return
+	}
+
+	var out interface{}
+	switch path := r.URL.Path; {
+	case path == "/v1/catalog/datacenters":
+		out = f.names(func(c scope) string { return c.datacenter })
+	case path == "/v1/partitions":
+		partitions := []map[string]string{}
+		for _, p := range f.names(func(c scope) string {
+			if c.datacenter != s.datacenter {
+				return ""
+			}
+			return c.partition
+		}) {
+			partitions = append(partitions, map[string]string{"Name": p})
+		}
+		out = partitions
+	case path == "/v1/namespaces":
+		namespaces := []*api.Namespace{}
+		for _, ns := range f.names(func(c scope) string {
+			if c.datacenter != s.datacenter || c.partition != s.partition {
+				return ""
+			}
+			return c.namespace
+		}) {
+			namespaces = append(namespaces, &api.Namespace{Name: ns})
+		}
+		out = namespaces
+	case path == "/v1/config/service-defaults":
+		entries := []*api.ServiceConfigEntry{}
+		for name, protocol := range f.defaults {
+			entries = append(entries, &api.ServiceConfigEntry{Kind: api.ServiceDefaults, Name: name, Protocol: protocol})
+		}
+		out = entries
+	case path == "/v1/catalog/services":
+		services := map[string][]string{}
+		for name, instances := range f.catalogs[s] {
+			for _, i := range instances {
+				services[name] = append(services[name], i.ServiceTags...)
+			}
+		}
+		out = services
+	case strings.HasPrefix(path, "/v1/catalog/service/"):
+		f.filters = append(f.filters, q.Get("filter"))
+		name := strings.TrimPrefix(path, "/v1/catalog/service/")
+		instances := []*instance{}
+		for _, i := range f.catalogs[s][name] {
+			instances = append(instances, &instance{CatalogService: *i, ServiceKind: f.kinds[name]})
+		}
+		out = instances
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("X-Consul-Index", fmt.Sprint(f.index))
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// names returns the distinct non-empty names the function picks out of every scope
+func (f *fakeConsul) names(name func(scope) string) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for s := range f.catalogs {
+		if n := name(s); n != "" && !seen[n] {
+			seen[n] = true
+			out = append(out, n)
+		}
+	}
+	return out
+}
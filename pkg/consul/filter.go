@@ -0,0 +1,96 @@
+package consul
+
+import (
+	"regexp"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+)
+
+// filter selects the services, and their instances, that are discovered. The zero filter selects everything.
+type filter struct {
+	requiredTags  []string
+	forbiddenTags []string
+	meta          map[string]string
+	include       []*regexp.Regexp
+	exclude       []*regexp.Regexp
+	expression    string // evaluated by Consul
+}
+
+func newFilter(opts Options) (filter, error) {
+	include, err := compileAll(opts.IncludeServices)
+	if err != nil {
+		return filter{}, err
+	}
+	exclude, err := compileAll(opts.ExcludeServices)
+	if err != nil {
+		return filter{}, err
+	}
+	return filter{
+		requiredTags:  opts.RequiredTags,
+		forbiddenTags: opts.ForbiddenTags,
+		meta:          opts.Meta,
+		include:       include,
+		exclude:       exclude,
+		expression:    opts.Filter,
+	}, nil
+}
+
+func compileAll(exprs []string) ([]*regexp.Regexp, error) {
+	out := make([]*regexp.Regexp, 0, len(exprs))
+	for _, e := range exprs {
+		re, err := regexp.Compile(e)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid service name pattern %q", e)
+		}
+		out = append(out, re)
+	}
+	return out, nil
+}
+
+// service reports whether any instance of the named service could be selected, given the tags of all its instances
+func (f filter) service(name string, tags []string) bool {
+	if len(f.include) > 0 && !matchesAny(f.include, name) {
+		return false
+	}
+	if matchesAny(f.exclude, name) {
+		return false
+	}
+	return hasAll(tags, f.requiredTags)
+}
+
+// instance reports whether the instance is selected
+func (f filter) instance(c *api.CatalogService) bool {
+	if !hasAll(c.ServiceTags, f.requiredTags) {
+		return false
+	}
+	for _, t := range f.forbiddenTags {
+		if contains(c.ServiceTags, t) {
+			return false
+		}
+	}
+	for k, v := range f.meta {
+		if actual, ok := c.ServiceMeta[k]; !ok || actual != v {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAll(tags, required []string) bool {
+	for _, t := range required {
+		if !contains(tags, t) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+package consul
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/tetratelabs/istio-cloud-map/pkg/provider"
+)
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         Options
+		service      string
+		tags         []string
+		meta         map[string]string
+		wantService  bool
+		wantInstance bool
+	}{
+		{name: "everything by default", service: "consul", wantService: true, wantInstance: true},
+		{
+			name:        "included",
+			opts:        Options{IncludeServices: []string{"^web", "^api$"}},
+			service:     "web-frontend",
+			wantService: true, wantInstance: true,
+		},
+		{
+			name:         "not included",
+			opts:         Options{IncludeServices: []string{"^web", "^api$"}},
+			service:      "api-internal",
+			wantInstance: true,
+		},
+		{
+			name:         "excluded",
+			opts:         Options{ExcludeServices: []string{"^consul$"}},
+			service:      "consul",
+			wantInstance: true,
+		},
+		{
+			name:        "required tags",
+			opts:        Options{RequiredTags: []string{"mesh", "v1"}},
+			service:     "web",
+			tags:        []string{"v1", "mesh", "primary"},
+			wantService: true, wantInstance: true,
+		},
+		{
+			name:    "missing required tag",
+			opts:    Options{RequiredTags: []string{"mesh", "v1"}},
+			service: "web",
+			tags:    []string{"v1"},
+		},
+		{
+			name:        "forbidden tag",
+			opts:        Options{ForbiddenTags: []string{"internal"}},
+			service:     "web",
+			tags:        []string{"v1", "internal"},
+			wantService: true,
+		},
+		{
+			name:        "meta",
+			opts:        Options{Meta: map[string]string{"mesh": "true"}},
+			service:     "web",
+			meta:        map[string]string{"mesh": "true", "version": "1"},
+			wantService: true, wantInstance: true,
+		},
+		{
+			name:        "meta mismatch",
+			opts:        Options{Meta: map[string]string{"mesh": "true"}},
+			service:     "web",
+			meta:        map[string]string{"mesh": "false"},
+			wantService: true,
+		},
+		{
+			name:        "meta missing",
+			opts:        Options{Meta: map[string]string{"mesh": ""}},
+			service:     "web",
+			wantService: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newFilter(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.service(tt.service, tt.tags); got != tt.wantService {
+				t.Errorf("service() = %v, want %v", got, tt.wantService)
+			}
+			instance := &api.CatalogService{ServiceName: tt.service, ServiceTags: tt.tags, ServiceMeta: tt.meta}
+			if got := f.instance(instance); got != tt.wantInstance {
+				t.Errorf("instance() = %v, want %v", got, tt.wantInstance)
+			}
+		})
+	}
+
+	if _, err := newFilter(Options{ExcludeServices: []string{"("}}); err == nil {
+		t.Error("expected an error for an invalid service name pattern")
+	}
+}
+
+func TestWatcher_filter(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.Close()
+	instance := func(address string, tags ...string) *api.CatalogService {
+		return &api.CatalogService{Address: address, ServicePort: 8080, ServiceTags: tags}
+	}
+	consul.set(scope{}, "consul", instance("192.0.2.1"))
+	consul.set(scope{}, "web", instance("192.0.2.2", "mesh"), instance("192.0.2.3", "mesh", "canary"))
+	consul.set(scope{}, "batch", instance("192.0.2.4"))
+
+	ww, err := NewWatcher(provider.NewStore(), consul.URL, "", Options{
+		ExcludeServices: []string{"^consul$"},
+		RequiredTags:    []string{"mesh"},
+		ForbiddenTags:   []string{"canary"},
+		Filter:          `ServiceMeta.mesh != "false"`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := ww.(*watcher)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.refreshStore(ctx)
+
+	hosts := w.store.Hosts()
+	if len(hosts) != 1 || len(hosts["web"]) != 1 || hosts["web"][0].Address != "192.0.2.2" {
+		t.Errorf("only the untagged instance of web must be discovered, got %v", hosts)
+	}
+	consul.m.Lock()
+	defer consul.m.Unlock()
+	if len(consul.filters) == 0 {
+		t.Fatal("no queries for instances were made")
+	}
+	for _, f := range consul.filters {
+		if want := `ServiceMeta.mesh != "false"`; f != want {
+			t.Errorf("queries for instances were filtered with %q, want %q", f, want)
+		}
+	}
+}
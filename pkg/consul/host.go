@@ -0,0 +1,97 @@
+package consul
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+
+	"github.com/tetratelabs/log"
+)
+
+// DefaultHostTemplate names hosts after the bare Consul service name
+const DefaultHostTemplate = "{{.Service}}"
+
+// HostData is what host templates are executed against
+type HostData struct {
+	Service    string
+	Namespace  string
+	Partition  string
+	Datacenter string
+	Tags       []string // sorted tags of the service across all of its instances
+}
+
+func parseHostTemplates(templates []string) ([]*template.Template, error) {
+	if len(templates) == 0 {
+		templates = []string{DefaultHostTemplate}
+	}
+	out := make([]*template.Template, 0, len(templates))
+	for _, t := range templates {
+		tmpl, err := template.New(t).Parse(t)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing host template %q", t)
+		}
+		out = append(out, tmpl)
+	}
+	return out, nil
+}
+
+// hosts returns the de-duplicated hosts the instances of the service in the scope are stored under, in template order
+func (w *watcher) hosts(name string, s scope, tags []string, instances []*api.CatalogService) []string {
+	if len(s.datacenter) == 0 {
+		s.datacenter = w.opts.Datacenter
+	}
+	data := HostData{
+		Service:    name,
+		Namespace:  s.namespace,
+		Partition:  s.partition,
+		Datacenter: s.datacenter,
+		Tags:       uniqueSorted(tags),
+	}
+	// the datacenter and namespace the instances were found in are the most accurate
+	for _, c := range instances {
+		if len(c.Datacenter) > 0 {
+			data.Datacenter = c.Datacenter
+		}
+		if len(c.Namespace) > 0 {
+			data.Namespace = c.Namespace
+		}
+		break
+	}
+
+	seen := make(map[string]bool, len(w.hostTemplates))
+	out := make([]string, 0, len(w.hostTemplates))
+	for _, tmpl := range w.hostTemplates {
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, data); err != nil {
+			log.Errorf("error executing host template %q for service %s: %v", tmpl.Name(), name, err)
+			continue
+		}
+		host := strings.ToLower(strings.TrimSpace(b.String()))
+		if len(host) == 0 {
+			log.Infof("host template %q is empty for service %s, skipping it", tmpl.Name(), name)
+			continue
+		}
+		if !seen[host] {
+			seen[host] = true
+			out = append(out, host)
+		}
+	}
+	return out
+}
+
+func uniqueSorted(in []string) []string {
+	seen := make(map[string]bool, len(in))
+	out := make([]string, 0, len(in))
+	for _, s := range in {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,73 @@
+package consul
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestWatcher_hosts(t *testing.T) {
+	instances := []*api.CatalogService{{Datacenter: "dc1", Namespace: "team-a"}}
+
+	tests := []struct {
+		name      string
+		templates []string
+		scope     scope
+		instances []*api.CatalogService
+		want      []string
+	}{
+		{name: "default", want: []string{"web"}},
+		{
+			name:      "datacenter",
+			templates: []string{"{{.Service}}.service.{{.Datacenter}}.consul"},
+			instances: instances,
+			want:      []string{"web.service.dc1.consul"},
+		},
+		{
+			name:      "datacenter of the catalog",
+			templates: []string{"{{.Service}}.service.{{.Datacenter}}.consul"},
+			scope:     scope{datacenter: "dc3"},
+			want:      []string{"web.service.dc3.consul"},
+		},
+		{
+			name:      "datacenter defaults to the configured one",
+			templates: []string{"{{.Service}}.service.{{.Datacenter}}.consul"},
+			want:      []string{"web.service.dc2.consul"},
+		},
+		{
+			name:      "aliases",
+			templates: []string{"{{.Service}}.service.consul", "{{.Service}}.{{.Namespace}}.consul", "{{.Service}}.service.consul"},
+			instances: instances,
+			want:      []string{"web.service.consul", "web.team-a.consul"},
+		},
+		{
+			name:      "tags",
+			templates: []string{"{{range .Tags}}{{.}}.{{end}}{{.Service}}.consul"},
+			want:      []string{"primary.v1.web.consul"},
+		},
+		{
+			name:      "empty hosts are skipped",
+			templates: []string{"{{if .Namespace}}{{.Service}}.{{.Namespace}}{{end}}", "{{.Service}}"},
+			want:      []string{"web"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpls, err := parseHostTemplates(tt.templates)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := &watcher{hostTemplates: tmpls, opts: Options{Datacenter: "dc2"}}
+			if got := w.hosts("web", tt.scope, []string{"v1", "primary", "v1"}, tt.instances); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hosts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHostTemplates(t *testing.T) {
+	if _, err := parseHostTemplates([]string{"{{.Service"}); err == nil {
+		t.Error("expected an error parsing an invalid template")
+	}
+}
@@ -0,0 +1,123 @@
+package consul
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/tetratelabs/istio-cloud-map/pkg/provider"
+)
+
+func TestWatcher_kinds(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.Close()
+	instance := func(dc, address string, port int) *api.CatalogService {
+		return &api.CatalogService{Datacenter: dc, Address: address, ServicePort: port}
+	}
+	web := func(dc, address string) *api.CatalogService {
+		i := instance(dc, address, 8080)
+		i.ServiceTags = []string{"web"}
+		return i
+	}
+	consul.set(scope{datacenter: "dc1"}, "web", web("dc1", "10.0.0.1"))
+	consul.set(scope{datacenter: "dc1"}, "web-sidecar-proxy", instance("dc1", "10.0.0.1", 21000))
+	consul.set(scope{datacenter: "dc1"}, "mesh-gateway", instance("dc1", "192.0.2.1", 8443))
+	consul.set(scope{datacenter: "dc1"}, "egress", instance("dc1", "10.0.0.2", 9000))
+	consul.set(scope{datacenter: "dc1"}, "ingress", instance("dc1", "10.0.0.3", 9001))
+	consul.set(scope{datacenter: "dc2"}, "web", web("dc2", "10.1.0.1"))
+	consul.set(scope{datacenter: "dc2"}, "mesh-gateway", instance("dc2", "198.51.100.1", 8443))
+	consul.kinds = map[string]api.ServiceKind{
+		"web-sidecar-proxy": api.ServiceKindConnectProxy,
+		"mesh-gateway":      api.ServiceKindMeshGateway,
+		"egress":            api.ServiceKindTerminatingGateway,
+		"ingress":           api.ServiceKindIngressGateway,
+	}
+
+	tests := []struct {
+		name     string
+		gateways []string
+		include  []string
+		tags     []string
+		filter   string
+		// the expression instances are queried with, if not filter
+		wantFilter string
+		want       map[string][]string // host->addresses
+	}{
+		{
+			name: "proxies and gateways are skipped",
+			want: map[string][]string{
+				"web.dc1": {"10.0.0.1"},
+				"web.dc2": {"10.1.0.1"},
+			},
+		},
+		{
+			name:     "through gateways",
+			gateways: []string{"dc2"},
+			want: map[string][]string{
+				"web.dc1": {"10.0.0.1"},
+				"web.dc2": {"198.51.100.1"},
+			},
+		},
+		{
+			name:     "through gateways the filters leave out",
+			gateways: []string{"dc2"},
+			include:  []string{"^web$"},
+			tags:     []string{"web"},
+			filter:   `ServiceMeta.mesh != "false"`,
+			// which mesh gateways pass
+			wantFilter: `(ServiceMeta.mesh != "false") or ServiceKind == "mesh-gateway"`,
+			want: map[string][]string{
+				"web.dc1": {"10.0.0.1"},
+				"web.dc2": {"198.51.100.1"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ww, err := NewWatcher(provider.NewStore(), consul.URL, "", Options{
+				Datacenters:        []string{"dc1", "dc2"},
+				GatewayDatacenters: tt.gateways,
+				HostTemplates:      []string{"{{.Service}}.{{.Datacenter}}"},
+				IncludeServices:    tt.include,
+				RequiredTags:       tt.tags,
+				Filter:             tt.filter,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := ww.(*watcher)
+			consul.m.Lock()
+			consul.filters = nil
+			consul.m.Unlock()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			w.refreshStore(ctx)
+
+			got := map[string][]string{}
+			for host, eps := range w.store.Hosts() {
+				for _, ep := range eps {
+					got[host] = append(got[host], ep.Address)
+				}
+				sort.Strings(got[host])
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got hosts %v, want %v", got, tt.want)
+			}
+
+			want := tt.filter
+			if len(tt.wantFilter) > 0 {
+				want = tt.wantFilter
+			}
+			consul.m.Lock()
+			defer consul.m.Unlock()
+			for _, f := range consul.filters {
+				if f != want {
+					t.Errorf("queries for instances were filtered with %q, want %q", f, want)
+				}
+			}
+		})
+	}
+}
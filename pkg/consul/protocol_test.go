@@ -0,0 +1,93 @@
+package consul
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/tetratelabs/istio-cloud-map/pkg/provider"
+)
+
+func TestWatcher_protocol(t *testing.T) {
+	opts := Options{ProtocolMetaKey: DefaultProtocolMetaKey, ProtocolTagPrefix: DefaultProtocolTagPrefix}
+	tests := []struct {
+		name string
+		opts Options
+		in   *api.CatalogService
+		want string
+	}{
+		{
+			name: "meta",
+			opts: opts,
+			in:   &api.CatalogService{ServiceMeta: map[string]string{"protocol": "grpc"}, ServiceTags: []string{"istio-protocol:http2"}},
+			want: "grpc",
+		},
+		{
+			name: "tag",
+			opts: opts,
+			in:   &api.CatalogService{ServiceTags: []string{"v1", "istio-protocol:http2"}},
+			want: "http2",
+		},
+		{name: "default", opts: opts, in: &api.CatalogService{ServiceTags: []string{"v1"}}, want: "mysql"},
+		{
+			name: "conventions not configured",
+			in:   &api.CatalogService{ServiceMeta: map[string]string{"protocol": "grpc"}, ServiceTags: []string{"istio-protocol:http2"}},
+			want: "mysql",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &watcher{opts: tt.opts}
+			if got := w.protocol(tt.in, "mysql"); got != tt.want {
+				t.Errorf("protocol() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatcher_serviceDefaults(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.Close()
+	consul.set(scope{}, "web", &api.CatalogService{Address: "192.0.2.1", ServicePort: 8080})
+	consul.set(scope{}, "api", &api.CatalogService{
+		Address: "192.0.2.2", ServicePort: 8080, ServiceMeta: map[string]string{"protocol": "http2"},
+	})
+	consul.defaults["web"] = "grpc"
+	consul.defaults["api"] = "grpc"
+
+	ww, err := NewWatcher(provider.NewStore(), consul.URL, "", Options{
+		ProtocolMetaKey:    DefaultProtocolMetaKey,
+		UseServiceDefaults: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := ww.(*watcher)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ports := func(host string) map[string]uint32 {
+		if eps := w.store.Hosts()[host]; len(eps) == 1 {
+			return eps[0].Ports
+		}
+		return nil
+	}
+	w.refreshStore(ctx)
+	if got, want := ports("web"), map[string]uint32{"grpc-8080": 8080}; !reflect.DeepEqual(got, want) {
+		t.Errorf("web has ports %v, want %v", got, want)
+	}
+	if got, want := ports("api"), map[string]uint32{"http2-8080": 8080}; !reflect.DeepEqual(got, want) {
+		t.Errorf("api has ports %v, want %v", got, want)
+	}
+
+	// changing the service-defaults updates the service, even though its instances haven't changed
+	consul.m.Lock()
+	consul.defaults["web"] = "http"
+	consul.m.Unlock()
+	w.refreshStore(ctx)
+	if got, want := ports("web"), map[string]uint32{"http-8080": 8080}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after changing its service-defaults, web has ports %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,126 @@
+package consul
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+
+	"github.com/tetratelabs/log"
+)
+
+// scope is where a catalog lives: a namespace of an admin partition of a datacenter. Empty fields are the defaults
+// of the agent we talk to.
+type scope struct {
+	datacenter string
+	partition  string
+	namespace  string
+}
+
+func (s scope) String() string {
+	return fmt.Sprintf("datacenter %q, partition %q, namespace %q", s.datacenter, s.partition, s.namespace)
+}
+
+// listScopes returns the namespaces of the partitions of the datacenter to discover services in
+func (w *watcher) listScopes(dc string) ([]scope, error) {
+	partitions := []string{""}
+	if len(w.opts.Partitions) > 0 {
+		all, err := w.listPartitions(dc)
+		if err != nil {
+			return nil, err
+		}
+		partitions = selectNames(all, w.opts.Partitions, w.opts.ExcludePartitions)
+	}
+
+	out := make([]scope, 0, len(partitions))
+	for _, p := range partitions {
+		namespaces := []string{w.namespace}
+		if len(w.opts.Namespaces) > 0 {
+			all, err := w.listNamespaces(dc, p)
+			if err != nil {
+				return nil, err
+			}
+			namespaces = selectNames(all, w.opts.Namespaces, w.opts.ExcludeNamespaces)
+		}
+		for _, ns := range namespaces {
+			out = append(out, scope{datacenter: dc, partition: p, namespace: ns})
+		}
+	}
+	return out, nil
+}
+
+func (w *watcher) listPartitions(dc string) ([]string, error) {
+	var partitions []struct{ Name string }
+	if _, err := w.consul("").Raw().Query("/v1/partitions", &partitions, &api.QueryOptions{Datacenter: dc}); err != nil {
+		return nil, errors.Wrapf(err, "failed to list partitions of datacenter %q", dc)
+	}
+	out := make([]string, 0, len(partitions))
+	for _, p := range partitions {
+		out = append(out, p.Name)
+	}
+	return out, nil
+}
+
+func (w *watcher) listNamespaces(dc, partition string) ([]string, error) {
+	namespaces, _, err := w.consul(partition).Namespaces().List(&api.QueryOptions{Datacenter: dc})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list namespaces of datacenter %q, partition %q", dc, partition)
+	}
+	out := make([]string, 0, len(namespaces))
+	for _, ns := range namespaces {
+		out = append(out, ns.Name)
+	}
+	return out, nil
+}
+
+// selectNames returns the names matching any of the include patterns and none of the exclude ones. Patterns are
+// globs, as understood by path.Match.
+func selectNames(names, include, exclude []string) []string {
+	out := make([]string, 0, len(names))
+	for _, name := range names {
+		if matchAny(include, name) && !matchAny(exclude, name) {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, err := path.Match(p, name); err != nil {
+			log.Errorf("invalid pattern %q: %v", p, err)
+		} else if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validPatterns returns an error naming the first malformed pattern
+func validPatterns(patterns ...[]string) error {
+	for _, ps := range patterns {
+		for _, p := range ps {
+			if _, err := path.Match(p, ""); err != nil {
+				return errors.Wrapf(err, "invalid pattern %q", p)
+			}
+		}
+	}
+	return nil
+}
+
+// partitionTransport scopes every request to an admin partition. The client library we use predates partitions, but
+// the HTTP API takes the partition as a query parameter like the namespace.
+type partitionTransport struct {
+	partition string
+	next      http.RoundTripper
+}
+
+func (t *partitionTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	q := r.URL.Query()
+	q.Set("partition", t.partition)
+	r.URL.RawQuery = q.Encode()
+	return t.next.RoundTrip(r)
+}
@@ -0,0 +1,105 @@
+package consul
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/tetratelabs/istio-cloud-map/pkg/provider"
+)
+
+func TestWatcher_scopes(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.Close()
+	web := &api.CatalogService{Address: "192.0.2.1", ServiceName: "web", ServicePort: 8080}
+	for _, s := range []scope{
+		{namespace: "default"},
+		{namespace: "team-a"},
+		{namespace: "team-b"},
+		{partition: "eu", namespace: "team-a"},
+		{partition: "eu", namespace: "kube-system"},
+		{partition: "internal", namespace: "team-a"},
+	} {
+		consul.set(s, "web", web)
+	}
+
+	ww, err := NewWatcher(provider.NewStore(), consul.URL, "", Options{
+		Namespaces:        []string{"team-*", "default"},
+		ExcludeNamespaces: []string{"team-b"},
+		Partitions:        []string{"*"},
+		ExcludePartitions: []string{"intern*"},
+		HostTemplates:     []string{"{{.Service}}.{{.Namespace}}.{{.Partition}}.consul"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := ww.(*watcher)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.refreshStore(ctx)
+
+	hosts := []string{}
+	for host := range w.store.Hosts() {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	want := []string{"web.default.default.consul", "web.team-a.default.consul", "web.team-a.eu.consul"}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("got hosts %v, want %v", hosts, want)
+	}
+
+	// namespaces that are deleted take their services with them
+	consul.set(scope{partition: "eu", namespace: "team-a"}, "web")
+	w.refreshStore(ctx)
+	if _, ok := w.store.Hosts()["web.team-a.eu.consul"]; ok {
+		t.Errorf("host of a deleted namespace must be removed, got %v", w.store.Hosts())
+	}
+}
+
+func TestWatcher_singleNamespace(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.Close()
+	consul.set(scope{namespace: "team-a"}, "web", &api.CatalogService{Address: "192.0.2.1", ServiceName: "web"})
+	consul.set(scope{namespace: "team-b"}, "api", &api.CatalogService{Address: "192.0.2.2", ServiceName: "api"})
+
+	ww, err := NewWatcher(provider.NewStore(), consul.URL, "team-a", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := ww.(*watcher)
+	w.refreshStore(context.Background())
+	if hosts := w.store.Hosts(); len(hosts) != 1 || hosts["web"] == nil {
+		t.Errorf("only the services of the given namespace must be discovered, got %v", hosts)
+	}
+}
+
+func TestSelectNames(t *testing.T) {
+	names := []string{"default", "team-a", "team-b", "kube-system"}
+	tests := []struct {
+		name             string
+		include, exclude []string
+		want             []string
+	}{
+		{name: "all", include: []string{"*"}, want: names},
+		{name: "exact", include: []string{"default"}, want: []string{"default"}},
+		{name: "glob", include: []string{"team-*"}, want: []string{"team-a", "team-b"}},
+		{name: "exclude", include: []string{"*"}, exclude: []string{"team-?", "kube-*"}, want: []string{"default"}},
+		{name: "none", include: []string{"other"}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := selectNames(names, tt.include, tt.exclude); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selectNames() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewWatcher_invalidPattern(t *testing.T) {
+	if _, err := NewWatcher(provider.NewStore(), "http://localhost:8500", "", Options{Namespaces: []string{"team-["}}); err == nil {
+		t.Error("expected an error for an invalid namespace pattern")
+	}
+}
@@ -2,7 +2,14 @@ package consul
 
 import (
 	"context"
+	"fmt"
 	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/hashicorp/consul/api"
@@ -16,48 +23,354 @@ import (
 
 var errIndexChangeTimeout = errors.New("blocking request timeout while waiting for index to change")
 
+// Options configures how the watcher discovers services from Consul
+type Options struct {
+	// UseHealthAPI discovers instances with the Health API, which reports their check status, rather than the Catalog
+	// API, which returns every registered instance whatever its checks say. Instances with critical checks, or in
+	// maintenance, are never discovered through the Health API.
+	UseHealthAPI bool
+	// IncludeWarning keeps instances whose worst check is a warning when UseHealthAPI is set; otherwise only
+	// instances with every check passing are discovered.
+	IncludeWarning bool
+
+	// Token is the ACL token to query Consul with; TokenFile, if set, takes precedence. Both default to the
+	// CONSUL_HTTP_TOKEN and CONSUL_HTTP_TOKEN_FILE environment variables.
+	Token     string
+	TokenFile string
+	// CAFile, CertFile and KeyFile configure mTLS with Consul, and TLSServerName the name its certificate is checked
+	// against. They default to the CONSUL_CACERT, CONSUL_CLIENT_CERT, CONSUL_CLIENT_KEY and CONSUL_TLS_SERVER_NAME
+	// environment variables.
+	CAFile        string
+	CertFile      string
+	KeyFile       string
+	TLSServerName string
+	// Datacenter to discover services in; defaults to the datacenter of the agent we talk to
+	Datacenter string
+	// Datacenters to discover services in, overriding Datacenter; AllDatacenters discovers services in every
+	// datacenter the agent knows of. A datacenter we fail to query keeps the services last discovered in it.
+	Datacenters []string
+	// Localities maps datacenters to the locality, "region/zone/sub-zone", of their endpoints. When discovering more
+	// than one datacenter, endpoints of datacenters that aren't mapped are in the region named after the datacenter.
+	Localities map[string]string
+	// Namespaces are glob patterns choosing the namespaces to discover services in, out of every namespace of each
+	// partition, unless they match any of ExcludeNamespaces. If unset, services are discovered in the namespace
+	// given to NewWatcher.
+	Namespaces        []string
+	ExcludeNamespaces []string
+	// Partitions are glob patterns choosing the admin partitions to discover services in, out of every partition of
+	// each datacenter, unless they match any of ExcludePartitions. If unset, services are discovered in the partition
+	// of the token we query Consul with.
+	Partitions        []string
+	ExcludePartitions []string
+	// UseWeights sets the weight of endpoints to their instance's passing weight, or warning weight if its worst
+	// check is a warning.
+	UseWeights bool
+	// LocalityKeys are the node meta keys holding the region, zone and sub-zone of the instances on the node, in
+	// that order. Nodes without the region key are in the locality of their datacenter.
+	LocalityKeys []string
+	// LabelKeys are node meta keys copied to the labels of endpoints of instances on the node
+	LabelKeys []string
+	// ProtocolMetaKey is the service meta key, and ProtocolTagPrefix the prefix of the tag, declaring the protocol
+	// an instance serves (e.g. "grpc" or "http2"), which names its ports. The meta key wins over the tag, and both
+	// over the Protocol of the service's service-defaults config entry if UseServiceDefaults is set. Without any,
+	// the protocol is inferred from the port number.
+	ProtocolMetaKey    string
+	ProtocolTagPrefix  string
+	UseServiceDefaults bool
+	// AddressType selects the tagged address ("lan", "wan" or "lan_ipv6") instances are reached at. If unset, or an
+	// instance has no such address, the service address is used, falling back to the node's address.
+	AddressType string
+	// Workers bounds how many services' instances are fetched at once when they're first seen, or their watch starts
+	// over. Defaults to DefaultWorkers.
+	Workers int
+	// MaxWatches bounds how many of the blocking queries watching every service for changes are in flight at once,
+	// apart from Workers, as each holds a connection to the agent. Together they must stay below the connections the
+	// agent allows a client (limits.http_max_conns_per_client, 200 by default). With more services than that, the
+	// services take turns, each watched for up to WaitTime. Defaults to DefaultMaxWatches.
+	MaxWatches int
+	// RequiredTags and ForbiddenTags select the instances with all of the former and none of the latter, and Meta
+	// those with all of its key/value pairs in their service meta.
+	RequiredTags  []string
+	ForbiddenTags []string
+	Meta          map[string]string
+	// IncludeServices and ExcludeServices are regular expressions selecting services by name: those matching any of
+	// IncludeServices, if set, and none of ExcludeServices.
+	IncludeServices []string
+	ExcludeServices []string
+	// Filter is a Consul filter expression (https://www.consul.io/api-docs/features/filtering) Consul selects the
+	// instances of services with. It's evaluated against catalog services, or health entries with UseHealthAPI.
+	Filter string
+	// GatewayDatacenters are the datacenters, or AllDatacenters, whose services are reached through the datacenter's
+	// mesh gateways rather than at their own addresses, once it has any. Sidecar proxies and gateways are never
+	// discovered as services of their own. Mesh gateways are then discovered whatever the filters above select.
+	GatewayDatacenters []string
+	// HostTemplates are text/template strings, executed against HostData, naming the hosts each service is stored
+	// under; every template after the first adds an alias. Defaults to DefaultHostTemplate.
+	HostTemplates []string
+	// WaitTime bounds how long blocking queries wait for a change, and TickInterval is how often the catalogs are
+	// listed. They default to DefaultWaitTime and DefaultTickInterval.
+	WaitTime     time.Duration
+	TickInterval time.Duration
+	// MaxBackoff caps how long we wait to retry after consecutive failures to query Consul. Retries start after
+	// TickInterval and double with each failure, jittered so that watches failing together don't retry together.
+	// Defaults to DefaultMaxBackoff.
+	MaxBackoff time.Duration
+	// Consistency is the consistency mode of queries, one of ConsistencyModes: "default", "stale" to let any server
+	// answer, "consistent" to have the leader confirm it still leads before answering, or "cached" to be answered
+	// from the agent's cache. Defaults to "default".
+	Consistency string
+}
+
+// DefaultProtocolMetaKey and DefaultProtocolTagPrefix are the conventional defaults of Options.ProtocolMetaKey and
+// Options.ProtocolTagPrefix
+const (
+	DefaultProtocolMetaKey   = "protocol"
+	DefaultProtocolTagPrefix = "istio-protocol:"
+)
+
+// AllDatacenters in Options.Datacenters discovers services in every datacenter
+const AllDatacenters = "*"
+
+// AddressTypes are the tagged addresses Options.AddressType can select
+var AddressTypes = []string{"lan", "wan", "lan_ipv6"}
+
+// ConsistencyModes are the consistency modes Options.Consistency can select
+var ConsistencyModes = []string{"default", "stale", "consistent", "cached"}
+
 type watcher struct {
-	client       *api.Client
-	store        provider.Store
-	tickInterval time.Duration
-	lastIndex    uint64 // lastly synced index of Catalog
-	namespace    string
+	client         *api.Client // for the default partition; clients of other partitions are created on demand
+	clients        map[string]*api.Client
+	store          provider.Store
+	tickInterval   time.Duration
+	namespace      string
+	useHealthAPI   bool
+	includeWarning bool
+	addressType    string
+	hostTemplates  []*template.Template
+	filter         filter
+
+	// what the client was created from, so we can recreate it when its token or TLS files change
+	endpoint string
+	opts     Options
+	files    map[string]time.Time // maps file->modification time when the client was created
+
+	workers  chan struct{} // bounds the number of non-blocking queries in flight
+	watches  chan struct{} // bounds the number of blocking queries in flight
+	m        sync.Mutex    // guards client, catalogs and health, which are used by every service's watch
+	catalogs map[scope]*catalog
+	health   error // why the last refresh failed, if it did
+}
+
+// catalog is the service catalog of a namespace, watched independently of the others'
+type catalog struct {
+	scope
+	lastIndex uint64 // lastly synced index of Catalog
+	services  map[string]*service
+	protocols map[string]string          // maps service->protocol of its service-defaults
+	kinds     map[string]api.ServiceKind // maps service->kind of its instances, once seen
+}
+
+// service is a Consul service we watch with its own blocking queries
+type service struct {
+	tags       []string
+	excluded   bool // whether the filter leaves it out by name and tags; mesh gateways are discovered either way
+	instances  []*instance
+	kind       api.ServiceKind
+	hosts      []string
+	eps        []*v1alpha3.ServiceEntry_Endpoint
+	attributes map[string]string // service meta every selected instance shares
+	cancel     context.CancelFunc
+}
+
+// instance of a service, along with its kind, which the client library's CatalogService doesn't decode
+type instance struct {
+	api.CatalogService
+	ServiceKind api.ServiceKind
 }
 
 const (
-	// TODO: allow users to specify these
-	defaultBlockingRequestWaitTimeDuration = 5 * time.Second
-	defaultTickIntervalDuration            = 10 * time.Second
+	// DefaultWaitTime, DefaultTickInterval, DefaultMaxBackoff, DefaultWorkers and DefaultMaxWatches are the defaults
+	// of the Options of the same names
+	DefaultWaitTime     = 5 * time.Second
+	DefaultTickInterval = 10 * time.Second
+	DefaultMaxBackoff   = 5 * time.Minute
+	DefaultWorkers      = 64
+	DefaultMaxWatches   = 100
 )
 
 var _ provider.Watcher = &watcher{}
 
-func NewWatcher(store provider.Store, endpoint string, namespace string) (provider.Watcher, error) {
+func NewWatcher(store provider.Store, endpoint string, namespace string, opts Options) (provider.Watcher, error) {
 	if len(endpoint) == 0 {
 		return nil, errors.New("Consul endpoint not specified")
 	}
+	if len(opts.AddressType) > 0 && !contains(AddressTypes, opts.AddressType) {
+		return nil, errors.Errorf("unknown Consul address type %q, must be one of %v", opts.AddressType, AddressTypes)
+	}
+	if len(opts.Consistency) > 0 && !contains(ConsistencyModes, opts.Consistency) {
+		return nil, errors.Errorf("unknown Consul consistency mode %q, must be one of %v", opts.Consistency, ConsistencyModes)
+	}
+	if opts.WaitTime < 0 || opts.TickInterval < 0 || opts.MaxBackoff < 0 {
+		return nil, errors.New("Consul wait time, tick interval and max backoff can't be negative")
+	}
+	if opts.WaitTime == 0 {
+		opts.WaitTime = DefaultWaitTime
+	}
+	if opts.TickInterval == 0 {
+		opts.TickInterval = DefaultTickInterval
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
 
+	if err := validPatterns(opts.Namespaces, opts.ExcludeNamespaces, opts.Partitions, opts.ExcludePartitions); err != nil {
+		return nil, err
+	}
+
+	hostTemplates, err := parseHostTemplates(opts.HostTemplates)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := newFilter(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	client, files, err := newClient(endpoint, opts, "")
+	if err != nil {
+		return nil, err
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	watches := opts.MaxWatches
+	if watches <= 0 {
+		watches = DefaultMaxWatches
+	}
+	return &watcher{client: client,
+		store:          store,
+		clients:        make(map[string]*api.Client),
+		tickInterval:   opts.TickInterval,
+		namespace:      namespace,
+		useHealthAPI:   opts.UseHealthAPI,
+		includeWarning: opts.IncludeWarning,
+		addressType:    opts.AddressType,
+		hostTemplates:  hostTemplates,
+		filter:         filter,
+		endpoint:       endpoint,
+		opts:           opts,
+		files:          files,
+		workers:        make(chan struct{}, workers),
+		watches:        make(chan struct{}, watches),
+		catalogs:       make(map[scope]*catalog),
+	}, nil
+}
+
+// newClient returns a client for the Consul endpoint, scoped to the partition if there is one, along with the token
+// and TLS files it was created from, and their modification times.
+func newClient(endpoint string, opts Options, partition string) (*api.Client, map[string]time.Time, error) {
 	config := api.DefaultConfig()
 	u, err := url.Parse(endpoint)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error parsing endpoint: %s", endpoint)
+		return nil, nil, errors.Wrapf(err, "error parsing endpoint: %s", endpoint)
 	}
 
-	// TODO: allow users to specify TOKEN
 	config.Scheme = u.Scheme
 	config.Address = u.Host
-	config.WaitTime = defaultBlockingRequestWaitTimeDuration
+	config.WaitTime = opts.WaitTime
+	config.Datacenter = opts.Datacenter
+	// only override what the environment gave us when explicitly configured
+	for dst, src := range map[*string]string{
+		&config.Token:              opts.Token,
+		&config.TokenFile:          opts.TokenFile,
+		&config.TLSConfig.CAFile:   opts.CAFile,
+		&config.TLSConfig.CertFile: opts.CertFile,
+		&config.TLSConfig.KeyFile:  opts.KeyFile,
+		&config.TLSConfig.Address:  opts.TLSServerName,
+	} {
+		if len(src) > 0 {
+			*dst = src
+		}
+	}
 
+	// read the files' modification times before the client reads the files, so we never miss a change
+	files := modTimes(config.TokenFile, config.TLSConfig.CAFile, config.TLSConfig.CertFile, config.TLSConfig.KeyFile)
+	if len(partition) > 0 {
+		httpClient, err := api.NewHttpClient(config.Transport, config.TLSConfig)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "error creating client")
+		}
+		httpClient.Transport = &partitionTransport{partition: partition, next: httpClient.Transport}
+		config.HttpClient = httpClient
+	}
 	client, err := api.NewClient(config)
 	if err != nil {
-		return nil, errors.Wrap(err, "error creating client")
+		return nil, nil, errors.Wrap(err, "error creating client")
 	}
-	return &watcher{client: client,
-		store:        store,
-		tickInterval: defaultTickIntervalDuration,
-		// TODO: Since namespace feature is only available in Enterprise (+1.7.0), we haven't tested yet
-		namespace: namespace,
-	}, nil
+	return client, files, nil
+}
+
+// modTimes returns the modification time of each of the named files; a file we can't stat has the zero time
+func modTimes(names ...string) map[string]time.Time {
+	out := make(map[string]time.Time, len(names))
+	for _, name := range names {
+		if len(name) == 0 {
+			continue
+		}
+		var mod time.Time
+		if info, err := os.Stat(name); err == nil {
+			mod = info.ModTime()
+		}
+		out[name] = mod
+	}
+	return out
+}
+
+// reloadClient recreates the client if its token or TLS files have changed since it was created
+func (w *watcher) reloadClient() {
+	if len(w.files) == 0 {
+		return
+	}
+	names := make([]string, 0, len(w.files))
+	for name := range w.files {
+		names = append(names, name)
+	}
+	if reflect.DeepEqual(modTimes(names...), w.files) {
+		return
+	}
+
+	client, files, err := newClient(w.endpoint, w.opts, "")
+	if err != nil {
+		log.Errorf("error reloading the Consul client after its token or TLS files changed, continuing with the old one: %v", err)
+		return
+	}
+	log.Infof("reloaded the Consul client after its token or TLS files changed")
+	w.m.Lock()
+	w.client = client
+	w.clients = make(map[string]*api.Client) // recreated on demand
+	w.m.Unlock()
+	w.files = files
+}
+
+// consul returns the current client for the partition, which reloadClient may replace at any time
+func (w *watcher) consul(partition string) *api.Client {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if len(partition) == 0 {
+		return w.client
+	}
+	if c, ok := w.clients[partition]; ok {
+		return c
+	}
+	c, _, err := newClient(w.endpoint, w.opts, partition)
+	if err != nil {
+		// the configuration was good enough for the default partition's client, so this shouldn't happen
+		log.Errorf("error creating Consul client for partition %q, using the default partition's: %v", partition, err)
+		return w.client
+	}
+	w.clients[partition] = c
+	return c
 }
 
 func (w *watcher) Store() provider.Store {
@@ -68,105 +381,652 @@ func (w *watcher) Prefix() string {
 	return "consul-"
 }
 
-// Run the watcher until the context is cancelled
+// Run the watcher until the context is cancelled, backing off while Consul can't be queried
 func (w *watcher) Run(ctx context.Context) {
-	ticker := time.NewTicker(w.tickInterval)
-	defer ticker.Stop()
-
-	w.refreshStore() // init
+	retry := w.backoff()
 	for {
+		wait := w.tickInterval
+		if err := w.refreshStore(ctx); err != nil {
+			wait = retry.next()
+			log.Infof("retrying to refresh Consul catalogs in %v", wait)
+		} else {
+			retry.reset()
+		}
 		select {
-		case <-ticker.C:
-			w.refreshStore()
+		case <-time.After(wait):
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-// fetch services and endpoints from consul catalog and sync them with Store
-func (w *watcher) refreshStore() {
-	names, err := w.listServices()
+// Healthy returns why Consul couldn't be queried the last time the catalogs were refreshed, or nil if it could
+func (w *watcher) Healthy() error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.health
+}
+
+// setHealth records the outcome of a refresh, logging when Consul becomes unhealthy or recovers
+func (w *watcher) setHealth(err error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if err != nil && w.health == nil {
+		log.Errorf("Consul is unhealthy: %v", err)
+	} else if err == nil && w.health != nil {
+		log.Infof("Consul is healthy again")
+	}
+	w.health = err
+}
+
+func (w *watcher) backoff() *backoff {
+	max := w.opts.MaxBackoff
+	if max < w.tickInterval {
+		max = w.tickInterval
+	}
+	return &backoff{base: w.tickInterval, max: max}
+}
+
+// fetch the namespaces to discover services in, then refresh each of their catalogs, syncing the Store with them.
+// Returns the first error querying Consul, having refreshed what could be.
+func (w *watcher) refreshStore(ctx context.Context) error {
+	w.reloadClient()
+	scopes, err := w.listAllScopes()
+
+	w.m.Lock()
+	catalogs := make([]*catalog, 0, len(scopes))
+	for _, s := range scopes {
+		c, ok := w.catalogs[s]
+		if !ok {
+			c = &catalog{scope: s, services: make(map[string]*service), kinds: make(map[string]api.ServiceKind)}
+			w.catalogs[s] = c
+		}
+		catalogs = append(catalogs, c)
+	}
+	for s, c := range w.catalogs {
+		if !containsScope(scopes, s) {
+			log.Infof("%v is gone, removing its services", s)
+			for _, svc := range c.services {
+				svc.cancel()
+			}
+			delete(w.catalogs, s)
+		}
+	}
+	w.m.Unlock()
+
+	// catalogs are refreshed concurrently so one that is slow, or down, doesn't hold the others back
+	var wg sync.WaitGroup
+	errs := make([]error, len(catalogs))
+	for i, c := range catalogs {
+		wg.Add(1)
+		go func(i int, c *catalog) {
+			defer wg.Done()
+			errs[i] = w.refreshCatalog(ctx, c)
+		}(i, c)
+	}
+	wg.Wait()
+	w.publish()
+
+	for _, e := range errs {
+		if err == nil {
+			err = e
+		}
+	}
+	w.setHealth(err)
+	return err
+}
+
+// listAllScopes returns the namespaces of every datacenter to discover services in. Where we fail to list the
+// datacenters, or the partitions and namespaces of a datacenter, we keep those we already know of and return the
+// first error along with them.
+func (w *watcher) listAllScopes() ([]scope, error) {
+	w.m.Lock()
+	known := make([]scope, 0, len(w.catalogs))
+	for s := range w.catalogs {
+		known = append(known, s)
+	}
+	w.m.Unlock()
+
+	datacenters, err := w.listDatacenters()
+	if err != nil {
+		log.Errorf("error listing datacenters from Consul, continuing with the ones we know of: %v", err)
+		return known, err
+	}
+	out := make([]scope, 0, len(known))
+	var failed error
+	for _, dc := range datacenters {
+		scopes, err := w.listScopes(dc)
+		if err != nil {
+			log.Errorf("error listing partitions and namespaces from Consul, continuing with the ones we know of: %v", err)
+			for _, s := range known {
+				if s.datacenter == dc {
+					out = append(out, s)
+				}
+			}
+			if failed == nil {
+				failed = err
+			}
+			continue
+		}
+		out = append(out, scopes...)
+	}
+	return out, failed
+}
+
+// listDatacenters returns the datacenters to discover services in
+func (w *watcher) listDatacenters() ([]string, error) {
+	if !contains(w.opts.Datacenters, AllDatacenters) {
+		if len(w.opts.Datacenters) == 0 {
+			return []string{""}, nil // the client's datacenter
+		}
+		return w.opts.Datacenters, nil
+	}
+
+	dcs, err := w.consul("").Catalog().Datacenters()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list datacenters")
+	}
+	return dcs, nil
+}
+
+// fetch services from the namespace's catalog, then start watching the services that appeared and stop watching
+// those that are gone. Services we already watch update the Store themselves when they change.
+func (w *watcher) refreshCatalog(ctx context.Context, c *catalog) error {
+	if w.opts.UseServiceDefaults {
+		w.refreshProtocols(c)
+	}
+	names, err := w.listServices(c)
 	if err == errIndexChangeTimeout {
-		log.Infof("waiting for index to change: current index: %d", w.lastIndex)
-		return
+		log.Infof("waiting for index to change in %v: current index: %d", c.scope, c.lastIndex)
+		return nil
 	} else if err != nil {
-		log.Errorf("error listing services from Consul: %v", err)
+		log.Errorf("error listing services from Consul in %v: %v", c.scope, err)
+		return errors.Wrapf(err, "in %v", c.scope)
+	}
+
+	w.m.Lock()
+	excluded := make(map[string]bool, len(names))
+	for name, tags := range names {
+		if excluded[name] = !w.filter.service(name, tags); excluded[name] && !w.mayBeGateway(c, name) {
+			delete(names, name) // as if it was gone
+		}
+	}
+	added := make([]string, 0)
+	for name, tags := range names {
+		if s, ok := c.services[name]; ok {
+			s.tags, s.excluded = tags, excluded[name]
+			continue
+		}
+		added = append(added, name)
+	}
+	for name, s := range c.services {
+		if _, ok := names[name]; !ok {
+			s.cancel()
+			delete(c.services, name)
+		}
+	}
+	w.m.Unlock()
+
+	// describe new services before returning so the Store is complete once we've seen them listed
+	var wg sync.WaitGroup
+	for _, name := range added {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			svcCtx, cancel := context.WithCancel(ctx)
+			instances, index, err := w.describeService(svcCtx, c, name, 0)
+			if err != nil {
+				log.Errorf("error describing service catalog from Consul: %v ", err)
+			}
+
+			w.m.Lock()
+			s := &service{tags: names[name], excluded: excluded[name], cancel: cancel}
+			w.update(c, name, s, instances)
+			if s.excluded && s.kind != api.ServiceKindMeshGateway {
+				// it was only described to find out whether it's a mesh gateway
+				w.m.Unlock()
+				cancel()
+				return
+			}
+			c.services[name] = s
+			w.m.Unlock()
+			go w.watchService(svcCtx, c, name, index)
+		}(name)
+	}
+	wg.Wait()
+	return nil
+}
+
+// mayBeGateway reports whether the service, which the filter doesn't select, must still be discovered as it is, or
+// may be, a mesh gateway other services are reached through. Whether it is is only known once its instances are.
+func (w *watcher) mayBeGateway(c *catalog, name string) bool {
+	if len(w.opts.GatewayDatacenters) == 0 {
+		return false
+	}
+	kind, ok := c.kinds[name]
+	return !ok || kind == api.ServiceKindMeshGateway
+}
+
+// refreshProtocols fetches the protocols of the catalog's service-defaults, updating the services whose protocol
+// changed. Config entries have indexes of their own, so they're fetched on every refresh.
+func (w *watcher) refreshProtocols(c *catalog) {
+	entries, _, err := w.consul(c.partition).ConfigEntries().List(api.ServiceDefaults, w.queryOptions(c, 0))
+	if err != nil {
+		log.Errorf("error listing service-defaults from Consul in %v: %v", c.scope, err)
 		return
 	}
+	protocols := make(map[string]string, len(entries))
+	for _, e := range entries {
+		if sd, ok := e.(*api.ServiceConfigEntry); ok && len(sd.Protocol) > 0 {
+			protocols[sd.Name] = sd.Protocol
+		}
+	}
 
-	css := w.describeServices(names)
-	data := make(map[string][]*v1alpha3.ServiceEntry_Endpoint, len(css))
-	for name, cs := range css {
-		eps := make([]*v1alpha3.ServiceEntry_Endpoint, 0, len(cs))
-		for _, c := range cs {
-			if ep := catalogServiceToEndpoints(c); ep != nil {
-				eps = append(eps, ep)
+	w.m.Lock()
+	defer w.m.Unlock()
+	previous := c.protocols
+	c.protocols = protocols
+	for name, s := range c.services {
+		if protocols[name] != previous[name] {
+			w.update(c, name, s, s.instances)
+		}
+	}
+}
+
+// watchService keeps the service's hosts up to date with blocking queries until the context is cancelled, backing
+// off while they fail
+func (w *watcher) watchService(ctx context.Context, c *catalog, name string, index uint64) {
+	retry := w.backoff()
+	for {
+		instances, next, err := w.describeService(ctx, c, name, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			wait := retry.next()
+			log.Errorf("error describing service catalog from Consul, retrying in %v: %v ", wait, err)
+			select {
+			case <-time.After(wait):
+				continue
+			case <-ctx.Done():
+				return
 			}
 		}
-		if len(eps) > 0 {
-			data[name] = eps
+		retry.reset()
+		if next == index {
+			continue // the blocking query timed out
 		}
+		// indexes are opaque; if one goes backwards, e.g. after a snapshot restore, start over
+		if next < index {
+			next = 0
+		}
+		index = next
+
+		w.m.Lock()
+		if s, ok := c.services[name]; ok {
+			w.update(c, name, s, instances)
+		}
+		w.m.Unlock()
+		w.publish()
 	}
+}
+
+// update the service with its instances, converting those the filter selects to endpoints
+func (w *watcher) update(c *catalog, name string, s *service, instances []*instance) {
+	s.instances = instances
+	s.kind = api.ServiceKindTypical
+	svcs := make([]*api.CatalogService, 0, len(instances))
+	for _, i := range instances {
+		s.kind = i.ServiceKind // every instance of a service is of the same kind
+		// mesh gateways are spared the filter, or it would turn off routing through them
+		if i.ServiceKind == api.ServiceKindMeshGateway || !s.excluded && w.filter.instance(&i.CatalogService) {
+			svcs = append(svcs, &i.CatalogService)
+		}
+	}
+	if len(instances) > 0 && c.kinds != nil {
+		c.kinds[name] = s.kind
+	}
+	if s.kind != api.ServiceKindTypical && s.kind != api.ServiceKindMeshGateway {
+		log.Debugf("skipping %s in %v, it's a %s", name, c.scope, s.kind)
+		s.eps, s.hosts, s.attributes = nil, nil, nil
+		return
+	}
+	if s.excluded && s.kind != api.ServiceKindMeshGateway {
+		log.Debugf("skipping %s in %v, the filter doesn't select it", name, c.scope)
+		s.eps, s.hosts, s.attributes = nil, nil, nil
+		return
+	}
+
+	locality := w.locality(c.datacenter)
+	s.eps = make([]*v1alpha3.ServiceEntry_Endpoint, 0, len(svcs))
+	meta := make([]map[string]string, 0, len(svcs))
+	for _, svc := range svcs {
+		meta = append(meta, svc.ServiceMeta)
+		if ep := catalogServiceToEndpoints(svc, w.addressType, w.protocol(svc, c.protocols[name])); ep != nil {
+			ep.Locality = locality
+			w.applyNode(ep, svc)
+			s.eps = append(s.eps, ep)
+		}
+	}
+	s.hosts = w.hosts(name, c.scope, s.tags, svcs)
+	s.attributes = provider.SharedAttributes(meta...)
+}
+
+// locality returns the locality of endpoints in the datacenter
+func (w *watcher) locality(dc string) string {
+	if l, ok := w.opts.Localities[dc]; ok {
+		return l
+	}
+	if len(w.opts.Datacenters) > 1 || contains(w.opts.Datacenters, AllDatacenters) {
+		return dc
+	}
+	return ""
+}
+
+// publish syncs the Store with the hosts of every service we watch. Services sharing a host, e.g. because the host
+// isn't qualified with the datacenter, share its endpoints. Mesh gateways are only used to reach other services.
+func (w *watcher) publish() {
+	w.m.Lock()
+	defer w.m.Unlock()
+	data := make(map[string][]*v1alpha3.ServiceEntry_Endpoint)
+	meta := make(map[string]provider.HostMeta)
+	// in a stable order, so the endpoints of shared hosts don't change places between syncs
+	scopes := make([]scope, 0, len(w.catalogs))
+	for s := range w.catalogs {
+		scopes = append(scopes, s)
+	}
+	sort.Slice(scopes, func(i, j int) bool { return scopes[i].String() < scopes[j].String() })
+
+	gateways := make(map[string][]*v1alpha3.ServiceEntry_Endpoint) // maps datacenter->endpoints of its mesh gateways
+	for _, s := range scopes {
+		for _, svc := range w.catalogs[s].services {
+			if svc.kind == api.ServiceKindMeshGateway {
+				gateways[s.datacenter] = append(gateways[s.datacenter], svc.eps...)
+			}
+		}
+	}
+
+	for _, s := range scopes {
+		c := w.catalogs[s]
+		names := make([]string, 0, len(c.services))
+		for name := range c.services {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			svc := c.services[name]
+			if svc.kind != api.ServiceKindTypical || len(svc.eps) == 0 {
+				continue
+			}
+			eps := svc.eps
+			if gw := gateways[s.datacenter]; len(gw) > 0 && w.throughGateway(s.datacenter) {
+				eps = gw
+			}
+			for _, host := range svc.hosts {
+				data[host] = append(data[host], eps...)
+				if _, ok := meta[host]; !ok { // the first service sharing a host describes it
+					meta[host] = w.hostMeta(s, name, svc)
+				}
+			}
+		}
+	}
+	w.store.SetMeta(meta)
 	w.store.Set(data)
 }
 
+// hostMeta describes the service in the scope
+func (w *watcher) hostMeta(s scope, name string, svc *service) provider.HostMeta {
+	meta := make(map[string]string)
+	if dc := s.datacenter; len(dc) > 0 {
+		meta["datacenter"] = dc
+	} else if len(w.opts.Datacenter) > 0 {
+		meta["datacenter"] = w.opts.Datacenter
+	}
+	if len(s.partition) > 0 {
+		meta["partition"] = s.partition
+	}
+	return provider.HostMeta{
+		Provider: "consul", Namespace: s.namespace, Service: name, Meta: meta, Attributes: svc.attributes,
+	}
+}
+
+func (w *watcher) throughGateway(dc string) bool {
+	if len(dc) == 0 {
+		dc = w.opts.Datacenter
+	}
+	return contains(w.opts.GatewayDatacenters, dc) || contains(w.opts.GatewayDatacenters, AllDatacenters)
+}
+
+// queryOptions returns the options of queries in the catalog's scope, blocking until its index is past waitIndex
+// if set, in the configured consistency mode
+func (w *watcher) queryOptions(c *catalog, waitIndex uint64) *api.QueryOptions {
+	return &api.QueryOptions{
+		Namespace:         c.namespace,
+		Datacenter:        c.datacenter,
+		WaitIndex:         waitIndex,
+		AllowStale:        w.opts.Consistency == "stale",
+		RequireConsistent: w.opts.Consistency == "consistent",
+		UseCache:          w.opts.Consistency == "cached",
+	}
+}
+
 // listServices lists services
-func (w *watcher) listServices() (map[string][]string, error) {
-	data, metadata, err := w.client.Catalog().Services(
-		&api.QueryOptions{WaitIndex: w.lastIndex, Namespace: w.namespace},
-	)
+func (w *watcher) listServices(c *catalog) (map[string][]string, error) {
+	data, metadata, err := w.consul(c.partition).Catalog().Services(w.queryOptions(c, c.lastIndex))
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to list services")
 	}
 
-	if w.lastIndex == metadata.LastIndex {
+	if c.lastIndex == metadata.LastIndex {
 		// this case indicates the request reaches timeout of blocking request
 		return nil, errIndexChangeTimeout
 	}
 
-	w.lastIndex = metadata.LastIndex
+	c.lastIndex = metadata.LastIndex
 	return data, nil
 }
 
-// describeServices gets catalog services for given service names
-func (w *watcher) describeServices(names map[string][]string) map[string][]*api.CatalogService {
-	ss := make(map[string][]*api.CatalogService, len(names))
-	for name := range names { // ignore tags in value
-		svcs, err := w.describeService(name)
-		if err != nil {
-			log.Errorf("error describing service catalog from Consul: %v ", err)
-			continue
-		}
-		ss[name] = svcs
+// describeService gets the service's instances once its index is past waitIndex, or the blocking query times out,
+// along with the index they are at. At most Options.Workers queries without a waitIndex, and Options.MaxWatches
+// blocking queries, are in flight at once. Blocking queries mostly sit idle, so they don't hold a worker, which would
+// keep other services from being fetched.
+func (w *watcher) describeService(ctx context.Context, c *catalog, name string, waitIndex uint64) ([]*instance, uint64, error) {
+	slots := w.workers
+	if waitIndex != 0 {
+		slots = w.watches
+	}
+	select {
+	case slots <- struct{}{}:
+		defer func() { <-slots }()
+	case <-ctx.Done():
+		return nil, waitIndex, ctx.Err()
+	}
+
+	opts := w.queryOptions(c, waitIndex)
+	opts.Filter = w.expression()
+	opts = opts.WithContext(ctx)
+	if w.useHealthAPI {
+		return w.describeHealthyService(c, name, opts)
+	}
+	// like Catalog().Service, but decoding the kind of the instances too
+	var instances []*instance
+	meta, err := w.consul(c.partition).Raw().Query("/v1/catalog/service/"+url.PathEscape(name), &instances, opts)
+	if err != nil {
+		return nil, waitIndex, errors.Wrapf(err, "failed to describe svc: %s", name)
+	}
+	return instances, meta.LastIndex, nil
+}
+
+// expression returns the filter expression Consul selects instances with. When routing through mesh gateways, they
+// pass it whatever it says, or it would turn the routing off.
+func (w *watcher) expression() string {
+	if len(w.filter.expression) == 0 || len(w.opts.GatewayDatacenters) == 0 {
+		return w.filter.expression
+	}
+	kind := "ServiceKind"
+	if w.useHealthAPI {
+		kind = "Service.Kind"
 	}
-	return ss
+	return fmt.Sprintf("(%s) or %s == %q", w.filter.expression, kind, api.ServiceKindMeshGateway)
 }
 
-func (w *watcher) describeService(name string) ([]*api.CatalogService, error) {
-	svcs, _, err := w.client.Catalog().Service(name, "", &api.QueryOptions{
-		Namespace: w.namespace,
-	})
+// describeHealthyService gets the instances of the service whose checks pass, or warn if we include warnings.
+// The instances are returned as catalog services, with their checks, so both APIs share the endpoint conversion.
+func (w *watcher) describeHealthyService(c *catalog, name string, opts *api.QueryOptions) ([]*instance, uint64, error) {
+	entries, meta, err := w.consul(c.partition).Health().Service(name, "", !w.includeWarning, opts)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to describe svc: %s", name)
+		return nil, opts.WaitIndex, errors.Wrapf(err, "failed to describe svc: %s", name)
+	}
+
+	svcs := make([]*instance, 0, len(entries))
+	for _, e := range entries {
+		status := e.Checks.AggregatedStatus()
+		if status != api.HealthPassing && (status != api.HealthWarning || !w.includeWarning) {
+			log.Infof("skipping instance %s of %s, its checks are %s", e.Service.ID, name, status)
+			continue
+		}
+		svcs = append(svcs, healthEntryToCatalogService(e))
 	}
-	return svcs, nil
+	return svcs, meta.LastIndex, nil
+}
+
+func healthEntryToCatalogService(e *api.ServiceEntry) *instance {
+	return &instance{ServiceKind: e.Service.Kind, CatalogService: api.CatalogService{
+		ID:                     e.Node.ID,
+		Node:                   e.Node.Node,
+		Address:                e.Node.Address,
+		Datacenter:             e.Node.Datacenter,
+		TaggedAddresses:        e.Node.TaggedAddresses,
+		NodeMeta:               e.Node.Meta,
+		ServiceID:              e.Service.ID,
+		ServiceName:            e.Service.Service,
+		ServiceAddress:         e.Service.Address,
+		ServiceTaggedAddresses: e.Service.TaggedAddresses,
+		ServiceTags:            e.Service.Tags,
+		ServiceMeta:            e.Service.Meta,
+		ServicePort:            e.Service.Port,
+		ServiceWeights:         api.Weights{Passing: e.Service.Weights.Passing, Warning: e.Service.Weights.Warning},
+		ServiceProxy:           e.Service.Proxy,
+		Checks:                 e.Checks,
+		Namespace:              e.Service.Namespace,
+	}}
 }
 
-// catalogServiceToEndpoints converts catalog service to service entry endpoint
-func catalogServiceToEndpoints(c *api.CatalogService) *v1alpha3.ServiceEntry_Endpoint {
-	address := c.Address
+// catalogServiceToEndpoints converts catalog service to service entry endpoint, reaching it at the tagged address
+// of the given type if it has one, and naming its port after the protocol it serves if known
+func catalogServiceToEndpoints(c *api.CatalogService, addressType, protocol string) *v1alpha3.ServiceEntry_Endpoint {
+	address, port := instanceAddress(c, addressType)
 	if address == "" {
 		log.Infof("instance %s of %s.%v is of a type that is not currently supported",
 			c.ServiceID, c.ServiceName, c.Namespace)
 		return nil
 	}
 
-	port := c.ServicePort
+	var ep *v1alpha3.ServiceEntry_Endpoint
 	if port > 0 { // port is optional and defaults to zero
-		return infer.Endpoint(address, uint32(port))
+		ep = infer.EndpointWithProtocol(address, uint32(port), protocol)
+	} else {
+		log.Infof("no port found for address %v, assuming http (80) and https (443)", address)
+		ep = infer.EndpointWithPorts(address, 80, 443)
+	}
+
+	// only instances discovered through the Health API carry their checks
+	if len(c.Checks) > 0 {
+		ep.Labels = map[string]string{provider.HealthStatusLabel: c.Checks.AggregatedStatus()}
+	}
+	return ep
+}
+
+// protocol returns the protocol the instance declares it serves, or the given default if it doesn't declare any
+func (w *watcher) protocol(c *api.CatalogService, def string) string {
+	if len(w.opts.ProtocolMetaKey) > 0 {
+		if p := c.ServiceMeta[w.opts.ProtocolMetaKey]; len(p) > 0 {
+			return p
+		}
+	}
+	if len(w.opts.ProtocolTagPrefix) > 0 {
+		for _, t := range c.ServiceTags {
+			if strings.HasPrefix(t, w.opts.ProtocolTagPrefix) {
+				return strings.TrimPrefix(t, w.opts.ProtocolTagPrefix)
+			}
+		}
+	}
+	return def
+}
+
+// applyNode sets the endpoint's weight, locality and labels from its instance and the node it's on
+func (w *watcher) applyNode(ep *v1alpha3.ServiceEntry_Endpoint, c *api.CatalogService) {
+	if w.opts.UseWeights {
+		weight := c.ServiceWeights.Passing
+		if c.Checks.AggregatedStatus() == api.HealthWarning {
+			weight = c.ServiceWeights.Warning
+		}
+		if weight > 0 {
+			ep.Weight = uint32(weight)
+		}
+	}
+
+	if len(w.opts.LocalityKeys) > 0 {
+		parts := make([]string, 0, len(w.opts.LocalityKeys))
+		for _, k := range w.opts.LocalityKeys {
+			v, ok := c.NodeMeta[k]
+			if !ok || len(v) == 0 {
+				break
+			}
+			parts = append(parts, v)
+		}
+		if len(parts) > 0 {
+			ep.Locality = strings.Join(parts, "/")
+		}
+	}
+
+	for _, k := range w.opts.LabelKeys {
+		if v, ok := c.NodeMeta[k]; ok {
+			if ep.Labels == nil {
+				ep.Labels = make(map[string]string)
+			}
+			ep.Labels[k] = v
+		}
 	}
+}
 
-	log.Infof("no port found for address %v, assuming http (80) and https (443)", address)
-	return &v1alpha3.ServiceEntry_Endpoint{Address: address, Ports: map[string]uint32{"http": 80, "https": 443}}
+// instanceAddress returns the address and port the instance is reached at. In order of preference, that's the
+// service's tagged address of the given type, the service's own address, the node's tagged address of the given
+// type, and finally the node's address. Services registered without an address of their own, which is common when
+// they run on the node's network, share the node's.
+func instanceAddress(c *api.CatalogService, addressType string) (string, int) {
+	if len(addressType) > 0 {
+		if tagged, ok := c.ServiceTaggedAddresses[addressType]; ok && len(tagged.Address) > 0 {
+			port := c.ServicePort
+			if tagged.Port > 0 {
+				port = tagged.Port
+			}
+			return tagged.Address, port
+		}
+	}
+	if len(c.ServiceAddress) > 0 {
+		return c.ServiceAddress, c.ServicePort
+	}
+	if tagged := c.TaggedAddresses[addressType]; len(addressType) > 0 && len(tagged) > 0 {
+		return tagged, c.ServicePort
+	}
+	return c.Address, c.ServicePort
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsScope(scopes []scope, s scope) bool {
+	for _, x := range scopes {
+		if x == s {
+			return true
+		}
+	}
+	return false
 }
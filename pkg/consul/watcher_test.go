@@ -1,10 +1,19 @@
 package consul
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/consul/api"
+	"istio.io/api/networking/v1alpha3"
 
 	"github.com/tetratelabs/istio-cloud-map/pkg/provider"
 )
@@ -32,16 +41,52 @@ func TestWatcher(t *testing.T) {
 		checkConsulEmpty(t)
 	})
 
+	t.Run("describeHealthyService", func(t *testing.T) {
+		testDescribeHealthyService(t)
+		checkConsulEmpty(t)
+	})
+
 	t.Run("refreshStore", func(t *testing.T) {
 		testRefreshStore(t)
 		checkConsulEmpty(t)
 	})
+
+	t.Run("watchService", func(t *testing.T) {
+		testWatchService(t)
+		checkConsulEmpty(t)
+	})
+}
+
+func newTestWatcher(t *testing.T) *watcher {
+	hostTemplates, err := parseHostTemplates(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &watcher{
+		client:        testClient,
+		store:         provider.NewStore(),
+		tickInterval:  time.Second * 10,
+		hostTemplates: hostTemplates,
+		workers:       make(chan struct{}, 2),
+		watches:       make(chan struct{}, 2),
+		catalogs:      make(map[scope]*catalog),
+	}
+}
+
+// eventually fails the test if the condition isn't met within a few seconds
+func eventually(t *testing.T, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !condition(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+	}
 }
 
 func checkConsulEmpty(t *testing.T) {
-	w := &watcher{client: testClient, store: provider.NewStore(), tickInterval: time.Second * 10}
+	w, c := newTestWatcher(t), &catalog{}
 
-	if n, err := w.listServices(); err != nil {
+	if n, err := w.listServices(c); err != nil {
 		t.Fatalf("listServices failed: %v", err)
 	} else if len(n) != 1 {
 		t.Fatalf("service must be empty")
@@ -135,8 +180,10 @@ func testRefreshStore(t *testing.T) {
 				}
 			}()
 
-			w := &watcher{client: testClient, store: provider.NewStore(), tickInterval: time.Second * 10}
-			w.refreshStore()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			w := newTestWatcher(t)
+			w.refreshStore(ctx)
 
 			actual := w.store.Hosts()
 			if len(actual) != len(tt.services)+1 {
@@ -164,15 +211,86 @@ func testRefreshStore(t *testing.T) {
 				}
 			}
 
-			prevIndex := w.lastIndex
-			w.refreshStore() // supposed to immediately return since the index not change
-			if prevIndex != w.lastIndex {
-				t.Fatalf("indexes must not change but have %d != %d", prevIndex, w.lastIndex)
+			prevIndex := w.catalogs[scope{}].lastIndex
+			w.refreshStore(ctx) // supposed to immediately return since the index not change
+			if lastIndex := w.catalogs[scope{}].lastIndex; prevIndex != lastIndex {
+				t.Fatalf("indexes must not change but have %d != %d", prevIndex, lastIndex)
 			}
 		})
 	}
 }
 
+func testWatchService(t *testing.T) {
+	register := func(node, address, name string) *api.CatalogRegistration {
+		r := &api.CatalogRegistration{
+			Node:    node,
+			Address: address,
+			Service: &api.AgentService{Service: name, Port: 8080, ID: name},
+		}
+		if _, err := testClient.Catalog().Register(r, nil); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	registrations := []*api.CatalogRegistration{
+		register("node1", "192.0.2.1", "service1"),
+		register("node1", "192.0.2.1", "service2"),
+	}
+	defer func() {
+		// clean up
+		for _, r := range registrations {
+			if _, err := testClient.Catalog().Deregister(&api.CatalogDeregistration{Node: r.Node}, nil); err != nil {
+				t.Fatalf("failed to clean up node %s: %v", r.Node, err)
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := newTestWatcher(t)
+	w.refreshStore(ctx)
+	before := w.store.Hosts()["service2"]
+	// blocking queries don't hold workers, so they notice changes even when every worker is busy
+	for i := 0; i < cap(w.workers); i++ {
+		w.workers <- struct{}{}
+	}
+
+	// the service's own blocking query notices the new instance, without the catalog being listed again
+	registrations = append(registrations, register("node2", "192.0.2.2", "service1"))
+	eventually(t, func() bool { return len(w.store.Hosts()["service1"]) == 2 })
+	if after := w.store.Hosts()["service2"]; len(after) != 1 || after[0] != before[0] {
+		t.Fatalf("service2 must be left alone but changed from %v to %v", before, after)
+	}
+
+	for i := 0; i < cap(w.workers); i++ {
+		<-w.workers
+	}
+
+	// no more blocking queries than there are watches are in flight; once every watch is taken, which waits for
+	// those in flight to time out, changes wait for one to be free
+	for i := 0; i < cap(w.watches); i++ {
+		w.watches <- struct{}{}
+	}
+	registrations = append(registrations, register("node3", "192.0.2.3", "service1"))
+	time.Sleep(2 * time.Second)
+	if eps := w.store.Hosts()["service1"]; len(eps) != 2 {
+		t.Fatalf("service1 has endpoints %v while every watch is taken, want them unchanged", eps)
+	}
+	for i := 0; i < cap(w.watches); i++ {
+		<-w.watches
+	}
+	eventually(t, func() bool { return len(w.store.Hosts()["service1"]) == 3 })
+
+	// services that are deregistered are removed from the store once the catalog is listed again
+	if _, err := testClient.Catalog().Deregister(&api.CatalogDeregistration{Node: "node1", ServiceID: "service2"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	w.refreshStore(ctx)
+	if eps, ok := w.store.Hosts()["service2"]; ok {
+		t.Fatalf("service2 must be removed but has endpoints %v", eps)
+	}
+}
+
 func testDescribeService(t *testing.T) {
 	tests := []struct {
 		name string
@@ -213,8 +331,8 @@ func testDescribeService(t *testing.T) {
 				}()
 			}
 
-			w := &watcher{client: testClient, store: provider.NewStore(), tickInterval: time.Second * 10}
-			ret, err := w.describeService(tt.sc.Service.Service)
+			w := newTestWatcher(t)
+			ret, _, err := w.describeService(context.Background(), &catalog{}, tt.sc.Service.Service, 0)
 			if tt.sc.Service.Service != "" {
 				if err != nil {
 					t.Fatal(err)
@@ -234,6 +352,68 @@ func testDescribeService(t *testing.T) {
 	}
 }
 
+func testDescribeHealthyService(t *testing.T) {
+	registrations := []*api.CatalogRegistration{}
+	for i, status := range []string{api.HealthPassing, api.HealthWarning, api.HealthCritical} {
+		node := fmt.Sprintf("node-%s", status)
+		registrations = append(registrations, &api.CatalogRegistration{
+			Node:    node,
+			Address: fmt.Sprintf("192.0.2.%d", i+1),
+			Service: &api.AgentService{Service: "service1", Port: 8080, ID: "service1"},
+			Check: &api.AgentCheck{
+				Node: node, CheckID: "service:service1", Name: "check", Status: status, ServiceID: "service1",
+			},
+		})
+	}
+	for _, r := range registrations {
+		if _, err := testClient.Catalog().Register(r, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		// clean up
+		for _, r := range registrations {
+			if _, err := testClient.Catalog().Deregister(&api.CatalogDeregistration{Node: r.Node}, nil); err != nil {
+				t.Fatalf("failed to clean up node %s: %v", r.Node, err)
+			}
+		}
+	}()
+
+	tests := []struct {
+		name           string
+		includeWarning bool
+		want           map[string]string // address->health status label
+	}{
+		{
+			name:           "include warning",
+			includeWarning: true,
+			want:           map[string]string{"192.0.2.1": api.HealthPassing, "192.0.2.2": api.HealthWarning},
+		},
+		{
+			name: "exclude warning",
+			want: map[string]string{"192.0.2.1": api.HealthPassing},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTestWatcher(t)
+			w.useHealthAPI, w.includeWarning = true, tt.includeWarning
+			svcs, _, err := w.describeService(context.Background(), &catalog{}, "service1", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual := map[string]string{}
+			for _, svc := range svcs {
+				ep := catalogServiceToEndpoints(&svc.CatalogService, "", "")
+				actual[ep.Address] = ep.Labels[provider.HealthStatusLabel]
+			}
+			if !reflect.DeepEqual(actual, tt.want) {
+				t.Fatalf("describeService() returned instances %v but want %v", actual, tt.want)
+			}
+		})
+	}
+}
+
 func testListServices(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -265,8 +445,8 @@ func testListServices(t *testing.T) {
 				}
 			}()
 
-			w := &watcher{client: testClient, store: provider.NewStore(), tickInterval: time.Second * 10}
-			actual, err := w.listServices()
+			w, c := newTestWatcher(t), &catalog{}
+			actual, err := w.listServices(c)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -295,13 +475,13 @@ func testListServices(t *testing.T) {
 			}
 		}()
 
-		w := &watcher{client: testClient, store: provider.NewStore(), tickInterval: time.Second * 10}
-		_, err = w.listServices()
+		w, c := newTestWatcher(t), &catalog{}
+		_, err = w.listServices(c)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		_, err = w.listServices()
+		_, err = w.listServices(c)
 		if err != errIndexChangeTimeout {
 			t.Fatalf(
 				"`%v` must be returned but got `%v`",
@@ -311,33 +491,337 @@ func testListServices(t *testing.T) {
 	})
 }
 
+func TestWatcher_reloadClient(t *testing.T) {
+	var tokens, datacenters []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, r.Header.Get("X-Consul-Token"))
+		datacenters = append(datacenters, r.URL.Query().Get("dc"))
+		w.Header().Set("X-Consul-Index", fmt.Sprint(len(tokens)))
+		fmt.Fprint(w, "{}")
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "consul")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("first"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ww, err := NewWatcher(provider.NewStore(), srv.URL, "", Options{Token: "ignored", TokenFile: tokenFile, Datacenter: "dc2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := ww.(*watcher)
+	w.refreshStore(context.Background())
+	w.refreshStore(context.Background()) // nothing changed, so we keep the client
+
+	if err := ioutil.WriteFile(tokenFile, []byte("second"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// make sure the modification time changes however coarse the file system's clock is
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(tokenFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	w.refreshStore(context.Background())
+
+	if want := []string{"first", "first", "second"}; !reflect.DeepEqual(tokens, want) {
+		t.Errorf("requests used tokens %v, want %v", tokens, want)
+	}
+	if want := []string{"dc2", "dc2", "dc2"}; !reflect.DeepEqual(datacenters, want) {
+		t.Errorf("requests went to datacenters %v, want %v", datacenters, want)
+	}
+}
+
+func TestWatcher_datacenters(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.Close()
+	instance := func(dc, address string) *api.CatalogService {
+		return &api.CatalogService{Datacenter: dc, Address: address, ServiceName: "web", ServicePort: 8080}
+	}
+	consul.set(scope{datacenter: "dc1"}, "web", instance("dc1", "192.0.2.1"))
+	consul.set(scope{datacenter: "dc2"}, "web", instance("dc2", "192.0.2.2"))
+	consul.set(scope{datacenter: "dc3"}, "web", instance("dc3", "192.0.2.3"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ww, err := NewWatcher(provider.NewStore(), consul.URL, "", Options{
+		Datacenters:   []string{AllDatacenters},
+		Localities:    map[string]string{"dc1": "us-east1/us-east1-a"},
+		HostTemplates: []string{"{{.Service}}.service.{{.Datacenter}}.consul", "{{.Service}}.service.consul"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := ww.(*watcher)
+
+	type endpoint struct{ address, locality string }
+	endpoints := func(host string) []endpoint {
+		out := []endpoint{}
+		for _, ep := range w.store.Hosts()[host] {
+			out = append(out, endpoint{ep.Address, ep.Locality})
+		}
+		return out
+	}
+	dc1 := endpoint{"192.0.2.1", "us-east1/us-east1-a"}
+	dc2 := endpoint{"192.0.2.2", "dc2"}
+	dc3 := endpoint{"192.0.2.3", "dc3"}
+
+	if err := w.refreshStore(ctx); err != nil || w.Healthy() != nil {
+		t.Errorf("refreshStore() = %v, health %v, want both nil", err, w.Healthy())
+	}
+	if got, want := endpoints("web.service.dc2.consul"), []endpoint{dc2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("datacenter qualified host has endpoints %v, want %v", got, want)
+	}
+	if got, want := endpoints("web.service.consul"), []endpoint{dc1, dc2, dc3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unqualified host has endpoints %v, want %v", got, want)
+	}
+
+	// a datacenter we can't reach keeps what we last discovered in it, and doesn't hold the others back
+	consul.fail("dc2", true)
+	consul.set(scope{datacenter: "dc1"}, "web", instance("dc1", "192.0.2.1"), instance("dc1", "192.0.2.4"))
+	if err := w.refreshStore(ctx); err == nil || w.Healthy() == nil {
+		t.Errorf("with dc2 unreachable, refreshStore() = %v, health %v, want both to be errors", err, w.Healthy())
+	}
+	dc1b := endpoint{"192.0.2.4", "us-east1/us-east1-a"}
+	eventually(t, func() bool { return len(endpoints("web.service.dc1.consul")) == 2 })
+	if got, want := endpoints("web.service.consul"), []endpoint{dc1, dc1b, dc2, dc3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with dc2 unreachable, unqualified host has endpoints %v, want %v", got, want)
+	}
+
+	// a datacenter that leaves the federation takes its services with it
+	consul.fail("dc2", false)
+	consul.remove("dc3")
+	w.refreshStore(ctx)
+	if err := w.Healthy(); err != nil {
+		t.Errorf("with dc2 back, health %v, want nil", err)
+	}
+	if got, want := endpoints("web.service.consul"), []endpoint{dc1, dc1b, dc2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("without dc3, unqualified host has endpoints %v, want %v", got, want)
+	}
+	if got := endpoints("web.service.dc3.consul"); len(got) != 0 {
+		t.Errorf("dc3's host must be removed but has endpoints %v", got)
+	}
+}
+
+func TestWatcher_hostMeta(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.Close()
+	instance := func(address string, meta map[string]string) *api.CatalogService {
+		return &api.CatalogService{Datacenter: "dc1", Address: address, ServiceName: "web", ServicePort: 443, ServiceMeta: meta}
+	}
+	consul.set(scope{datacenter: "dc1"}, "web",
+		instance("192.0.2.1", map[string]string{"tls": "true", "version": "v1"}),
+		instance("192.0.2.2", map[string]string{"tls": "true", "version": "v2"}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ww, err := NewWatcher(provider.NewStore(), consul.URL, "", Options{Datacenters: []string{"dc1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := ww.(*watcher)
+	w.refreshStore(ctx)
+
+	want := provider.HostMeta{
+		Provider:   "consul",
+		Service:    "web",
+		Meta:       map[string]string{"datacenter": "dc1"},
+		Attributes: map[string]string{"tls": "true"},
+	}
+	if got := w.store.Meta()["web"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Meta() of web = %+v, want %+v", got, want)
+	}
+}
+
+func TestWatcher_consistency(t *testing.T) {
+	tests := []struct {
+		mode      string
+		wantParam string
+	}{
+		{mode: "", wantParam: ""},
+		{mode: "default", wantParam: ""},
+		{mode: "stale", wantParam: "stale"},
+		{mode: "consistent", wantParam: "consistent"},
+		{mode: "cached", wantParam: "cached"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			consul := newFakeConsul()
+			defer consul.Close()
+			consul.set(scope{}, "web", &api.CatalogService{Address: "192.0.2.1", ServicePort: 8080})
+
+			ww, err := NewWatcher(provider.NewStore(), consul.URL, "", Options{Consistency: tt.mode, WaitTime: time.Second})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ww.(*watcher).refreshStore(ctx)
+
+			consul.m.Lock()
+			defer consul.m.Unlock()
+			for _, q := range consul.queries {
+				if got := q.Get("wait"); got != "1000ms" && q.Get("index") != "" {
+					t.Errorf("blocking query waits %q, want 1000ms", got)
+				}
+				for _, param := range []string{"stale", "consistent", "cached"} {
+					if _, ok := q[param]; ok != (param == tt.wantParam) {
+						t.Errorf("query %v has %s: %v, want %v", q, param, ok, !ok)
+					}
+				}
+			}
+		})
+	}
+
+	if _, err := NewWatcher(provider.NewStore(), "http://localhost:8500", "", Options{Consistency: "eventual"}); err == nil {
+		t.Error("NewWatcher() succeeded with an unknown consistency mode")
+	}
+}
+
+func TestWatcher_applyNode(t *testing.T) {
+	node := map[string]string{"region": "us-east1", "zone": "us-east1-a", "rack": "r12"}
+	weights := api.Weights{Passing: 10, Warning: 1}
+	warning := api.HealthChecks{{Status: api.HealthPassing}, {Status: api.HealthWarning}}
+
+	tests := []struct {
+		name   string
+		opts   Options
+		in     *api.CatalogService
+		labels map[string]string // labels the endpoint already has
+		want   *v1alpha3.ServiceEntry_Endpoint
+	}{
+		{
+			name: "nothing configured",
+			in:   &api.CatalogService{NodeMeta: node, ServiceWeights: weights},
+			want: &v1alpha3.ServiceEntry_Endpoint{Locality: "dc1"},
+		},
+		{
+			name: "passing weight",
+			opts: Options{UseWeights: true},
+			in:   &api.CatalogService{ServiceWeights: weights},
+			want: &v1alpha3.ServiceEntry_Endpoint{Locality: "dc1", Weight: 10},
+		},
+		{
+			name: "warning weight",
+			opts: Options{UseWeights: true},
+			in:   &api.CatalogService{ServiceWeights: weights, Checks: warning},
+			want: &v1alpha3.ServiceEntry_Endpoint{Locality: "dc1", Weight: 1},
+		},
+		{
+			name: "locality",
+			opts: Options{LocalityKeys: []string{"region", "zone", "rack"}},
+			in:   &api.CatalogService{NodeMeta: node},
+			want: &v1alpha3.ServiceEntry_Endpoint{Locality: "us-east1/us-east1-a/r12"},
+		},
+		{
+			name: "partial locality",
+			opts: Options{LocalityKeys: []string{"region", "availability-zone", "rack"}},
+			in:   &api.CatalogService{NodeMeta: node},
+			want: &v1alpha3.ServiceEntry_Endpoint{Locality: "us-east1"},
+		},
+		{
+			name: "no locality",
+			opts: Options{LocalityKeys: []string{"location"}},
+			in:   &api.CatalogService{NodeMeta: node},
+			want: &v1alpha3.ServiceEntry_Endpoint{Locality: "dc1"},
+		},
+		{
+			name:   "labels",
+			opts:   Options{LabelKeys: []string{"rack", "kernel"}},
+			in:     &api.CatalogService{NodeMeta: node},
+			labels: map[string]string{provider.HealthStatusLabel: api.HealthPassing},
+			want: &v1alpha3.ServiceEntry_Endpoint{
+				Locality: "dc1",
+				Labels:   map[string]string{provider.HealthStatusLabel: api.HealthPassing, "rack": "r12"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &watcher{opts: tt.opts}
+			ep := &v1alpha3.ServiceEntry_Endpoint{Locality: "dc1", Labels: tt.labels}
+			w.applyNode(ep, tt.in)
+			if !reflect.DeepEqual(ep, tt.want) {
+				t.Errorf("applyNode() = %v, want %v", ep, tt.want)
+			}
+		})
+	}
+}
+
 func TestCatalogServiceToEndpoints(t *testing.T) {
 	// empty address
-	res := catalogServiceToEndpoints(&api.CatalogService{})
+	res := catalogServiceToEndpoints(&api.CatalogService{}, "", "")
 	if res != nil {
 		t.Errorf("result must be nil but got %v", res)
 	}
 
 	// empty port
 	in := &api.CatalogService{Address: "192.0.2.4"}
-	res = catalogServiceToEndpoints(in)
+	res = catalogServiceToEndpoints(in, "", "")
 	if res.Address != in.Address {
 		t.Errorf("address must be %s but got %s", in.Address, res.Address)
 	}
-	if res.Ports["http"] != 80 {
+	if res.Ports["http-80"] != 80 {
 		t.Error("port 80 must be configured")
 	}
-	if res.Ports["https"] != 443 {
+	if res.Ports["https-443"] != 443 {
 		t.Error("port 433 must be configured")
 	}
 
 	// address and ports are provided
-	in = &api.CatalogService{Address: "192.0.2.10", ServicePort: 8080}
-	res = catalogServiceToEndpoints(in)
+	in = &api.CatalogService{Address: "192.0.2.10", ServicePort: 9090}
+	res = catalogServiceToEndpoints(in, "", "")
 	if res.Address != in.Address {
 		t.Errorf("address must be %s but got %s", in.Address, res.Address)
 	}
-	if res.Ports["tcp"] != uint32(in.ServicePort) {
-		t.Errorf("port %d must be of name tcp", in.ServicePort)
+	if res.Ports["tcp-9090"] != uint32(in.ServicePort) {
+		t.Errorf("port %d must be of name tcp-9090", in.ServicePort)
+	}
+}
+
+func TestInstanceAddress(t *testing.T) {
+	instance := &api.CatalogService{
+		Address:         "192.0.2.1",
+		TaggedAddresses: map[string]string{"lan": "192.0.2.1", "wan": "198.51.100.1"},
+		ServiceAddress:  "10.0.0.1",
+		ServiceTaggedAddresses: map[string]api.ServiceAddress{
+			"lan_ipv6": {Address: "2001:db8::1", Port: 9090},
+			"wan":      {Address: "198.51.100.2"},
+		},
+		ServicePort: 8080,
+	}
+	nodeOnly := &api.CatalogService{
+		Address:         "192.0.2.1",
+		TaggedAddresses: map[string]string{"lan": "192.0.2.1", "wan": "198.51.100.1"},
+		ServicePort:     8080,
+	}
+
+	tests := []struct {
+		name        string
+		in          *api.CatalogService
+		addressType string
+		wantAddress string
+		wantPort    int
+	}{
+		{name: "service address", in: instance, wantAddress: "10.0.0.1", wantPort: 8080},
+		{name: "service tagged address", in: instance, addressType: "wan", wantAddress: "198.51.100.2", wantPort: 8080},
+		{name: "service tagged address with port", in: instance, addressType: "lan_ipv6", wantAddress: "2001:db8::1", wantPort: 9090},
+		{name: "service address without tagged address", in: instance, addressType: "lan", wantAddress: "10.0.0.1", wantPort: 8080},
+		{name: "node address", in: nodeOnly, wantAddress: "192.0.2.1", wantPort: 8080},
+		{name: "node tagged address", in: nodeOnly, addressType: "wan", wantAddress: "198.51.100.1", wantPort: 8080},
+		{name: "node address without tagged address", in: nodeOnly, addressType: "lan_ipv6", wantAddress: "192.0.2.1", wantPort: 8080},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address, port := instanceAddress(tt.in, tt.addressType)
+			if address != tt.wantAddress || port != tt.wantPort {
+				t.Errorf("instanceAddress() = %s:%d, want %s:%d", address, port, tt.wantAddress, tt.wantPort)
+			}
+		})
 	}
 }
@@ -0,0 +1,95 @@
+package control
+
+import (
+	"github.com/golang/protobuf/proto"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	icapi "istio.io/client-go/pkg/clientset/versioned/typed/networking/v1alpha3"
+	iclisters "istio.io/client-go/pkg/listers/networking/v1alpha3"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/tetratelabs/istio-cloud-map/pkg/infer"
+	"github.com/tetratelabs/istio-cloud-map/pkg/provider"
+	"github.com/tetratelabs/istio-cloud-map/pkg/serviceentry"
+	"github.com/tetratelabs/log"
+)
+
+// DestinationRuleOptions configures the DestinationRules generated alongside ServiceEntries. They share the name,
+// namespace and owner of their ServiceEntry, and are created, updated and deleted with it.
+type DestinationRuleOptions struct {
+	Policies *infer.DestinationRules
+	// Client writes DestinationRules to the namespace ServiceEntries are published to
+	Client icapi.DestinationRuleInterface
+	// Lister lists the DestinationRules of that namespace
+	Lister iclisters.DestinationRuleNamespaceLister
+}
+
+// syncDestinationRule creates, updates or deletes the DestinationRule of the host's ServiceEntry, as its policies say
+func (s *synchronizer) syncDestinationRule(host string, se *ic.ServiceEntry, meta provider.HostMeta) {
+	if s.destinationRules == nil {
+		return
+	}
+	want := s.destinationRules.Policies.DestinationRule(se, host, meta)
+	existing, ok := s.existingDestinationRule(se.Name)
+	if !ok {
+		return
+	}
+	client := s.destinationRules.Client
+	switch {
+	case want == nil && existing == nil:
+	case want == nil:
+		s.removeDestinationRule(se.Name)
+	case existing == nil:
+		if _, err := client.Create(want); err != nil {
+			log.Errorf("error creating Destination Rule %q: %v", want.Name, err)
+			return
+		}
+		log.Infof("created Destination Rule %q", want.Name)
+	case proto.Equal(&existing.Spec, &want.Spec) && subset(want.Annotations, existing.Annotations):
+	default:
+		want.ResourceVersion = existing.ResourceVersion
+		if _, err := client.Update(want); err != nil {
+			log.Errorf("error updating Destination Rule %q: %v", want.Name, err)
+			return
+		}
+		log.Infof("updated Destination Rule %q", want.Name)
+	}
+}
+
+// deleteDestinationRule deletes the DestinationRule of the ServiceEntry of that name, if there's one of ours
+func (s *synchronizer) deleteDestinationRule(name string) {
+	if s.destinationRules == nil {
+		return
+	}
+	if existing, ok := s.existingDestinationRule(name); ok && existing != nil {
+		s.removeDestinationRule(name)
+	}
+}
+
+func (s *synchronizer) removeDestinationRule(name string) {
+	if err := s.destinationRules.Client.Delete(name, &v1.DeleteOptions{}); err != nil && !kerrors.IsNotFound(err) {
+		log.Errorf("error deleting Destination Rule %q: %v", name, err)
+		return
+	}
+	log.Infof("deleted Destination Rule %q", name)
+}
+
+// existingDestinationRule returns the DestinationRule of that name, nil if there's none, or false if it can't be
+// found out or the DestinationRule isn't ours to change. Those of previous runs of the operator are ours too.
+func (s *synchronizer) existingDestinationRule(name string) (*ic.DestinationRule, bool) {
+	existing, err := s.destinationRules.Lister.Get(name)
+	switch {
+	case kerrors.IsNotFound(err):
+		return nil, true
+	case err != nil:
+		log.Errorf("error getting Destination Rule %q: %v", name, err)
+		return nil, false
+	}
+	for _, ref := range existing.OwnerReferences {
+		if serviceentry.SameOwner(ref, s.owner) {
+			return existing, true
+		}
+	}
+	log.Debugf("Destination Rule %q was created by someone else, leaving it be", name)
+	return nil, false
+}
@@ -0,0 +1,148 @@
+package control
+
+import (
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+	icapi "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/clientset/versioned/typed/networking/v1alpha3"
+	iclisters "istio.io/client-go/pkg/listers/networking/v1alpha3"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/tetratelabs/istio-cloud-map/pkg/control/mock"
+	"github.com/tetratelabs/istio-cloud-map/pkg/infer"
+	"github.com/tetratelabs/istio-cloud-map/pkg/provider"
+)
+
+func TestSynchronizer_destinationRules(t *testing.T) {
+	owner := v1.OwnerReference{APIVersion: "cloudmap.istio.io", Kind: "ServiceController", Name: "test"}
+	drs := &mockDestinationRules{indexer: cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})}
+	ses := map[string]*icapi.ServiceEntry{}
+	store := &mock.Store{
+		Result:     map[string][]*v1alpha3.ServiceEntry_Endpoint{"web.tetrate.io": defaultEndpoints},
+		MetaResult: map[string]provider.HostMeta{"web.tetrate.io": {Provider: "consul", Attributes: map[string]string{"tls": "true"}}},
+	}
+	mi := &mockIstio{store: make(map[string]*icapi.ServiceEntry)}
+	s := &synchronizer{
+		owner:        owner,
+		store:        store,
+		serviceEntry: &mock.SEStore{Result: ses},
+		client:       mi,
+		mixed:        map[string]bool{},
+		destinationRules: &DestinationRuleOptions{
+			Policies: &infer.DestinationRules{},
+			Client:   drs,
+			Lister:   iclisters.NewDestinationRuleLister(drs.indexer).DestinationRules("default"),
+		},
+	}
+	name := infer.ServiceEntryName("", "web.tetrate.io")
+	get := func() *icapi.DestinationRule {
+		dr, err := s.destinationRules.Lister.Get(name)
+		if err != nil {
+			return nil
+		}
+		return dr
+	}
+
+	// created with the ServiceEntry
+	s.sync()
+	dr := get()
+	if dr == nil || dr.Spec.TrafficPolicy.Tls.Mode != v1alpha3.TLSSettings_SIMPLE {
+		t.Fatalf("DestinationRule = %v, want one originating TLS", dr)
+	}
+	if drs.writes != 1 {
+		t.Errorf("DestinationRule written %d times, want once", drs.writes)
+	}
+
+	// left alone while it's up to date
+	ses["web.tetrate.io"] = mi.store[name]
+	s.serviceEntry = &mock.SEStore{Result: map[string]*icapi.ServiceEntry{}} // so the ServiceEntry is only ours
+	s.createOrUpdate("web.tetrate.io", defaultEndpoints, store.MetaResult["web.tetrate.io"])
+	if drs.writes != 1 {
+		t.Errorf("up to date DestinationRule written %d times, want once", drs.writes)
+	}
+
+	// updated when its policy changes
+	s.destinationRules.Policies.Policies = []infer.DestinationRulePolicy{{
+		TrafficPolicy: &v1alpha3.TrafficPolicy{OutlierDetection: &v1alpha3.OutlierDetection{ConsecutiveErrors: 5}},
+	}}
+	s.createOrUpdate("web.tetrate.io", defaultEndpoints, store.MetaResult["web.tetrate.io"])
+	if dr := get(); dr == nil || dr.Spec.TrafficPolicy.OutlierDetection == nil || dr.Spec.TrafficPolicy.Tls == nil {
+		t.Errorf("DestinationRule = %v, want it updated with outlier detection", dr)
+	}
+
+	// deleted when no policy applies anymore
+	s.destinationRules.Policies = &infer.DestinationRules{TLSAttribute: "secure"}
+	s.createOrUpdate("web.tetrate.io", defaultEndpoints, store.MetaResult["web.tetrate.io"])
+	if dr := get(); dr != nil {
+		t.Errorf("DestinationRule = %v, want it deleted", dr)
+	}
+
+	// garbage collected with the ServiceEntry
+	s.destinationRules.Policies = &infer.DestinationRules{}
+	s.createOrUpdate("web.tetrate.io", defaultEndpoints, store.MetaResult["web.tetrate.io"])
+	s.serviceEntry = &mock.SEStore{Result: map[string]*icapi.ServiceEntry{"web.tetrate.io": mi.store[name]}}
+	s.garbageCollect(map[string][]*v1alpha3.ServiceEntry_Endpoint{})
+	if dr := get(); dr != nil {
+		t.Errorf("DestinationRule = %v, want it garbage collected", dr)
+	}
+
+	// a previous run's are still ours, though its owner had another UID
+	previous := owner
+	previous.UID = "previous-run"
+	drs.indexer.Add(&icapi.DestinationRule{ObjectMeta: v1.ObjectMeta{
+		Name: name, Namespace: "default", OwnerReferences: []v1.OwnerReference{previous},
+	}})
+	s.createOrUpdate("web.tetrate.io", defaultEndpoints, store.MetaResult["web.tetrate.io"])
+	if dr := get(); dr == nil || dr.Spec.TrafficPolicy == nil || dr.Spec.TrafficPolicy.Tls == nil {
+		t.Errorf("previous run's DestinationRule = %v, want it updated", dr)
+	}
+	s.garbageCollect(map[string][]*v1alpha3.ServiceEntry_Endpoint{})
+	if dr := get(); dr != nil {
+		t.Errorf("previous run's DestinationRule = %v, want it garbage collected", dr)
+	}
+
+	// someone else's are left alone
+	theirs := &icapi.DestinationRule{ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "default"}}
+	drs.indexer.Add(theirs)
+	drs.writes = 0
+	s.createOrUpdate("web.tetrate.io", defaultEndpoints, store.MetaResult["web.tetrate.io"])
+	s.garbageCollect(map[string][]*v1alpha3.ServiceEntry_Endpoint{})
+	if dr := get(); dr != theirs || drs.writes != 0 {
+		t.Errorf("DestinationRule = %v after %d writes, want someone else's left alone", dr, drs.writes)
+	}
+}
+
+// mockDestinationRules writes DestinationRules to the indexer its lister reads, in the default namespace
+type mockDestinationRules struct {
+	ic.DestinationRuleInterface
+
+	indexer cache.Indexer
+	writes  int
+}
+
+func (m *mockDestinationRules) Create(dr *icapi.DestinationRule) (*icapi.DestinationRule, error) {
+	m.writes++
+	dr = dr.DeepCopy()
+	dr.Namespace = "default"
+	return dr, m.indexer.Add(dr)
+}
+
+func (m *mockDestinationRules) Update(dr *icapi.DestinationRule) (*icapi.DestinationRule, error) {
+	m.writes++
+	dr = dr.DeepCopy()
+	dr.Namespace = "default"
+	return dr, m.indexer.Update(dr)
+}
+
+func (m *mockDestinationRules) Delete(name string, _ *v1.DeleteOptions) error {
+	m.writes++
+	obj, ok, _ := m.indexer.GetByKey("default/" + name)
+	if !ok {
+		return kerrors.NewNotFound(schema.GroupResource{Resource: "destinationrules"}, name)
+	}
+	return m.indexer.Delete(obj)
+}
@@ -0,0 +1,96 @@
+package control
+
+import (
+	"net"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"github.com/tetratelabs/log"
+)
+
+// Strategies for hosts with both IP and hostname endpoints, which can't all be resolved the same way
+const (
+	// MixedDNS publishes every endpoint in a single DNS ServiceEntry
+	MixedDNS = "dns"
+	// MixedDropMinority publishes only the endpoints of the more common type, IPs if there are as many of each
+	MixedDropMinority = "drop-minority"
+	// MixedSplit publishes the IP endpoints under the host, and the hostname endpoints under its alias prefixed with
+	// SplitAliasPrefix
+	MixedSplit = "split"
+	// MixedNone publishes a ServiceEntry with NONE resolution and no endpoints, leaving clients to resolve the host
+	MixedNone = "none"
+
+	// SplitAliasPrefix prefixes the alias hostname endpoints are published under by MixedSplit
+	SplitAliasPrefix = "dns."
+)
+
+// MixedStrategies are the strategies Options.MixedStrategy can select
+var MixedStrategies = []string{MixedDNS, MixedDropMinority, MixedSplit, MixedNone}
+
+// hosts returns the endpoints of every host of the store, once the mixed strategy is applied. Splitting a host adds
+// its alias.
+func (s *synchronizer) hosts() map[string][]*v1alpha3.ServiceEntry_Endpoint {
+	hosts := s.store.Hosts()
+	out := make(map[string][]*v1alpha3.ServiceEntry_Endpoint, len(hosts))
+	for host, endpoints := range hosts {
+		ips, hostnames := splitEndpoints(endpoints)
+		mixed := len(ips) > 0 && len(hostnames) > 0
+		s.logMixed(host, mixed, len(ips), len(hostnames))
+		switch {
+		case !mixed:
+			out[host] = endpoints
+		case s.mixedStrategy == MixedDropMinority && len(hostnames) > len(ips):
+			out[host] = hostnames
+		case s.mixedStrategy == MixedDropMinority:
+			out[host] = ips
+		case s.mixedStrategy == MixedSplit:
+			out[host] = ips
+			// the alias is only ours to take if the provider doesn't have a host of that name itself
+			if _, ok := hosts[SplitAliasPrefix+host]; !ok {
+				out[SplitAliasPrefix+host] = hostnames
+			}
+		default: // MixedDNS, and MixedNone which drops the endpoints once their ports are inferred
+			out[host] = endpoints
+		}
+	}
+	// forget hosts that have gone away, so they're logged afresh if they come back
+	for host := range s.mixed {
+		if _, ok := hosts[host]; !ok {
+			delete(s.mixed, host)
+		}
+	}
+	return out
+}
+
+// logMixed logs the strategy applied to the host when its endpoints become mixed, and when they no longer are
+func (s *synchronizer) logMixed(host string, mixed bool, ips, hostnames int) {
+	if mixed == s.mixed[host] {
+		return
+	}
+	if mixed {
+		log.Infof("host %q has %d IP and %d hostname endpoints, applying the %q strategy", host, ips, hostnames, s.strategy())
+		s.mixed[host] = true
+	} else {
+		log.Infof("host %q no longer has both IP and hostname endpoints", host)
+		delete(s.mixed, host)
+	}
+}
+
+func (s *synchronizer) strategy() string {
+	if len(s.mixedStrategy) == 0 {
+		return MixedDNS
+	}
+	return s.mixedStrategy
+}
+
+// splitEndpoints separates the endpoints with IP addresses from those with hostnames
+func splitEndpoints(endpoints []*v1alpha3.ServiceEntry_Endpoint) (ips, hostnames []*v1alpha3.ServiceEntry_Endpoint) {
+	for _, ep := range endpoints {
+		if net.ParseIP(ep.Address) != nil {
+			ips = append(ips, ep)
+		} else {
+			hostnames = append(hostnames, ep)
+		}
+	}
+	return ips, hostnames
+}
@@ -0,0 +1,126 @@
+package control
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+	icapi "istio.io/client-go/pkg/apis/networking/v1alpha3"
+
+	"github.com/tetratelabs/istio-cloud-map/pkg/control/mock"
+	"github.com/tetratelabs/istio-cloud-map/pkg/infer"
+	"github.com/tetratelabs/istio-cloud-map/pkg/vip"
+)
+
+func TestSynchronizer_hosts(t *testing.T) {
+	ip1 := &v1alpha3.ServiceEntry_Endpoint{Address: "1.1.1.1", Ports: map[string]uint32{"http-80": 80}}
+	ip2 := &v1alpha3.ServiceEntry_Endpoint{Address: "8.8.8.8", Ports: map[string]uint32{"http-80": 80}}
+	cname := &v1alpha3.ServiceEntry_Endpoint{Address: "demo.tetrate.io", Ports: map[string]uint32{"http-80": 80}}
+	mixed := []*v1alpha3.ServiceEntry_Endpoint{ip1, cname, ip2}
+
+	tests := []struct {
+		strategy string
+		hosts    map[string][]*v1alpha3.ServiceEntry_Endpoint
+		want     map[string][]*v1alpha3.ServiceEntry_Endpoint
+	}{
+		{
+			strategy: "",
+			hosts:    map[string][]*v1alpha3.ServiceEntry_Endpoint{"tetrate.io": mixed},
+			want:     map[string][]*v1alpha3.ServiceEntry_Endpoint{"tetrate.io": mixed},
+		},
+		{
+			strategy: MixedDropMinority,
+			hosts:    map[string][]*v1alpha3.ServiceEntry_Endpoint{"tetrate.io": mixed},
+			want:     map[string][]*v1alpha3.ServiceEntry_Endpoint{"tetrate.io": {ip1, ip2}},
+		},
+		{
+			strategy: MixedDropMinority,
+			hosts:    map[string][]*v1alpha3.ServiceEntry_Endpoint{"tetrate.io": {ip1, cname, cname}},
+			want:     map[string][]*v1alpha3.ServiceEntry_Endpoint{"tetrate.io": {cname, cname}},
+		},
+		{
+			strategy: MixedSplit,
+			hosts:    map[string][]*v1alpha3.ServiceEntry_Endpoint{"tetrate.io": mixed, "other.io": {ip1}},
+			want: map[string][]*v1alpha3.ServiceEntry_Endpoint{
+				"tetrate.io":     {ip1, ip2},
+				"dns.tetrate.io": {cname},
+				"other.io":       {ip1},
+			},
+		},
+		{
+			strategy: MixedSplit,
+			hosts:    map[string][]*v1alpha3.ServiceEntry_Endpoint{"tetrate.io": mixed, "dns.tetrate.io": {ip1}},
+			want: map[string][]*v1alpha3.ServiceEntry_Endpoint{
+				"tetrate.io":     {ip1, ip2},
+				"dns.tetrate.io": {ip1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			s := &synchronizer{store: &mock.Store{Result: tt.hosts}, mixedStrategy: tt.strategy, mixed: map[string]bool{}}
+			if got := s.hosts(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hosts() = %v, want %v", got, tt.want)
+			}
+			var logged []string
+			for host := range s.mixed {
+				logged = append(logged, host)
+			}
+			sort.Strings(logged)
+			if !reflect.DeepEqual(logged, []string{"tetrate.io"}) {
+				t.Errorf("hosts() found %v mixed, want tetrate.io", logged)
+			}
+
+			// hosts that are gone are forgotten
+			s.store = &mock.Store{Result: map[string][]*v1alpha3.ServiceEntry_Endpoint{"other.io": {ip1}}}
+			s.hosts()
+			if len(s.mixed) != 0 {
+				t.Errorf("hosts() still has %v mixed once they're gone, want none", s.mixed)
+			}
+		})
+	}
+}
+
+func TestSynchronizer_mixedNone(t *testing.T) {
+	endpoints := []*v1alpha3.ServiceEntry_Endpoint{
+		{Address: "1.1.1.1", Ports: map[string]uint32{"http-80": 80}},
+		{Address: "demo.tetrate.io", Ports: map[string]uint32{"https-443": 443}},
+	}
+	mi := &mockIstio{store: make(map[string]*icapi.ServiceEntry)}
+	s := &synchronizer{
+		store:         &mock.Store{Result: map[string][]*v1alpha3.ServiceEntry_Endpoint{"tetrate.io": endpoints}},
+		serviceEntry:  &mock.SEStore{Result: map[string]*icapi.ServiceEntry{}},
+		client:        mi,
+		mixedStrategy: MixedNone,
+		mixed:         map[string]bool{},
+	}
+	s.sync()
+
+	se := mi.store[infer.ServiceEntryName("", "tetrate.io")]
+	if se == nil {
+		t.Fatal("ServiceEntry wasn't created")
+	}
+	if se.Spec.Resolution != v1alpha3.ServiceEntry_NONE || len(se.Spec.Endpoints) != 0 {
+		t.Errorf("ServiceEntry has resolution %v and endpoints %v, want NONE without endpoints",
+			se.Spec.Resolution, se.Spec.Endpoints)
+	}
+	if len(se.Spec.Ports) != 2 {
+		t.Errorf("ServiceEntry has ports %v, want those of both endpoints", se.Spec.Ports)
+	}
+	if len(se.Spec.Addresses) != 0 {
+		t.Errorf("ServiceEntry has addresses %v, want none", se.Spec.Addresses)
+	}
+
+	// its only address is its virtual IP, if it has one
+	allocator, err := vip.NewAllocator("240.240.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.vips = allocator
+	s.sync()
+	se = mi.store[infer.ServiceEntryName("", "tetrate.io")]
+	if ip := se.Annotations[vip.Annotation]; len(se.Spec.Addresses) != 1 || se.Spec.Addresses[0] != ip {
+		t.Errorf("ServiceEntry has addresses %v, want its virtual IP %q", se.Spec.Addresses, ip)
+	}
+}
@@ -1,10 +1,15 @@
 package mock
 
-import "istio.io/api/networking/v1alpha3"
+import (
+	"istio.io/api/networking/v1alpha3"
+
+	"github.com/tetratelabs/istio-cloud-map/pkg/provider"
+)
 
 // Store is a mock store
 type Store struct {
-	Result map[string][]*v1alpha3.ServiceEntry_Endpoint
+	Result     map[string][]*v1alpha3.ServiceEntry_Endpoint
+	MetaResult map[string]provider.HostMeta
 }
 
 // Hosts return s.Result
@@ -15,3 +20,12 @@ func (s *Store) Hosts() map[string][]*v1alpha3.ServiceEntry_Endpoint {
 func (s *Store) Set(map[string][]*v1alpha3.ServiceEntry_Endpoint) {
 	return
 }
+
+// Meta returns s.MetaResult
+func (s *Store) Meta() map[string]provider.HostMeta {
+	return s.MetaResult
+}
+
+func (s *Store) SetMeta(map[string]provider.HostMeta) {
+	return
+}
@@ -3,18 +3,42 @@ package control
 import (
 	"context"
 	"reflect"
+	"strings"
 	"time"
 
 	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
 	icapi "istio.io/client-go/pkg/clientset/versioned/typed/networking/v1alpha3"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/tetratelabs/istio-cloud-map/pkg/infer"
+	"github.com/tetratelabs/istio-cloud-map/pkg/overlay"
 	"github.com/tetratelabs/istio-cloud-map/pkg/provider"
 	"github.com/tetratelabs/istio-cloud-map/pkg/serviceentry"
+	"github.com/tetratelabs/istio-cloud-map/pkg/vip"
 	"github.com/tetratelabs/log"
 )
 
+// Options configures how the synchronizer generates ServiceEntries beyond what it infers from their endpoints
+type Options struct {
+	// VIPs, if set, allocates every ServiceEntry a stable virtual IP, replacing the addresses inferred from its
+	// endpoints
+	VIPs *vip.Allocator
+	// MixedStrategy, one of MixedStrategies, is how hosts with both IP and hostname endpoints are published.
+	// Defaults to MixedDNS.
+	MixedStrategy string
+	// Rules set the Location, ExportTo and SubjectAltNames of the ServiceEntries of the hosts they match
+	Rules infer.ServiceEntryRules
+	// Overlays patch the ServiceEntries of the hosts they match, once everything else is generated
+	Overlays overlay.Overlays
+	// DestinationRules, if set, generates DestinationRules alongside the ServiceEntries of the hosts its policies
+	// apply to
+	DestinationRules *DestinationRuleOptions
+	// WorkloadEntries, if set, moves the endpoints of ServiceEntries with IP endpoints only to WorkloadEntries they
+	// select
+	WorkloadEntries *WorkloadEntryOptions
+}
+
 type synchronizer struct {
 	owner              v1.OwnerReference
 	serviceEntry       serviceentry.Store
@@ -22,10 +46,17 @@ type synchronizer struct {
 	serviceEntryPrefix string
 	client             icapi.ServiceEntryInterface
 	interval           time.Duration
+	vips               *vip.Allocator
+	mixedStrategy      string
+	mixed              map[string]bool // hosts whose endpoints are mixed, as last logged
+	rules              infer.ServiceEntryRules
+	overlays           overlay.Overlays
+	destinationRules   *DestinationRuleOptions
+	workloadEntries    *WorkloadEntryOptions
 }
 
-func NewSynchronizer(owner v1.OwnerReference,
-	serviceEntry serviceentry.Store, store provider.Store, serviceEntryPrefix string, client icapi.ServiceEntryInterface) *synchronizer {
+func NewSynchronizer(owner v1.OwnerReference, serviceEntry serviceentry.Store, store provider.Store,
+	serviceEntryPrefix string, client icapi.ServiceEntryInterface, opts Options) *synchronizer {
 	return &synchronizer{
 		owner:              owner,
 		serviceEntry:       serviceEntry,
@@ -33,6 +64,13 @@ func NewSynchronizer(owner v1.OwnerReference,
 		serviceEntryPrefix: serviceEntryPrefix,
 		client:             client,
 		interval:           time.Second * 5,
+		vips:               opts.VIPs,
+		mixedStrategy:      opts.MixedStrategy,
+		mixed:              make(map[string]bool),
+		rules:              opts.Rules,
+		overlays:           opts.Overlays,
+		destinationRules:   opts.DestinationRules,
+		workloadEntries:    opts.WorkloadEntries,
 	}
 }
 
@@ -52,33 +90,62 @@ func (s *synchronizer) Run(ctx context.Context) {
 }
 
 func (s *synchronizer) sync() {
+	s.reserveVIPs()
 	// Entries are generated per host; entirely from information in the slice of endpoints;
 	// so we only actually need to compare the current endpoints with the new endpoints.
-	for host, endpoints := range s.store.Hosts() {
+	hosts := s.hosts()
+	meta := s.store.Meta()
+	for host, endpoints := range hosts {
 		// If a service entry with the same host has been created by someone else, continue.
 		if _, ok := s.serviceEntry.Theirs()[host]; ok {
 			continue
 		}
-		s.createOrUpdate(host, endpoints)
+		m, ok := meta[host]
+		if !ok { // split aliases are described by the host they're split from
+			m = meta[strings.TrimPrefix(host, SplitAliasPrefix)]
+		}
+		s.createOrUpdate(host, endpoints, m)
 	}
-	s.garbageCollect()
+	s.garbageCollect(hosts)
 }
 
-func (s *synchronizer) createOrUpdate(host string, endpoints []*v1alpha3.ServiceEntry_Endpoint) {
+func (s *synchronizer) createOrUpdate(host string, endpoints []*v1alpha3.ServiceEntry_Endpoint, meta provider.HostMeta) {
 	newServiceEntry := infer.ServiceEntry(s.owner, s.serviceEntryPrefix, host, endpoints)
+	if ips, hostnames := splitEndpoints(endpoints); s.mixedStrategy == MixedNone && len(ips) > 0 && len(hostnames) > 0 {
+		newServiceEntry.Spec.Resolution = v1alpha3.ServiceEntry_NONE
+		newServiceEntry.Spec.Endpoints = nil
+		// the address of one of the endpoints would only catch the traffic to it; the virtual IP, if any, is set below
+		newServiceEntry.Spec.Addresses = nil
+	}
+	selector, workloadEntries := s.selectWorkloadEntries(host, newServiceEntry)
+	s.rules.Apply(newServiceEntry, host, meta)
+	s.allocateVIP(host, newServiceEntry)
 	name := infer.ServiceEntryName(s.serviceEntryPrefix, host)
-	if _, ok := s.serviceEntry.Ours()[host]; ok {
+	existing, ok := s.serviceEntry.Ours()[host]
+	newServiceEntry, err := s.overlays.Apply(newServiceEntry, host, meta)
+	if err != nil {
+		log.Errorf("error overlaying Service Entry %q, leaving it as it is: %v", name, err)
+		if !ok {
+			s.releaseVIP(host)
+		}
+		return
+	}
+	if ok {
 		// If we have already created an identical service entry, return.
-		if reflect.DeepEqual(s.serviceEntry.Ours()[host].Spec.Endpoints, endpoints) {
+		if identical(existing, newServiceEntry) {
+			newServiceEntry.Name = existing.Name
+			s.syncDestinationRule(host, newServiceEntry, meta)
+			s.syncWorkloadEntries(selector, workloadEntries)
 			return
 		}
-		// Otherwise, endpoints have changed so update existing Service Entry
-		n := infer.ServiceEntryName(s.serviceEntryPrefix, host)
-		oldServiceEntry, err := s.client.Get(n, v1.GetOptions{})
+		// Otherwise, endpoints or settings have changed so update existing Service Entry, under the name it has
+		name = existing.Name
+		oldServiceEntry, err := s.client.Get(name, v1.GetOptions{})
 		if err != nil {
-			log.Errorf("failed to get existing service entry %q for host %q", n, host)
+			log.Errorf("failed to get existing service entry %q for host %q", name, host)
 			return
 		}
+		newServiceEntry.Name = name
 		newServiceEntry.ResourceVersion = oldServiceEntry.ResourceVersion
 		rv, err := s.client.Update(newServiceEntry)
 		if err != nil {
@@ -86,27 +153,114 @@ func (s *synchronizer) createOrUpdate(host string, endpoints []*v1alpha3.Service
 			return
 		}
 		log.Infof("updated Service Entry %q, ResourceVersion is now %q", name, rv.ResourceVersion)
+		s.syncDestinationRule(host, newServiceEntry, meta)
+		s.syncWorkloadEntries(selector, workloadEntries)
 		return
 	}
 	// Otherwise, create a new Service Entry
 	rv, err := s.client.Create(newServiceEntry)
 	if err != nil {
 		log.Errorf("error creating Service Entry %q: %v\n%v", name, err, newServiceEntry)
+		s.releaseVIP(host)
+		return
 	}
 	log.Infof("created Service Entry %q, ResourceVersion is %q", name, rv.ResourceVersion)
+	s.syncDestinationRule(host, newServiceEntry, meta)
+	s.syncWorkloadEntries(selector, workloadEntries)
 }
 
-func (s *synchronizer) garbageCollect() {
-	for host := range s.serviceEntry.Ours() {
+func (s *synchronizer) garbageCollect(hosts map[string][]*v1alpha3.ServiceEntry_Endpoint) {
+	for host, se := range s.serviceEntry.Ours() {
 		// If host no longer exists, delete service entry
-		if _, ok := s.store.Hosts()[host]; !ok {
+		if _, ok := hosts[host]; !ok {
 			// TODO: namespaces!
 			// TODO: Don't attempt to delete no owners
-			name := infer.ServiceEntryName(s.serviceEntryPrefix, host)
+			name := se.Name
 			if err := s.client.Delete(name, &v1.DeleteOptions{}); err != nil {
 				log.Errorf("error deleting Service Entry %q: %v", name, err)
+				continue
 			}
 			log.Infof("successfully deleted Service Entry %q", name)
+			s.deleteDestinationRule(name)
+			s.deleteWorkloadEntries(se)
+			if s.vips != nil {
+				s.vips.Release(infer.Host(se))
+			}
+		}
+	}
+}
+
+// reserveVIPs records the virtual IPs our ServiceEntries hold, including those previous runs created, so they keep
+// them across restarts and no other host is allocated them. A virtual IP is held by the host its ServiceEntry was
+// generated for, whatever other hosts the ServiceEntry has.
+func (s *synchronizer) reserveVIPs() {
+	if s.vips == nil {
+		return
+	}
+	for _, se := range s.serviceEntry.Ours() {
+		if ip, ok := se.Annotations[vip.Annotation]; ok && !s.vips.Reserve(infer.Host(se), ip) {
+			log.Warnf("Service Entry %q can't keep virtual IP %s, it will be allocated another", se.Name, ip)
+		}
+	}
+}
+
+// allocateVIP sets the addresses of the host's ServiceEntry to its virtual IP, recording it in an annotation
+func (s *synchronizer) allocateVIP(host string, se *ic.ServiceEntry) {
+	if s.vips == nil {
+		return
+	}
+	ip, err := s.vips.Allocate(host)
+	if err != nil {
+		log.Errorf("error allocating a virtual IP to %q, keeping its inferred addresses: %v", host, err)
+		return
+	}
+	se.Spec.Addresses = []string{ip}
+	if se.Annotations == nil {
+		se.Annotations = make(map[string]string)
+	}
+	se.Annotations[vip.Annotation] = ip
+}
+
+// releaseVIP releases the virtual IP allocated to a host whose ServiceEntry couldn't be created, so it isn't held
+// by no ServiceEntry, which garbage collection would never release
+func (s *synchronizer) releaseVIP(host string) {
+	if s.vips != nil {
+		s.vips.Release(host)
+	}
+}
+
+// identical reports whether the existing ServiceEntry has the spec of the generated one, and its labels and
+// annotations. Labels and annotations others add to it are ignored.
+func identical(existing, generated *ic.ServiceEntry) bool {
+	a, b := existing.Spec, generated.Spec
+	return equivalent(a.Hosts, b.Hosts) &&
+		equivalent(a.Endpoints, b.Endpoints) &&
+		equivalent(a.Addresses, b.Addresses) &&
+		equivalent(a.Ports, b.Ports) &&
+		a.Location == b.Location &&
+		a.Resolution == b.Resolution &&
+		equivalent(a.ExportTo, b.ExportTo) &&
+		equivalent(a.SubjectAltNames, b.SubjectAltNames) &&
+		subset(generated.Labels, existing.Labels) &&
+		subset(generated.Annotations, existing.Annotations)
+}
+
+// subset reports whether every key of a has the same value in b
+func subset(a, b map[string]string) bool {
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
 		}
 	}
+	return true
+}
+
+// equivalent compares parts of ServiceEntry specs, where empty and nil slices are the same once round-tripped
+// through the API server
+func equivalent(a, b interface{}) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.Kind() == reflect.Slice && vb.Kind() == reflect.Slice && va.Len() == 0 && vb.Len() == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
 }
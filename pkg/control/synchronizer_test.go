@@ -1,15 +1,21 @@
 package control
 
 import (
+	"reflect"
 	"testing"
 
 	"istio.io/api/networking/v1alpha3"
 	icapi "istio.io/client-go/pkg/apis/networking/v1alpha3"
 	ic "istio.io/client-go/pkg/clientset/versioned/typed/networking/v1alpha3"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 
 	"github.com/tetratelabs/istio-cloud-map/pkg/control/mock"
 	"github.com/tetratelabs/istio-cloud-map/pkg/infer"
+	"github.com/tetratelabs/istio-cloud-map/pkg/overlay"
+	"github.com/tetratelabs/istio-cloud-map/pkg/provider"
+	"github.com/tetratelabs/istio-cloud-map/pkg/serviceentry"
+	"github.com/tetratelabs/istio-cloud-map/pkg/vip"
 )
 
 var defaultHost = "tetrate.io"
@@ -17,7 +23,7 @@ var defaultHost = "tetrate.io"
 var defaultEndpoints = []*v1alpha3.ServiceEntry_Endpoint{
 	&v1alpha3.ServiceEntry_Endpoint{
 		Address: "8.8.8.8",
-		Ports:   map[string]uint32{"http": 80, "https": 443},
+		Ports:   map[string]uint32{"http-80": 80, "https-443": 443},
 	},
 }
 
@@ -27,12 +33,13 @@ var defaultHosts = map[string][]*v1alpha3.ServiceEntry_Endpoint{
 
 var defaultServiceEntries = map[string]*icapi.ServiceEntry{
 	defaultHost: {
-		v1.TypeMeta{},
-		v1.ObjectMeta{
-			Name: infer.ServiceEntryName("cloud-map", defaultHost),
+		ObjectMeta: v1.ObjectMeta{
+			Name:        infer.ServiceEntryName("cloud-map", defaultHost),
+			Annotations: map[string]string{infer.HostAnnotation: defaultHost},
 		},
-		v1alpha3.ServiceEntry{
-			Hosts: []string{defaultHost},
+		Spec: v1alpha3.ServiceEntry{
+			Hosts:     []string{defaultHost},
+			Addresses: []string{"8.8.8.8"},
 			// assume external for now
 			Location:   v1alpha3.ServiceEntry_MESH_EXTERNAL,
 			Resolution: infer.Resolution(defaultEndpoints),
@@ -73,7 +80,7 @@ func TestSynchronizer_garbageCollect(t *testing.T) {
 				serviceEntry: &mock.SEStore{Result: tt.serviceEntries},
 				client:       &mockIstio{store: make(map[string]*icapi.ServiceEntry)},
 			}
-			s.garbageCollect()
+			s.garbageCollect(tt.cloudMapHosts)
 			if s.client.(*mockIstio).DeleteCall != tt.deleteCall {
 				t.Errorf("Delete called = %v, want %v", s.client.(*mockIstio).DeleteCall, tt.deleteCall)
 			}
@@ -107,11 +114,11 @@ func TestSynchronizer_createOrUpdate(t *testing.T) {
 			endpoints: []*v1alpha3.ServiceEntry_Endpoint{
 				&v1alpha3.ServiceEntry_Endpoint{
 					Address: "8.8.8.8",
-					Ports:   map[string]uint32{"http": 80, "https": 443},
+					Ports:   map[string]uint32{"http-80": 80, "https-443": 443},
 				},
 				&v1alpha3.ServiceEntry_Endpoint{
 					Address: "1.1.1.1",
-					Ports:   map[string]uint32{"http": 80, "https": 443},
+					Ports:   map[string]uint32{"http-80": 80, "https-443": 443},
 				},
 			},
 		},
@@ -140,7 +147,7 @@ func TestSynchronizer_createOrUpdate(t *testing.T) {
 				serviceEntry: &mock.SEStore{Result: tt.serviceEntries},
 				client:       &mockIstio{store: make(map[string]*icapi.ServiceEntry)},
 			}
-			s.createOrUpdate(tt.host, tt.endpoints)
+			s.createOrUpdate(tt.host, tt.endpoints, provider.HostMeta{})
 			if s.client.(*mockIstio).UpdateCall != tt.updateCall {
 				t.Errorf("Update called = %v, want %v", s.client.(*mockIstio).UpdateCall, tt.createCall)
 			}
@@ -154,6 +161,341 @@ func TestSynchronizer_createOrUpdate(t *testing.T) {
 	}
 }
 
+func TestSynchronizer_updateKeepsName(t *testing.T) {
+	existing := defaultServiceEntries[defaultHost].DeepCopy()
+	existing.Name = "named-by-an-older-version"
+	mi := &mockIstio{store: map[string]*icapi.ServiceEntry{existing.Name: existing}}
+	s := &synchronizer{
+		serviceEntryPrefix: "cloud-map",
+		store:              &mock.Store{Result: defaultHosts},
+		serviceEntry:       &mock.SEStore{Result: map[string]*icapi.ServiceEntry{defaultHost: existing}},
+		client:             mi,
+	}
+	s.createOrUpdate(defaultHost, []*v1alpha3.ServiceEntry_Endpoint{infer.Endpoint("1.1.1.1", 80)}, provider.HostMeta{})
+	if !mi.UpdateCall || len(mi.store) != 1 || mi.store[existing.Name].Spec.Endpoints[0].Address != "1.1.1.1" {
+		t.Errorf("Update called = %v, ServiceEntries %v, want %q updated", mi.UpdateCall, mi.store, existing.Name)
+	}
+}
+
+func TestSynchronizer_vips(t *testing.T) {
+	allocator, err := vip.NewAllocator("240.240.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	persisted := &icapi.ServiceEntry{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        infer.ServiceEntryName("cloud-map", defaultHost),
+			Annotations: map[string]string{vip.Annotation: "240.240.0.10", infer.HostAnnotation: defaultHost},
+		},
+		Spec: v1alpha3.ServiceEntry{
+			Hosts:      []string{defaultHost},
+			Addresses:  []string{"240.240.0.10"},
+			Resolution: infer.Resolution(defaultEndpoints),
+			Ports:      infer.Ports(defaultEndpoints),
+			Endpoints:  defaultEndpoints,
+		},
+	}
+	ours := map[string]*icapi.ServiceEntry{defaultHost: persisted}
+	mi := &mockIstio{store: make(map[string]*icapi.ServiceEntry)}
+	s := &synchronizer{
+		serviceEntryPrefix: "cloud-map",
+		store:              &mock.Store{Result: map[string][]*v1alpha3.ServiceEntry_Endpoint{"new.tetrate.io": defaultEndpoints}},
+		serviceEntry:       &mock.SEStore{Result: ours},
+		client:             mi,
+		vips:               allocator,
+	}
+
+	// the persisted ServiceEntry keeps its address, and isn't updated
+	s.reserveVIPs()
+	s.createOrUpdate(defaultHost, defaultEndpoints, provider.HostMeta{})
+	if mi.UpdateCall {
+		t.Errorf("ServiceEntry keeping its virtual IP was updated")
+	}
+	if ip, _ := allocator.Allocate(defaultHost); ip != "240.240.0.10" {
+		t.Errorf("%s was allocated %s, want its persisted 240.240.0.10", defaultHost, ip)
+	}
+
+	// new ServiceEntries get addresses of their own
+	s.createOrUpdate("new.tetrate.io", defaultEndpoints, provider.HostMeta{})
+	created := mi.store[infer.ServiceEntryName("cloud-map", "new.tetrate.io")]
+	if created == nil {
+		t.Fatal("ServiceEntry of new.tetrate.io wasn't created")
+	}
+	ip := created.Annotations[vip.Annotation]
+	if !reflect.DeepEqual(created.Spec.Addresses, []string{ip}) || ip == "" || ip == "240.240.0.10" {
+		t.Errorf("new ServiceEntry has addresses %v and annotation %q, want a new virtual IP in both",
+			created.Spec.Addresses, ip)
+	}
+
+	// garbage collected hosts release their addresses
+	s.garbageCollect(s.hosts())
+	if !allocator.Reserve("other.tetrate.io", "240.240.0.10") {
+		t.Errorf("virtual IP of the garbage collected %s wasn't released", defaultHost)
+	}
+}
+
+func TestSynchronizer_vipsOfGeneratedHost(t *testing.T) {
+	allocator, err := vip.NewAllocator("240.240.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a ServiceEntry with another host besides the one it was generated for, as which it's found
+	se := &icapi.ServiceEntry{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        infer.ServiceEntryName("cloud-map", defaultHost),
+			Annotations: map[string]string{vip.Annotation: "240.240.0.10", infer.HostAnnotation: defaultHost},
+		},
+		Spec: v1alpha3.ServiceEntry{Hosts: []string{defaultHost, "alias.tetrate.io"}, Addresses: []string{"240.240.0.10"}},
+	}
+	s := &synchronizer{
+		serviceEntry: &mock.SEStore{Result: map[string]*icapi.ServiceEntry{"alias.tetrate.io": se}},
+		client:       &mockIstio{store: make(map[string]*icapi.ServiceEntry)},
+		vips:         allocator,
+	}
+
+	// the address is held by the host the ServiceEntry was generated for
+	s.reserveVIPs()
+	if ip, _ := allocator.Allocate(defaultHost); ip != "240.240.0.10" {
+		t.Errorf("%s was allocated %s, want its persisted 240.240.0.10", defaultHost, ip)
+	}
+
+	// and released by it
+	s.garbageCollect(map[string][]*v1alpha3.ServiceEntry_Endpoint{})
+	if !allocator.Reserve("other.tetrate.io", "240.240.0.10") {
+		t.Errorf("virtual IP of the garbage collected %s wasn't released", defaultHost)
+	}
+}
+
+func TestSynchronizer_vipsOfFailedServiceEntries(t *testing.T) {
+	allocator, err := vip.NewAllocator("240.240.0.0/30") // room for two
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi := &mockIstio{store: make(map[string]*icapi.ServiceEntry)}
+	s := &synchronizer{
+		serviceEntry: &mock.SEStore{Result: map[string]*icapi.ServiceEntry{}},
+		client:       mi,
+		vips:         allocator,
+		overlays:     overlay.Overlays{{Host: "bad.tetrate.io", Patch: "spec: {hosts: [other.io]}"}},
+	}
+
+	// the virtual IP of a ServiceEntry that failed to be overlaid is released, so others can have it
+	s.createOrUpdate("bad.tetrate.io", defaultEndpoints, provider.HostMeta{})
+	if mi.CreateCall {
+		t.Fatal("ServiceEntry that failed to be overlaid was created")
+	}
+	for _, host := range []string{"a.tetrate.io", "b.tetrate.io"} {
+		if _, err := allocator.Allocate(host); err != nil {
+			t.Errorf("%s wasn't allocated a virtual IP: %v", host, err)
+		}
+	}
+}
+
+func TestSynchronizer_vipsAfterRestart(t *testing.T) {
+	mi := &mockIstio{store: make(map[string]*icapi.ServiceEntry)}
+	// every run of the operator has an owner with a UID of its own, and an allocator that starts out empty
+	run := func(uid types.UID, hosts ...string) {
+		t.Helper()
+		owner := v1.OwnerReference{APIVersion: "cloudmap.istio.io", Kind: "ServiceController", Name: "test", UID: uid}
+		ses := serviceentry.New(owner)
+		for _, se := range mi.store {
+			if err := ses.Insert(se); err != nil {
+				t.Fatal(err)
+			}
+		}
+		allocator, err := vip.NewAllocator("240.240.0.0/30") // room for two
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := make(map[string][]*v1alpha3.ServiceEntry_Endpoint, len(hosts))
+		for _, host := range hosts {
+			result[host] = defaultEndpoints
+		}
+		s := &synchronizer{
+			owner:        owner,
+			store:        &mock.Store{Result: result},
+			serviceEntry: ses,
+			client:       mi,
+			vips:         allocator,
+			mixed:        map[string]bool{},
+		}
+		s.sync()
+	}
+	vips := func() map[string]string {
+		out := make(map[string]string)
+		for _, se := range mi.store {
+			out[infer.Host(se)] = se.Annotations[vip.Annotation]
+		}
+		return out
+	}
+
+	run("first", "a.tetrate.io", "b.tetrate.io")
+	before := vips()
+	if len(before["a.tetrate.io"]) == 0 || len(before["b.tetrate.io"]) == 0 {
+		t.Fatalf("virtual IPs = %v, want one for each host", before)
+	}
+
+	// the addresses of the ServiceEntries the first run created are still taken, so the new host gets none
+	run("second", "a.tetrate.io", "b.tetrate.io", "c.tetrate.io")
+	after := vips()
+	if after["a.tetrate.io"] != before["a.tetrate.io"] || after["b.tetrate.io"] != before["b.tetrate.io"] {
+		t.Errorf("virtual IPs changed from %v to %v after a restart, want them kept", before, after)
+	}
+	if ip := after["c.tetrate.io"]; ip == after["a.tetrate.io"] || ip == after["b.tetrate.io"] {
+		t.Errorf("c.tetrate.io was allocated %q, which is already taken: %v", ip, after)
+	}
+}
+
+func TestSynchronizer_rules(t *testing.T) {
+	rules := infer.ServiceEntryRules{
+		{Match: infer.ServiceEntryMatch{Provider: "cloudmap"}, ExportTo: []string{"*"}},
+		{Match: infer.ServiceEntryMatch{Namespace: "team-*"}, Location: "MESH_INTERNAL", ExportTo: []string{"."}},
+	}
+	meta := provider.HostMeta{Provider: "consul", Namespace: "team-a"}
+	check := func(se *icapi.ServiceEntry) {
+		t.Helper()
+		if se == nil {
+			t.Fatal("ServiceEntry wasn't written")
+		}
+		if se.Spec.Location != v1alpha3.ServiceEntry_MESH_INTERNAL || !reflect.DeepEqual(se.Spec.ExportTo, []string{"."}) {
+			t.Errorf("ServiceEntry has location %v and exportTo %v, want MESH_INTERNAL and [.]",
+				se.Spec.Location, se.Spec.ExportTo)
+		}
+	}
+
+	t.Run("new hosts are matched with their provider metadata", func(t *testing.T) {
+		mi := &mockIstio{store: make(map[string]*icapi.ServiceEntry)}
+		s := &synchronizer{
+			store: &mock.Store{
+				Result:     map[string][]*v1alpha3.ServiceEntry_Endpoint{"new.tetrate.io": defaultEndpoints},
+				MetaResult: map[string]provider.HostMeta{"new.tetrate.io": meta},
+			},
+			serviceEntry: &mock.SEStore{Result: map[string]*icapi.ServiceEntry{}},
+			client:       mi,
+			mixed:        map[string]bool{},
+			rules:        rules,
+		}
+		s.sync()
+		check(mi.store[infer.ServiceEntryName("", "new.tetrate.io")])
+	})
+
+	t.Run("rules changing an otherwise identical ServiceEntry update it", func(t *testing.T) {
+		existing := defaultServiceEntries[defaultHost]
+		mi := &mockIstio{store: map[string]*icapi.ServiceEntry{existing.Name: existing.DeepCopy()}}
+		s := &synchronizer{
+			serviceEntryPrefix: "cloud-map",
+			store:              &mock.Store{Result: defaultHosts},
+			serviceEntry:       &mock.SEStore{Result: defaultServiceEntries},
+			client:             mi,
+			rules:              rules,
+		}
+		s.createOrUpdate(defaultHost, defaultEndpoints, meta)
+		if !mi.UpdateCall {
+			t.Fatal("ServiceEntry whose settings changed wasn't updated")
+		}
+		check(mi.store[existing.Name])
+	})
+}
+
+func TestSynchronizer_overlays(t *testing.T) {
+	meta := provider.HostMeta{Provider: "consul", Service: "web"}
+	overlays := overlay.Overlays{{Host: "*.io", Template: "metadata: {labels: {service: '{{ .Service }}'}}"}}
+	tests := []struct {
+		name       string
+		overlays   overlay.Overlays
+		labels     map[string]string
+		updateCall bool
+	}{
+		{
+			name:       "Updates Service Entry missing the labels of overlays",
+			overlays:   overlays,
+			updateCall: true,
+		},
+		{
+			name:     "Does nothing if Service Entry has the labels of overlays, and others",
+			overlays: overlays,
+			labels:   map[string]string{"service": "web", "added-by": "someone-else"},
+		},
+		{
+			name:     "Does nothing if overlays make Service Entry not ours",
+			overlays: overlay.Overlays{{Host: "*", Patch: "spec: {hosts: [other.io]}"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			existing := defaultServiceEntries[defaultHost].DeepCopy()
+			existing.Labels = tt.labels
+			mi := &mockIstio{store: map[string]*icapi.ServiceEntry{existing.Name: existing}}
+			s := &synchronizer{
+				serviceEntryPrefix: "cloud-map",
+				store:              &mock.Store{Result: defaultHosts},
+				serviceEntry:       &mock.SEStore{Result: map[string]*icapi.ServiceEntry{defaultHost: existing}},
+				client:             mi,
+				overlays:           tt.overlays,
+			}
+			s.createOrUpdate(defaultHost, defaultEndpoints, meta)
+			if mi.UpdateCall != tt.updateCall || mi.CreateCall {
+				t.Fatalf("Update called = %v, Create called = %v, want %v and false", mi.UpdateCall, mi.CreateCall, tt.updateCall)
+			}
+			if tt.updateCall && mi.store[existing.Name].Labels["service"] != "web" {
+				t.Errorf("updated Service Entry has labels %v, want service=web", mi.store[existing.Name].Labels)
+			}
+		})
+	}
+}
+
+func TestSynchronizer_overlaidMetadataChange(t *testing.T) {
+	owner := v1.OwnerReference{APIVersion: "cloudmap.istio.io", Kind: "ServiceController", Name: "test"}
+	ses := serviceentry.New(owner)
+	mi := &mockIstio{store: make(map[string]*icapi.ServiceEntry)}
+	s := &synchronizer{
+		owner:        owner,
+		store:        &mock.Store{Result: defaultHosts},
+		serviceEntry: ses,
+		client:       mi,
+		mixed:        map[string]bool{},
+		overlays:     overlay.Overlays{{Host: "*", Patch: "metadata: {labels: {team: a}}"}},
+	}
+	// the informer passes what's written on to the store
+	informed := make(map[string]*icapi.ServiceEntry)
+	sync := func() {
+		t.Helper()
+		mi.CreateCall, mi.UpdateCall = false, false
+		s.sync()
+		for name, se := range mi.store {
+			var err error
+			if old, ok := informed[name]; ok {
+				err = ses.Update(old, se)
+			} else {
+				err = ses.Insert(se)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			informed[name] = se
+		}
+	}
+
+	sync()
+	if !mi.CreateCall {
+		t.Fatal("ServiceEntry wasn't created")
+	}
+
+	// an overlay changing only labels updates the ServiceEntry once
+	s.overlays = overlay.Overlays{{Host: "*", Patch: "metadata: {labels: {team: b}}"}}
+	sync()
+	if !mi.UpdateCall {
+		t.Fatal("ServiceEntry wasn't updated with the overlay's new labels")
+	}
+	if got := ses.Ours()[defaultHost].Labels["team"]; got != "b" {
+		t.Errorf("stored ServiceEntry has label team=%s, want b", got)
+	}
+	sync()
+	if mi.UpdateCall {
+		t.Error("ServiceEntry with the overlay's labels was updated again")
+	}
+}
+
 type mockIstio struct {
 	ic.ServiceEntryInterface
 
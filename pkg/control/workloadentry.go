@@ -0,0 +1,107 @@
+package control
+
+import (
+	"reflect"
+
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamiclister"
+
+	"github.com/tetratelabs/istio-cloud-map/pkg/infer"
+	"github.com/tetratelabs/istio-cloud-map/pkg/networking"
+	"github.com/tetratelabs/istio-cloud-map/pkg/serviceentry"
+	"github.com/tetratelabs/log"
+)
+
+// WorkloadEntryOptions configures the WorkloadEntries generated in place of the endpoints of ServiceEntries, which
+// select them. They share the namespace and owner of their ServiceEntry, and are created, updated and deleted with it.
+type WorkloadEntryOptions struct {
+	infer.WorkloadEntries
+	// Client writes WorkloadEntries to the namespace ServiceEntries are published to. Its ServiceEntry client must be
+	// one of networking.API's SelectingServiceEntries, for their workload selectors to be written.
+	Client dynamic.ResourceInterface
+	// Lister lists the WorkloadEntries of that namespace
+	Lister dynamiclister.NamespaceLister
+}
+
+// selectWorkloadEntries has the host's ServiceEntry select WorkloadEntries in place of its endpoints, if it can. It
+// returns the selector of the ServiceEntry's WorkloadEntries, which may have selected some before, and those it selects.
+func (s *synchronizer) selectWorkloadEntries(host string, se *ic.ServiceEntry) (string, []*unstructured.Unstructured) {
+	if s.workloadEntries == nil {
+		return "", nil
+	}
+	return infer.WorkloadSelector(se.Name), s.workloadEntries.Select(se, host)
+}
+
+// syncWorkloadEntries creates, updates and deletes the WorkloadEntries the selector selects so they're those wanted
+func (s *synchronizer) syncWorkloadEntries(selector string, want []*unstructured.Unstructured) {
+	if s.workloadEntries == nil {
+		return
+	}
+	selected, err := s.workloadEntries.Lister.List(labels.SelectorFromSet(labels.Set{networking.WorkloadLabel: selector}))
+	if err != nil {
+		log.Errorf("error listing the Workload Entries of %q: %v", selector, err)
+		return
+	}
+	existing := make(map[string]*unstructured.Unstructured, len(selected))
+	for _, we := range selected {
+		existing[we.GetName()] = we
+	}
+	client := s.workloadEntries.Client
+	for _, we := range want {
+		name := we.GetName()
+		old, ok := existing[name]
+		delete(existing, name)
+		switch {
+		case !ok:
+			if _, err := client.Create(we, v1.CreateOptions{}); err != nil {
+				log.Errorf("error creating Workload Entry %q: %v", name, err)
+				continue
+			}
+			log.Infof("created Workload Entry %q", name)
+		case !s.ownsWorkloadEntry(old):
+		case reflect.DeepEqual(old.Object["spec"], we.Object["spec"]) &&
+			subset(we.GetLabels(), old.GetLabels()) && subset(we.GetAnnotations(), old.GetAnnotations()):
+		default:
+			we.SetResourceVersion(old.GetResourceVersion())
+			if _, err := client.Update(we, v1.UpdateOptions{}); err != nil {
+				log.Errorf("error updating Workload Entry %q: %v", name, err)
+				continue
+			}
+			log.Infof("updated Workload Entry %q", name)
+		}
+	}
+	for name, old := range existing {
+		if !s.ownsWorkloadEntry(old) {
+			continue
+		}
+		if err := client.Delete(name, &v1.DeleteOptions{}); err != nil && !kerrors.IsNotFound(err) {
+			log.Errorf("error deleting Workload Entry %q: %v", name, err)
+			continue
+		}
+		log.Infof("deleted Workload Entry %q", name)
+	}
+}
+
+// deleteWorkloadEntries deletes the WorkloadEntries of ours the ServiceEntry selects, if it selects any
+func (s *synchronizer) deleteWorkloadEntries(se *ic.ServiceEntry) {
+	if selector, ok := se.Annotations[networking.WorkloadSelectorAnnotation]; ok {
+		s.syncWorkloadEntries(selector, nil)
+	}
+}
+
+// ownsWorkloadEntry reports whether the WorkloadEntry is ours to change. Those of previous runs of the operator are
+// ours too.
+func (s *synchronizer) ownsWorkloadEntry(we *unstructured.Unstructured) bool {
+	for _, ref := range we.GetOwnerReferences() {
+		if serviceentry.SameOwner(ref, s.owner) {
+			return true
+		}
+	}
+	log.Debugf("Workload Entry %q was created by someone else, leaving it be", we.GetName())
+	return false
+}
@@ -0,0 +1,149 @@
+package control
+
+import (
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+	icapi "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamiclister"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/tetratelabs/istio-cloud-map/pkg/control/mock"
+	"github.com/tetratelabs/istio-cloud-map/pkg/infer"
+	"github.com/tetratelabs/istio-cloud-map/pkg/networking"
+	"github.com/tetratelabs/istio-cloud-map/pkg/provider"
+)
+
+func TestSynchronizer_workloadEntries(t *testing.T) {
+	owner := v1.OwnerReference{APIVersion: "cloudmap.istio.io", Kind: "ServiceController", Name: "test"}
+	wes := &mockWorkloadEntries{indexer: cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})}
+	web, api := infer.Endpoint("1.1.1.1", 80), infer.Endpoint("2.2.2.2", 80)
+	web.Locality = "us-east-1/us-east-1a"
+	mi := &mockIstio{store: make(map[string]*icapi.ServiceEntry)}
+	s := &synchronizer{
+		owner:        owner,
+		serviceEntry: &mock.SEStore{Result: map[string]*icapi.ServiceEntry{}},
+		client:       mi,
+		mixed:        map[string]bool{},
+		workloadEntries: &WorkloadEntryOptions{
+			Client: wes,
+			Lister: dynamiclister.New(wes.indexer, networking.WorkloadEntries).Namespace("default"),
+		},
+	}
+	name := infer.ServiceEntryName("", "web.tetrate.io")
+	selector := infer.WorkloadSelector(name)
+	selected := func() map[string]*unstructured.Unstructured {
+		list, err := s.workloadEntries.Lister.List(labels.SelectorFromSet(labels.Set{networking.WorkloadLabel: selector}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := make(map[string]*unstructured.Unstructured, len(list))
+		for _, we := range list {
+			out[we.GetName()] = we
+		}
+		return out
+	}
+	sync := func(endpoints ...*v1alpha3.ServiceEntry_Endpoint) {
+		s.createOrUpdate("web.tetrate.io", endpoints, provider.HostMeta{})
+		s.serviceEntry = &mock.SEStore{Result: map[string]*icapi.ServiceEntry{"web.tetrate.io": mi.store[name]}}
+	}
+
+	// created with the ServiceEntry, which selects them in place of its endpoints
+	sync(web, api)
+	se := mi.store[name]
+	if se == nil || se.Annotations[networking.WorkloadSelectorAnnotation] != selector || len(se.Spec.Endpoints) > 0 ||
+		se.Spec.Location != v1alpha3.ServiceEntry_MESH_INTERNAL {
+		t.Fatalf("ServiceEntry = %v, want a mesh-internal one selecting %q without endpoints", se, selector)
+	}
+	got := selected()
+	if len(got) != 2 || got[infer.WorkloadEntryName(name, web)] == nil || got[infer.WorkloadEntryName(name, api)] == nil {
+		t.Fatalf("WorkloadEntries = %v, want one per endpoint", got)
+	}
+	if wes.writes != 2 {
+		t.Errorf("WorkloadEntries written %d times, want twice", wes.writes)
+	}
+
+	// left alone while they're up to date
+	sync(web, api)
+	if wes.writes != 2 {
+		t.Errorf("up to date WorkloadEntries written %d times, want twice", wes.writes)
+	}
+
+	// updated when their instance changes, and deleted when it's gone
+	moved := infer.Endpoint("1.1.1.1", 80)
+	moved.Locality = "us-east-1/us-east-1b"
+	sync(moved)
+	got = selected()
+	we := got[infer.WorkloadEntryName(name, web)]
+	if len(got) != 1 || we == nil {
+		t.Fatalf("WorkloadEntries = %v, want only the remaining instance's", got)
+	}
+	if locality, _, _ := unstructured.NestedString(we.Object, "spec", "locality"); locality != moved.Locality {
+		t.Errorf("WorkloadEntry locality = %q, want it updated to %q", locality, moved.Locality)
+	}
+
+	// deleted when the endpoints can't be selected anymore
+	sync(web, infer.Endpoint("web.tetrate.io", 80))
+	if se := mi.store[name]; len(se.Spec.Endpoints) != 2 || se.Annotations[networking.WorkloadSelectorAnnotation] != "" {
+		t.Errorf("ServiceEntry = %v, want its endpoints inline again", se)
+	}
+	if got := selected(); len(got) != 0 {
+		t.Errorf("WorkloadEntries = %v, want them deleted", got)
+	}
+
+	// garbage collected with the ServiceEntry
+	sync(web)
+	s.garbageCollect(map[string][]*v1alpha3.ServiceEntry_Endpoint{})
+	if got := selected(); len(got) != 0 {
+		t.Errorf("WorkloadEntries = %v, want them garbage collected", got)
+	}
+
+	// someone else's are left alone
+	theirs := &unstructured.Unstructured{}
+	theirs.SetName(infer.WorkloadEntryName(name, web))
+	theirs.SetNamespace("default")
+	theirs.SetLabels(map[string]string{networking.WorkloadLabel: selector})
+	_ = wes.indexer.Add(theirs)
+	wes.writes = 0
+	sync(web)
+	s.garbageCollect(map[string][]*v1alpha3.ServiceEntry_Endpoint{})
+	if got := selected(); len(got) != 1 || got[theirs.GetName()] != theirs || wes.writes != 0 {
+		t.Errorf("WorkloadEntries = %v after %d writes, want someone else's left alone", got, wes.writes)
+	}
+}
+
+// mockWorkloadEntries writes WorkloadEntries to the indexer its lister reads, in the default namespace
+type mockWorkloadEntries struct {
+	dynamic.ResourceInterface
+
+	indexer cache.Indexer
+	writes  int
+}
+
+func (m *mockWorkloadEntries) Create(we *unstructured.Unstructured, _ v1.CreateOptions, _ ...string) (*unstructured.Unstructured, error) {
+	m.writes++
+	we = we.DeepCopy()
+	we.SetNamespace("default")
+	return we, m.indexer.Add(we)
+}
+
+func (m *mockWorkloadEntries) Update(we *unstructured.Unstructured, _ v1.UpdateOptions, _ ...string) (*unstructured.Unstructured, error) {
+	m.writes++
+	we = we.DeepCopy()
+	we.SetNamespace("default")
+	return we, m.indexer.Update(we)
+}
+
+func (m *mockWorkloadEntries) Delete(name string, _ *v1.DeleteOptions, _ ...string) error {
+	m.writes++
+	obj, ok, _ := m.indexer.GetByKey("default/" + name)
+	if !ok {
+		return kerrors.NewNotFound(networking.WorkloadEntries.GroupResource(), name)
+	}
+	return m.indexer.Delete(obj)
+}
@@ -0,0 +1,175 @@
+package export
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	iclisters "istio.io/client-go/pkg/listers/networking/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/tetratelabs/log"
+)
+
+type (
+	// Instance is a single address and port to register with a registry outside of the mesh
+	Instance struct {
+		Address string
+		Port    uint32
+	}
+
+	// Source describes the services running in the mesh that should be visible outside of it,
+	// keyed by the service name they should be registered under.
+	Source interface {
+		Instances() map[string][]Instance
+		// HasSynced reports whether the listers behind the source have been filled, so that services missing from
+		// Instances really have gone away
+		HasSynced() bool
+	}
+
+	services struct {
+		services  corelisters.ServiceLister
+		endpoints corelisters.EndpointsLister
+		selector  labels.Selector
+		synced    []cache.InformerSynced
+	}
+
+	serviceEntries struct {
+		serviceEntries iclisters.ServiceEntryLister
+		selector       labels.Selector
+		owner          v1.OwnerReference
+		synced         []cache.InformerSynced
+	}
+)
+
+// NewServiceSource returns a Source exporting the ready endpoints of the Kubernetes Services matching the selector,
+// each registered as "<name>.<namespace>". It has synced once every one of the synced functions of the informers
+// behind the listers says so.
+func NewServiceSource(svcs corelisters.ServiceLister, eps corelisters.EndpointsLister, selector labels.Selector,
+	synced ...cache.InformerSynced) Source {
+	return &services{services: svcs, endpoints: eps, selector: selector, synced: synced}
+}
+
+// NewServiceEntrySource returns a Source exporting the endpoints of the ServiceEntries matching the selector,
+// registered once for each of their hosts. ServiceEntries created by owner are never exported, so that we
+// don't re-export what we imported. It has synced once every one of the synced functions says so.
+func NewServiceEntrySource(ses iclisters.ServiceEntryLister, selector labels.Selector, owner v1.OwnerReference,
+	synced ...cache.InformerSynced) Source {
+	return &serviceEntries{serviceEntries: ses, selector: selector, owner: owner, synced: synced}
+}
+
+func (s *services) HasSynced() bool {
+	return hasSynced(s.synced)
+}
+
+func (s *serviceEntries) HasSynced() bool {
+	return hasSynced(s.synced)
+}
+
+func hasSynced(synced []cache.InformerSynced) bool {
+	for _, f := range synced {
+		if !f() {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *services) Instances() map[string][]Instance {
+	out := make(map[string][]Instance)
+	svcs, err := s.services.List(s.selector)
+	if err != nil {
+		log.Errorf("error listing Services to export: %v", err)
+		return out
+	}
+	for _, svc := range svcs {
+		eps, err := s.endpoints.Endpoints(svc.Namespace).Get(svc.Name)
+		if err != nil {
+			log.Infof("no endpoints found for Service %s/%s: %v", svc.Namespace, svc.Name, err)
+			continue
+		}
+		if instances := endpointsToInstances(eps); len(instances) > 0 {
+			out[fmt.Sprintf("%s.%s", svc.Name, svc.Namespace)] = instances
+		}
+	}
+	return out
+}
+
+func endpointsToInstances(eps *corev1.Endpoints) []Instance {
+	var out []Instance
+	for _, subset := range eps.Subsets {
+		for _, addr := range subset.Addresses { // only ready addresses
+			for _, port := range subset.Ports {
+				out = append(out, Instance{Address: addr.IP, Port: uint32(port.Port)})
+			}
+		}
+	}
+	sortInstances(out)
+	return out
+}
+
+func (s *serviceEntries) Instances() map[string][]Instance {
+	out := make(map[string][]Instance)
+	ses, err := s.serviceEntries.List(s.selector)
+	if err != nil {
+		log.Errorf("error listing ServiceEntries to export: %v", err)
+		return out
+	}
+	for _, se := range ses {
+		if ownedBy(se, s.owner) {
+			continue
+		}
+		instances := serviceEntryToInstances(se)
+		if len(instances) == 0 {
+			continue
+		}
+		for _, host := range se.Spec.Hosts {
+			out[host] = instances
+		}
+	}
+	return out
+}
+
+// serviceEntryToInstances returns an instance per port for every IP endpoint of the ServiceEntry.
+// Endpoints can remap the ServiceEntry's port numbers by port name.
+func serviceEntryToInstances(se *ic.ServiceEntry) []Instance {
+	var out []Instance
+	for _, ep := range se.Spec.Endpoints {
+		if net.ParseIP(ep.Address) == nil {
+			log.Infof("skipping endpoint %q of ServiceEntry %s/%s, only IP addresses can be exported", ep.Address, se.Namespace, se.Name)
+			continue
+		}
+		for _, port := range se.Spec.Ports {
+			number := port.Number
+			if n, ok := ep.Ports[port.Name]; ok {
+				number = n
+			}
+			out = append(out, Instance{Address: ep.Address, Port: number})
+		}
+	}
+	sortInstances(out)
+	return out
+}
+
+func ownedBy(se *ic.ServiceEntry, owner v1.OwnerReference) bool {
+	for _, ref := range se.OwnerReferences {
+		if ref.UID == owner.UID || (ref.APIVersion == owner.APIVersion && ref.Kind == owner.Kind && ref.Name == owner.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortInstances(instances []Instance) {
+	sort.Slice(instances, func(i, j int) bool {
+		if instances[i].Address != instances[j].Address {
+			return instances[i].Address < instances[j].Address
+		}
+		return instances[i].Port < instances[j].Port
+	})
+}
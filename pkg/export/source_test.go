@@ -0,0 +1,121 @@
+package export
+
+import (
+	"reflect"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	iclisters "istio.io/client-go/pkg/listers/networking/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	exported = map[string]string{"export": "true"}
+	owner    = v1.OwnerReference{APIVersion: "cloudmap.istio.io", Kind: "ServiceController", Name: "us", UID: "1"}
+)
+
+func indexer(objs ...interface{}) cache.Indexer {
+	idx := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, o := range objs {
+		if err := idx.Add(o); err != nil {
+			panic(err)
+		}
+	}
+	return idx
+}
+
+func TestServiceSource(t *testing.T) {
+	web := &corev1.Service{ObjectMeta: v1.ObjectMeta{Name: "web", Namespace: "default", Labels: exported}}
+	hidden := &corev1.Service{ObjectMeta: v1.ObjectMeta{Name: "hidden", Namespace: "default"}}
+	noEndpoints := &corev1.Service{ObjectMeta: v1.ObjectMeta{Name: "empty", Namespace: "default", Labels: exported}}
+	webEndpoints := &corev1.Endpoints{
+		ObjectMeta: v1.ObjectMeta{Name: "web", Namespace: "default"},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses:         []corev1.EndpointAddress{{IP: "10.0.0.2"}, {IP: "10.0.0.1"}},
+			NotReadyAddresses: []corev1.EndpointAddress{{IP: "10.0.0.3"}},
+			Ports:             []corev1.EndpointPort{{Port: 8080}, {Port: 9090}},
+		}},
+	}
+	hiddenEndpoints := &corev1.Endpoints{
+		ObjectMeta: v1.ObjectMeta{Name: "hidden", Namespace: "default"},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{{IP: "10.0.0.4"}},
+			Ports:     []corev1.EndpointPort{{Port: 80}},
+		}},
+	}
+
+	src := NewServiceSource(
+		corelisters.NewServiceLister(indexer(web, hidden, noEndpoints)),
+		corelisters.NewEndpointsLister(indexer(webEndpoints, hiddenEndpoints)),
+		labels.SelectorFromSet(exported),
+	)
+	want := map[string][]Instance{
+		"web.default": {
+			{Address: "10.0.0.1", Port: 8080}, {Address: "10.0.0.1", Port: 9090},
+			{Address: "10.0.0.2", Port: 8080}, {Address: "10.0.0.2", Port: 9090},
+		},
+	}
+	if got := src.Instances(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Instances() = %v, want %v", got, want)
+	}
+	if !src.HasSynced() {
+		t.Error("HasSynced() = false without informers to wait for, want true")
+	}
+
+	synced := map[string]bool{"services": true}
+	src = NewServiceSource(corelisters.NewServiceLister(indexer()), corelisters.NewEndpointsLister(indexer()),
+		labels.Everything(), func() bool { return synced["services"] }, func() bool { return synced["endpoints"] })
+	if src.HasSynced() {
+		t.Error("HasSynced() = true before the endpoints informer synced, want false")
+	}
+	synced["endpoints"] = true
+	if !src.HasSynced() {
+		t.Error("HasSynced() = false once every informer synced, want true")
+	}
+}
+
+func TestServiceEntrySource(t *testing.T) {
+	theirs := &ic.ServiceEntry{
+		ObjectMeta: v1.ObjectMeta{Name: "theirs", Namespace: "default", Labels: exported},
+		Spec: v1alpha3.ServiceEntry{
+			Hosts: []string{"a.example.com", "b.example.com"},
+			Ports: []*v1alpha3.Port{{Name: "http", Number: 80}, {Name: "grpc", Number: 9090}},
+			Endpoints: []*v1alpha3.ServiceEntry_Endpoint{
+				{Address: "10.0.0.1", Ports: map[string]uint32{"http": 8080}},
+				{Address: "vm.example.com"},
+			},
+		},
+	}
+	ours := &ic.ServiceEntry{
+		ObjectMeta: v1.ObjectMeta{Name: "ours", Namespace: "default", Labels: exported, OwnerReferences: []v1.OwnerReference{owner}},
+		Spec: v1alpha3.ServiceEntry{
+			Hosts:     []string{"ours.example.com"},
+			Ports:     []*v1alpha3.Port{{Name: "http", Number: 80}},
+			Endpoints: []*v1alpha3.ServiceEntry_Endpoint{{Address: "10.0.0.2"}},
+		},
+	}
+	unlabelled := &ic.ServiceEntry{
+		ObjectMeta: v1.ObjectMeta{Name: "unlabelled", Namespace: "default"},
+		Spec: v1alpha3.ServiceEntry{
+			Hosts:     []string{"unlabelled.example.com"},
+			Ports:     []*v1alpha3.Port{{Name: "http", Number: 80}},
+			Endpoints: []*v1alpha3.ServiceEntry_Endpoint{{Address: "10.0.0.3"}},
+		},
+	}
+
+	// a previous run of the operator has the same name, but a different UID
+	restarted := owner
+	restarted.UID = "2"
+	src := NewServiceEntrySource(iclisters.NewServiceEntryLister(indexer(theirs, ours, unlabelled)),
+		labels.SelectorFromSet(exported), restarted)
+	instances := []Instance{{Address: "10.0.0.1", Port: 8080}, {Address: "10.0.0.1", Port: 9090}}
+	want := map[string][]Instance{"a.example.com": instances, "b.example.com": instances}
+	if got := src.Instances(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Instances() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,108 @@
+package infer
+
+import (
+	"io/ioutil"
+	"path"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/tetratelabs/istio-cloud-map/pkg/provider"
+)
+
+// DefaultTLSAttribute is the service attribute that, when "true", has DestinationRules originate TLS
+const DefaultTLSAttribute = "tls"
+
+// DestinationRulePolicy is the traffic policy of the DestinationRules of the hosts it matches
+type DestinationRulePolicy struct {
+	Match         ServiceEntryMatch       `json:"match"`
+	TrafficPolicy *v1alpha3.TrafficPolicy `json:"trafficPolicy"`
+}
+
+// DestinationRules decides which hosts get a DestinationRule alongside their ServiceEntry, and its traffic policy
+type DestinationRules struct {
+	// TLSAttribute is the service attribute that, when "true", has the host's DestinationRule originate TLS, unless
+	// its policy sets TLS settings of its own. Defaults to DefaultTLSAttribute.
+	TLSAttribute string `json:"tlsAttribute,omitempty"`
+	// Policies are tried in order; only the first policy matching a host applies. Hosts neither policies nor the
+	// TLS attribute apply to get no DestinationRule.
+	Policies []DestinationRulePolicy `json:"policies,omitempty"`
+}
+
+// LoadDestinationRules reads DestinationRules from a YAML or JSON file
+func LoadDestinationRules(file string) (*DestinationRules, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read destination rule policies %q", file)
+	}
+	d := &DestinationRules{}
+	if err := yaml.UnmarshalStrict(data, d); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse destination rule policies %q", file)
+	}
+	if err := d.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid destination rule policies %q", file)
+	}
+	return d, nil
+}
+
+// Validate returns an error describing the first malformed policy
+func (d *DestinationRules) Validate() error {
+	for i, p := range d.Policies {
+		for _, pattern := range []string{p.Match.Provider, p.Match.Namespace, p.Match.Host} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Wrapf(err, "policy %d: invalid pattern %q", i, pattern)
+			}
+		}
+		if p.TrafficPolicy == nil {
+			return errors.Errorf("policy %d: has no traffic policy", i)
+		}
+	}
+	return nil
+}
+
+// DestinationRule returns the DestinationRule of the host, named and owned like its ServiceEntry, or nil if it
+// shouldn't have one
+func (d *DestinationRules) DestinationRule(se *ic.ServiceEntry, host string, meta provider.HostMeta) *ic.DestinationRule {
+	var policy *v1alpha3.TrafficPolicy
+	for _, p := range d.Policies {
+		if p.Match.matches(host, meta) {
+			policy = proto.Clone(p.TrafficPolicy).(*v1alpha3.TrafficPolicy)
+			break
+		}
+	}
+	if meta.Attributes[d.tlsAttribute()] == "true" {
+		if policy == nil {
+			policy = &v1alpha3.TrafficPolicy{}
+		}
+		if policy.Tls == nil {
+			policy.Tls = &v1alpha3.TLSSettings{Mode: v1alpha3.TLSSettings_SIMPLE, Sni: host}
+		}
+	}
+	if policy == nil {
+		return nil
+	}
+	return &ic.DestinationRule{
+		ObjectMeta: v1.ObjectMeta{
+			Name:            se.Name,
+			Namespace:       se.Namespace,
+			Annotations:     map[string]string{HostAnnotation: host},
+			OwnerReferences: se.OwnerReferences,
+		},
+		Spec: v1alpha3.DestinationRule{
+			Host:          host,
+			TrafficPolicy: policy,
+			ExportTo:      se.Spec.ExportTo,
+		},
+	}
+}
+
+func (d *DestinationRules) tlsAttribute() string {
+	if len(d.TLSAttribute) == 0 {
+		return DefaultTLSAttribute
+	}
+	return d.TLSAttribute
+}
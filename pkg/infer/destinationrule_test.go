@@ -0,0 +1,156 @@
+package infer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"istio.io/api/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/tetratelabs/istio-cloud-map/pkg/provider"
+)
+
+func TestDestinationRules_DestinationRule(t *testing.T) {
+	limits := &v1alpha3.TrafficPolicy{
+		ConnectionPool: &v1alpha3.ConnectionPoolSettings{Tcp: &v1alpha3.ConnectionPoolSettings_TCPSettings{MaxConnections: 100}},
+	}
+	mtls := &v1alpha3.TrafficPolicy{Tls: &v1alpha3.TLSSettings{Mode: v1alpha3.TLSSettings_MUTUAL}}
+	d := &DestinationRules{Policies: []DestinationRulePolicy{
+		{Match: ServiceEntryMatch{Host: "*.partner.com"}, TrafficPolicy: mtls},
+		{Match: ServiceEntryMatch{Provider: "consul"}, TrafficPolicy: limits},
+	}}
+	tls := map[string]string{"tls": "true"}
+
+	tests := []struct {
+		name string
+		host string
+		meta provider.HostMeta
+		want *v1alpha3.TrafficPolicy
+	}{
+		{
+			name: "no policy",
+			host: "web.tetrate.io",
+			meta: provider.HostMeta{Provider: "cloudmap"},
+		},
+		{
+			name: "policy",
+			host: "web.tetrate.io",
+			meta: provider.HostMeta{Provider: "consul"},
+			want: limits,
+		},
+		{
+			name: "tls attribute",
+			host: "web.tetrate.io",
+			meta: provider.HostMeta{Provider: "cloudmap", Attributes: tls},
+			want: &v1alpha3.TrafficPolicy{Tls: &v1alpha3.TLSSettings{Mode: v1alpha3.TLSSettings_SIMPLE, Sni: "web.tetrate.io"}},
+		},
+		{
+			name: "tls attribute and policy",
+			host: "web.tetrate.io",
+			meta: provider.HostMeta{Provider: "consul", Attributes: tls},
+			want: &v1alpha3.TrafficPolicy{
+				ConnectionPool: limits.ConnectionPool,
+				Tls:            &v1alpha3.TLSSettings{Mode: v1alpha3.TLSSettings_SIMPLE, Sni: "web.tetrate.io"},
+			},
+		},
+		{
+			name: "policy with its own tls settings",
+			host: "api.partner.com",
+			meta: provider.HostMeta{Provider: "consul", Attributes: tls},
+			want: mtls,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			se := ServiceEntry(v1.OwnerReference{Name: "test"}, "consul-", tt.host, nil)
+			se.Spec.ExportTo = []string{"."}
+			got := d.DestinationRule(se, tt.host, tt.meta)
+			if tt.want == nil {
+				if got != nil {
+					t.Errorf("DestinationRule() = %v, want none", got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatalf("DestinationRule() = nil, want one with traffic policy %v", tt.want)
+			}
+			if !proto.Equal(got.Spec.TrafficPolicy, tt.want) {
+				t.Errorf("DestinationRule() traffic policy = %v, want %v", got.Spec.TrafficPolicy, tt.want)
+			}
+			if got.Name != se.Name || got.Spec.Host != tt.host || got.Spec.ExportTo[0] != "." ||
+				got.OwnerReferences[0].Name != "test" || Host(se) != tt.host {
+				t.Errorf("DestinationRule() = %v, want it named, owned and exported like ServiceEntry %v", got, se)
+			}
+		})
+	}
+
+	// policies are copied, not shared
+	se := ServiceEntry(v1.OwnerReference{}, "", "web.tetrate.io", nil)
+	d.DestinationRule(se, "web.tetrate.io", provider.HostMeta{Provider: "consul", Attributes: tls})
+	if limits.Tls != nil {
+		t.Errorf("DestinationRule() changed the policy to %v", limits)
+	}
+}
+
+func TestLoadDestinationRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "destinationrules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		want    *DestinationRules
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			content: `
+tlsAttribute: secure
+policies:
+- match:
+    host: "*"
+  trafficPolicy:
+    outlierDetection:
+      consecutiveErrors: 5
+`,
+			want: &DestinationRules{
+				TLSAttribute: "secure",
+				Policies: []DestinationRulePolicy{{
+					Match: ServiceEntryMatch{Host: "*"},
+					TrafficPolicy: &v1alpha3.TrafficPolicy{
+						OutlierDetection: &v1alpha3.OutlierDetection{ConsecutiveErrors: 5},
+					},
+				}},
+			},
+		},
+		{name: "no traffic policy", content: "policies: [{match: {host: '*'}}]", wantErr: true},
+		{name: "invalid traffic policy", content: "policies: [{match: {}, trafficPolicy: {retries: 3}}]", wantErr: true},
+		{name: "invalid pattern", content: "policies: [{match: {host: '['}, trafficPolicy: {}}]", wantErr: true},
+		{name: "unknown field", content: "tls: secure", wantErr: true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, string(rune('a'+i)))
+			if err := ioutil.WriteFile(file, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadDestinationRules(file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadDestinationRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.TLSAttribute != tt.want.TLSAttribute || len(got.Policies) != len(tt.want.Policies) ||
+				!proto.Equal(got.Policies[0].TrafficPolicy, tt.want.Policies[0].TrafficPolicy) {
+				t.Errorf("LoadDestinationRules() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
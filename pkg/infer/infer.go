@@ -3,6 +3,8 @@ package infer
 import (
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
 
 	"istio.io/api/networking/v1alpha3"
@@ -19,10 +21,13 @@ func ServiceEntry(owner v1.OwnerReference, prefix, host string, endpoints []*v1a
 		}
 	}
 
+	ports := Ports(endpoints)
+	applyHostRules(host, ports)
 	return &ic.ServiceEntry{
 		TypeMeta: v1.TypeMeta{},
 		ObjectMeta: v1.ObjectMeta{
 			Name:            ServiceEntryName(prefix, host),
+			Annotations:     map[string]string{HostAnnotation: host},
 			OwnerReferences: []v1.OwnerReference{owner},
 		},
 		Spec: v1alpha3.ServiceEntry{
@@ -31,8 +36,8 @@ func ServiceEntry(owner v1.OwnerReference, prefix, host string, endpoints []*v1a
 			// assume external for now
 			Location:   v1alpha3.ServiceEntry_MESH_EXTERNAL,
 			Resolution: Resolution(endpoints),
-			Ports:      Ports(endpoints),
-			Endpoints:  endpoints,
+			Ports:      ports,
+			Endpoints:  namePorts(endpoints, ports),
 		},
 	}
 }
@@ -40,44 +45,124 @@ func ServiceEntry(owner v1.OwnerReference, prefix, host string, endpoints []*v1a
 // Endpoint creates a Service Entry endpoint from an address and port
 // It infers the port name from the port number
 func Endpoint(address string, port uint32) *v1alpha3.ServiceEntry_Endpoint {
+	return EndpointWithPorts(address, port)
+}
+
+// EndpointWithPorts creates a Service Entry endpoint from an address and its ports
+// It infers the port names from the port numbers
+func EndpointWithPorts(address string, ports ...uint32) *v1alpha3.ServiceEntry_Endpoint {
+	ep := &v1alpha3.ServiceEntry_Endpoint{Address: address, Ports: make(map[string]uint32, len(ports))}
+	for _, port := range ports {
+		ep.Ports[PortName(Proto(port), port)] = port
+	}
+	return ep
+}
+
+// EndpointWithProtocol creates a Service Entry endpoint from an address and port serving the given protocol
+// It names the port after the protocol if Istio understands it, otherwise it infers the name from the port number
+func EndpointWithProtocol(address string, port uint32, protocol string) *v1alpha3.ServiceEntry_Endpoint {
+	protocol = strings.ToLower(protocol)
+	if !protocols[protocol] {
+		return Endpoint(address, port)
+	}
 	return &v1alpha3.ServiceEntry_Endpoint{
 		Address: address,
-		Ports:   map[string]uint32{Proto(port): port},
+		Ports:   map[string]uint32{PortName(protocol, port): port},
+	}
+}
+
+// protocols Istio understands, by the names of the ports serving them
+var protocols = map[string]bool{
+	"http": true, "http2": true, "https": true, "grpc": true, "grpc-web": true, "mongo": true, "mysql": true,
+	"redis": true, "tcp": true, "tls": true, "udp": true,
+}
+
+// Protocol returns the protocol of a port named after it, following Istio's <protocol>[-<suffix>] convention
+// If the name doesn't start with a protocol Istio understands, it infers the protocol from the port number
+func Protocol(name string, port uint32) string {
+	name = strings.ToLower(name)
+	match := ""
+	for p := range protocols {
+		if (name == p || strings.HasPrefix(name, p+"-")) && len(p) > len(match) {
+			match = p
+		}
+	}
+	if match == "" {
+		return Proto(port)
 	}
+	return match
 }
 
 // Proto infers the port name based on the port number
+// The rules of the protocol table are tried first, then DefaultProtocolRules; ports matching none are TCP
 func Proto(port uint32) string {
-	switch port {
-	case 80:
-		return "http"
-	case 443:
-		return "https"
-	default:
+	proto, rule, ok := protocol(port, protocolTable().Rules, DefaultProtocolRules)
+	key := strconv.Itoa(int(port))
+	if !ok {
+		logDecision(key, "port %d matches no protocol rule, assuming TCP", port)
 		return "tcp"
 	}
+	logDecision(key, "port %d is %s by rule %v", port, strings.ToUpper(proto), rule)
+	return proto
 }
 
-// Ports uses a slice of Service Entry endpoints to create a de-duped slice of Istio Ports
-// Infering name and protocol from the port number
+// PortName names a port after the protocol it serves and its number, e.g. http-8080, so that every port of a
+// Service Entry has a unique name following Istio's <protocol>[-<suffix>] convention
+func PortName(protocol string, port uint32) string {
+	return fmt.Sprintf("%s-%d", strings.ToLower(protocol), port)
+}
+
+// Ports uses a slice of Service Entry endpoints to create a de-duped slice of Istio Ports sorted by number
+// Infering name and protocol from the endpoints' port names, or the port number
+// If endpoints disagree on the protocol of a port, the first endpoint naming it wins
 func Ports(endpoints []*v1alpha3.ServiceEntry_Endpoint) []*v1alpha3.Port {
 	dedup := map[uint32]*v1alpha3.Port{}
 	for _, ep := range endpoints {
-		for _, port := range ep.Ports {
+		names := make([]string, 0, len(ep.Ports))
+		for name := range ep.Ports {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			port := ep.Ports[name]
+			if _, ok := dedup[port]; ok {
+				continue
+			}
+			proto := Protocol(name, port)
 			dedup[port] = &v1alpha3.Port{
-				Name:     Proto(port),
-				Number:   uint32(port),
-				Protocol: strings.ToUpper(Proto(port)),
+				Name:     PortName(proto, port),
+				Number:   port,
+				Protocol: strings.ToUpper(proto),
 			}
 		}
 	}
-	res := []*v1alpha3.Port{}
+	res := make([]*v1alpha3.Port, 0, len(dedup))
 	for _, port := range dedup {
 		res = append(res, port)
 	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Number < res[j].Number })
 	return res
 }
 
+// namePorts returns copies of the endpoints whose ports are named like the Service Entry's ports of the same number,
+// as Istio matches them by name
+func namePorts(endpoints []*v1alpha3.ServiceEntry_Endpoint, ports []*v1alpha3.Port) []*v1alpha3.ServiceEntry_Endpoint {
+	names := make(map[uint32]string, len(ports))
+	for _, p := range ports {
+		names[p.Number] = p.Name
+	}
+	out := make([]*v1alpha3.ServiceEntry_Endpoint, 0, len(endpoints))
+	for _, ep := range endpoints {
+		named := *ep
+		named.Ports = make(map[string]uint32, len(ep.Ports))
+		for _, port := range ep.Ports {
+			named.Ports[names[port]] = port
+		}
+		out = append(out, &named)
+	}
+	return out
+}
+
 // Resolution infers STATIC resolution if there are endpoints
 // If there are no endpoints it infers DNS; otherwise will return STATIC
 func Resolution(endpoints []*v1alpha3.ServiceEntry_Endpoint) v1alpha3.ServiceEntry_Resolution {
@@ -91,8 +176,3 @@ func Resolution(endpoints []*v1alpha3.ServiceEntry_Endpoint) v1alpha3.ServiceEnt
 	}
 	return v1alpha3.ServiceEntry_STATIC
 }
-
-// ServiceEntryName returns the service entry name based on the specificed host
-func ServiceEntryName(prefix, host string) string {
-	return fmt.Sprintf("%s%s", prefix, host)
-}
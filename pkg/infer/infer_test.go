@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"istio.io/api/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 var ipEndpoint = &v1alpha3.ServiceEntry_Endpoint{Address: "8.8.8.8"}
@@ -60,8 +61,8 @@ func TestPorts(t *testing.T) {
 				&v1alpha3.ServiceEntry_Endpoint{Address: "8.8.8.8", Ports: map[string]uint32{"https": 443}},
 			},
 			want: []*v1alpha3.Port{
-				&v1alpha3.Port{Number: 80, Name: "http", Protocol: "HTTP"},
-				&v1alpha3.Port{Number: 443, Name: "https", Protocol: "HTTPS"},
+				&v1alpha3.Port{Number: 80, Name: "http-80", Protocol: "HTTP"},
+				&v1alpha3.Port{Number: 443, Name: "https-443", Protocol: "HTTPS"},
 			},
 		},
 		{
@@ -70,7 +71,34 @@ func TestPorts(t *testing.T) {
 				&v1alpha3.ServiceEntry_Endpoint{Address: "1.1.1.1", Ports: map[string]uint32{"http": 80}},
 				&v1alpha3.ServiceEntry_Endpoint{Address: "8.8.8.8", Ports: map[string]uint32{"http": 80}},
 			},
-			want: []*v1alpha3.Port{&v1alpha3.Port{Number: 80, Name: "http", Protocol: "HTTP"}},
+			want: []*v1alpha3.Port{&v1alpha3.Port{Number: 80, Name: "http-80", Protocol: "HTTP"}},
+		},
+		{
+			name: "Protocols are taken from port names",
+			endpoints: []*v1alpha3.ServiceEntry_Endpoint{
+				&v1alpha3.ServiceEntry_Endpoint{Address: "1.1.1.1", Ports: map[string]uint32{"grpc": 8080}},
+			},
+			want: []*v1alpha3.Port{&v1alpha3.Port{Number: 8080, Name: "grpc-8080", Protocol: "GRPC"}},
+		},
+		{
+			name: "Ports of the same protocol get unique names and are sorted by number",
+			endpoints: []*v1alpha3.ServiceEntry_Endpoint{
+				&v1alpha3.ServiceEntry_Endpoint{Address: "1.1.1.1", Ports: map[string]uint32{"tcp-9090": 9090, "tcp-8080": 8080}},
+				&v1alpha3.ServiceEntry_Endpoint{Address: "8.8.8.8", Ports: map[string]uint32{"tcp-7070": 7070}},
+			},
+			want: []*v1alpha3.Port{
+				&v1alpha3.Port{Number: 7070, Name: "tcp-7070", Protocol: "TCP"},
+				&v1alpha3.Port{Number: 8080, Name: "tcp-8080", Protocol: "TCP"},
+				&v1alpha3.Port{Number: 9090, Name: "tcp-9090", Protocol: "TCP"},
+			},
+		},
+		{
+			name: "The first endpoint naming a port decides its protocol",
+			endpoints: []*v1alpha3.ServiceEntry_Endpoint{
+				&v1alpha3.ServiceEntry_Endpoint{Address: "1.1.1.1", Ports: map[string]uint32{"http-8080": 8080}},
+				&v1alpha3.ServiceEntry_Endpoint{Address: "8.8.8.8", Ports: map[string]uint32{"grpc-8080": 8080}},
+			},
+			want: []*v1alpha3.Port{&v1alpha3.Port{Number: 8080, Name: "http-8080", Protocol: "HTTP"}},
 		},
 	}
 	for _, tt := range tests {
@@ -95,7 +123,7 @@ func TestEndpoint(t *testing.T) {
 			port:    80,
 			want: &v1alpha3.ServiceEntry_Endpoint{
 				Address: "1.1.1.1",
-				Ports:   map[string]uint32{"http": 80},
+				Ports:   map[string]uint32{"http-80": 80},
 			},
 		},
 	}
@@ -117,6 +145,13 @@ func TestProto(t *testing.T) {
 		{port: 443, want: "https"},
 		{port: 1234, want: "tcp"},
 		{port: 4321, want: "tcp"},
+		{port: 3306, want: "mysql"},
+		{port: 6379, want: "redis"},
+		{port: 8000, want: "http"},
+		{port: 8080, want: "http"},
+		{port: 8443, want: "tls"},
+		{port: 27017, want: "mongo"},
+		{port: 50051, want: "grpc"},
 	}
 	for _, tt := range tests {
 		t.Run(fmt.Sprintf("%v is %v", tt.port, tt.want), func(t *testing.T) {
@@ -126,3 +161,67 @@ func TestProto(t *testing.T) {
 		})
 	}
 }
+
+func TestEndpointWithProtocol(t *testing.T) {
+	tests := []struct {
+		protocol string
+		want     map[string]uint32
+	}{
+		{protocol: "grpc", want: map[string]uint32{"grpc-8080": 8080}},
+		{protocol: "HTTP2", want: map[string]uint32{"http2-8080": 8080}},
+		{protocol: "", want: map[string]uint32{"http-8080": 8080}},
+		{protocol: "thrift", want: map[string]uint32{"http-8080": 8080}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.protocol, func(t *testing.T) {
+			if got := EndpointWithProtocol("1.1.1.1", 8080, tt.protocol); !reflect.DeepEqual(got.Ports, tt.want) {
+				t.Errorf("EndpointWithProtocol() ports = %v, want %v", got.Ports, tt.want)
+			}
+		})
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	tests := []struct {
+		name string
+		port uint32
+		want string
+	}{
+		{name: "grpc", port: 8080, want: "grpc"},
+		{name: "grpc-web", port: 8080, want: "grpc-web"},
+		{name: "grpc-internal", port: 8080, want: "grpc"},
+		{name: "HTTP2", port: 8080, want: "http2"},
+		{name: "metrics", port: 80, want: "http"},
+		{name: "", port: 9090, want: "tcp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Protocol(tt.name, tt.port); got != tt.want {
+				t.Errorf("Protocol(%q, %d) = %v, want %v", tt.name, tt.port, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServiceEntry(t *testing.T) {
+	endpoints := []*v1alpha3.ServiceEntry_Endpoint{
+		{Address: "1.1.1.1", Ports: map[string]uint32{"http-8080": 8080, "tcp-9090": 9090}},
+		{Address: "8.8.8.8", Ports: map[string]uint32{"grpc": 8080}},
+	}
+	se := ServiceEntry(v1.OwnerReference{}, "prefix-", "tetrate.io", endpoints)
+
+	wantPorts := []*v1alpha3.Port{
+		{Number: 8080, Name: "http-8080", Protocol: "HTTP"},
+		{Number: 9090, Name: "tcp-9090", Protocol: "TCP"},
+	}
+	if !reflect.DeepEqual(se.Spec.Ports, wantPorts) {
+		t.Errorf("ServiceEntry() ports = %v, want %v", se.Spec.Ports, wantPorts)
+	}
+	// endpoints' ports are named like the Service Entry's, without changing the endpoints we were given
+	if got, want := se.Spec.Endpoints[1].Ports, map[string]uint32{"http-8080": 8080}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ServiceEntry() endpoint ports = %v, want %v", got, want)
+	}
+	if got, want := endpoints[1].Ports, map[string]uint32{"grpc": 8080}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ServiceEntry() changed the endpoint's ports to %v, want %v", got, want)
+	}
+}
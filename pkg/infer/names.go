@@ -0,0 +1,68 @@
+package infer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strings"
+
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// HostAnnotation records the host a ServiceEntry was generated for, as its name may not spell it out
+const HostAnnotation = "istio-cloud-map/host"
+
+// invalidNameChars are those a DNS-1123 subdomain, and so a Kubernetes object name, can't have
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// ServiceEntryName returns the service entry name based on the specificed host. It's a valid DNS-1123 subdomain:
+// lowercase, with every run of other characters than letters, digits, '-' and '.' replaced by '-'. Names that had to
+// be changed so, as different hosts may then have the same name, and names too long are truncated and suffixed with
+// a hash of the prefix and host, so they stay unique and stable.
+func ServiceEntryName(prefix, host string) string {
+	name := sanitize(prefix + host)
+	if len(name) > 0 && name == prefix+host && len(name) <= validation.DNS1123SubdomainMaxLength {
+		return name
+	}
+	return hashed(name, prefix+host, validation.DNS1123SubdomainMaxLength)
+}
+
+// hashed truncates the name to fit in max characters along with a hash of the key, which it's suffixed with
+func hashed(name, key string, max int) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	suffix := fmt.Sprintf("%08x", h.Sum32())
+	if max := max - len(suffix) - 1; len(name) > max {
+		name = strings.TrimRight(name[:max], ".-")
+	}
+	if len(name) == 0 {
+		return suffix
+	}
+	return name + "-" + suffix
+}
+
+// sanitize lowercases the name and replaces its invalid characters, dropping empty labels and the '-' that labels
+// can't start or end with
+func sanitize(name string) string {
+	name = invalidNameChars.ReplaceAllString(strings.ToLower(name), "-")
+	labels := strings.Split(name, ".")
+	out := labels[:0]
+	for _, l := range labels {
+		if l = strings.Trim(l, "-"); len(l) > 0 {
+			out = append(out, l)
+		}
+	}
+	return strings.Join(out, ".")
+}
+
+// Host returns the host the ServiceEntry was generated for, from its annotation, or its first host if it has none
+func Host(se *ic.ServiceEntry) string {
+	if host, ok := se.Annotations[HostAnnotation]; ok {
+		return host
+	}
+	if len(se.Spec.Hosts) > 0 {
+		return se.Spec.Hosts[0]
+	}
+	return ""
+}
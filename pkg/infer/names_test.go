@@ -0,0 +1,60 @@
+package infer
+
+import (
+	"strings"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestServiceEntryName(t *testing.T) {
+	long := strings.Repeat("a", 250) + ".tetrate.io"
+	tests := []struct {
+		name   string
+		prefix string
+		host   string
+		want   string
+	}{
+		{name: "valid", prefix: "consul-", host: "web.service.consul", want: "consul-web.service.consul"},
+		{name: "uppercase", prefix: "", host: "Web.Service.Consul", want: "web.service.consul-ecf0c422"},
+		{name: "invalid characters", prefix: "consul-", host: "my_web__app.service.consul", want: "consul-my-web-app.service.consul-2c2ff0f9"},
+		{name: "invalid label edges", prefix: "", host: "_web_..-api-.consul", want: "web.api.consul-860f31bf"},
+		{name: "nothing left", prefix: "", host: "__", want: "720ba823"},
+		{name: "too long", prefix: "cloud-map-", host: long, want: "cloud-map-" + strings.Repeat("a", 234) + "-47d8eb1b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ServiceEntryName(tt.prefix, tt.host)
+			if got != tt.want {
+				t.Errorf("ServiceEntryName(%q, %q) = %v, want %v", tt.prefix, tt.host, got, tt.want)
+			}
+			if errs := validation.IsDNS1123Subdomain(got); len(errs) > 0 {
+				t.Errorf("ServiceEntryName(%q, %q) = %v, which isn't a valid name: %v", tt.prefix, tt.host, got, errs)
+			}
+		})
+	}
+
+	// truncated names of different hosts differ
+	if a, b := ServiceEntryName("", long), ServiceEntryName("", long+"."); a == b {
+		t.Errorf("ServiceEntryName() = %v for different hosts", a)
+	}
+
+	// as do the names of hosts that only differ in characters that had to be replaced
+	if a, b := ServiceEntryName("", "a_b.svc"), ServiceEntryName("", "a-b.svc"); a == b {
+		t.Errorf("ServiceEntryName() = %v for different hosts", a)
+	}
+}
+
+func TestHost(t *testing.T) {
+	host := "My_Service.service.consul"
+	se := ServiceEntry(v1.OwnerReference{}, "consul-", host, []*v1alpha3.ServiceEntry_Endpoint{Endpoint("1.1.1.1", 80)})
+	if got := Host(se); got != host {
+		t.Errorf("Host() = %v, want %v", got, host)
+	}
+	if got := Host(&ic.ServiceEntry{Spec: v1alpha3.ServiceEntry{Hosts: []string{"tetrate.io"}}}); got != "tetrate.io" {
+		t.Errorf("Host() of a ServiceEntry without annotation = %v, want its host tetrate.io", got)
+	}
+}
@@ -0,0 +1,187 @@
+package infer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"istio.io/api/networking/v1alpha3"
+	"sigs.k8s.io/yaml"
+
+	"github.com/tetratelabs/log"
+)
+
+// ProtocolRule maps a port, or an inclusive range of ports such as "8000-8999", to the Istio protocol they serve
+type ProtocolRule struct {
+	Ports    string `json:"ports"`
+	Protocol string `json:"protocol"`
+}
+
+func (r ProtocolRule) String() string {
+	return r.Ports + "=" + r.Protocol
+}
+
+// HostProtocolRules are the protocol rules of the hosts matching a glob pattern, as understood by path.Match
+type HostProtocolRules struct {
+	Host  string         `json:"host"`
+	Rules []ProtocolRule `json:"rules"`
+}
+
+// ProtocolTable infers the protocol of ports from their number
+type ProtocolTable struct {
+	// Rules are tried in order, before DefaultProtocolRules, for ports whose endpoints don't name their protocol
+	Rules []ProtocolRule `json:"rules"`
+	// Hosts override the protocol of the ports of matching hosts, whatever their endpoints name them. Only the rules
+	// of the first pattern matching a host apply.
+	Hosts []HostProtocolRules `json:"hosts"`
+}
+
+// DefaultProtocolRules are the well-known ports every ProtocolTable falls back to
+var DefaultProtocolRules = []ProtocolRule{
+	{Ports: "80", Protocol: "HTTP"},
+	{Ports: "443", Protocol: "HTTPS"},
+	{Ports: "3306", Protocol: "MYSQL"},
+	{Ports: "6379", Protocol: "REDIS"},
+	{Ports: "8000", Protocol: "HTTP"},
+	{Ports: "8080", Protocol: "HTTP"},
+	{Ports: "8443", Protocol: "TLS"},
+	{Ports: "27017", Protocol: "MONGO"},
+	{Ports: "50051", Protocol: "GRPC"},
+}
+
+var (
+	tableMu sync.RWMutex
+	table   = &ProtocolTable{} // only the defaults until SetProtocolTable is called
+
+	decisionsMu sync.Mutex
+	decisions   = make(map[string]string) // maps port, or host:port->how its protocol was last decided
+)
+
+// SetProtocolTable sets the table Proto and ServiceEntry infer protocols with
+func SetProtocolTable(t *ProtocolTable) {
+	tableMu.Lock()
+	defer tableMu.Unlock()
+	table = t
+}
+
+func protocolTable() *ProtocolTable {
+	tableMu.RLock()
+	defer tableMu.RUnlock()
+	return table
+}
+
+// LoadProtocolTable reads a ProtocolTable from a YAML or JSON file
+func LoadProtocolTable(file string) (*ProtocolTable, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read protocol table %q", file)
+	}
+	t := &ProtocolTable{}
+	if err := yaml.UnmarshalStrict(data, t); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse protocol table %q", file)
+	}
+	if err := t.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid protocol table %q", file)
+	}
+	return t, nil
+}
+
+// Validate returns an error naming the first malformed rule or host pattern
+func (t *ProtocolTable) Validate() error {
+	rules := append([]ProtocolRule{}, t.Rules...)
+	for _, h := range t.Hosts {
+		if _, err := path.Match(h.Host, ""); err != nil {
+			return errors.Wrapf(err, "invalid host pattern %q", h.Host)
+		}
+		rules = append(rules, h.Rules...)
+	}
+	for _, r := range rules {
+		if !protocols[strings.ToLower(r.Protocol)] {
+			return errors.Errorf("rule %v: unknown protocol %q", r, r.Protocol)
+		}
+		if _, _, err := portRange(r.Ports); err != nil {
+			return errors.Wrapf(err, "rule %v", r)
+		}
+	}
+	return nil
+}
+
+// protocol returns the protocol of the first of the rules matching the port, and that rule
+func protocol(port uint32, rules ...[]ProtocolRule) (string, ProtocolRule, bool) {
+	for _, rs := range rules {
+		for _, r := range rs {
+			if from, to, err := portRange(r.Ports); err == nil && from <= port && port <= to {
+				return strings.ToLower(r.Protocol), r, true
+			}
+		}
+	}
+	return "", ProtocolRule{}, false
+}
+
+// portRange parses a port, or an inclusive range of ports such as "8000-8999"
+func portRange(ports string) (uint32, uint32, error) {
+	parts := strings.SplitN(ports, "-", 2)
+	from, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 16)
+	if err != nil {
+		return 0, 0, errors.Errorf("invalid port %q", ports)
+	}
+	to := from
+	if len(parts) == 2 {
+		if to, err = strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 16); err != nil || to < from {
+			return 0, 0, errors.Errorf("invalid port range %q", ports)
+		}
+	}
+	return uint32(from), uint32(to), nil
+}
+
+// hostRules returns the rules of the first host pattern matching the host
+func (t *ProtocolTable) hostRules(host string) []ProtocolRule {
+	for _, h := range t.Hosts {
+		if ok, _ := path.Match(h.Host, host); ok {
+			return h.Rules
+		}
+	}
+	return nil
+}
+
+// applyHostRules overrides the protocol of the ports the host's rules match
+func applyHostRules(host string, ports []*v1alpha3.Port) {
+	rules := protocolTable().hostRules(host)
+	if len(rules) == 0 {
+		return
+	}
+	for _, p := range ports {
+		if proto, rule, ok := protocol(p.Number, rules); ok {
+			logDecision(host+":"+strconv.Itoa(int(p.Number)),
+				"port %d of %s is %s by host rule %v", p.Number, host, strings.ToUpper(proto), rule)
+			p.Name = PortName(proto, p.Number)
+			p.Protocol = strings.ToUpper(proto)
+		}
+	}
+}
+
+// logDecision logs how the protocol of the port, keyed by its number or host:number, was decided. It's logged at Info
+// the first time and whenever it changes, e.g. as the table is reloaded, and at Debug every other time, so that
+// operators see what decided every port without the same lines being logged every sync.
+func logDecision(key, format string, args ...interface{}) {
+	if decided(key, fmt.Sprintf(format, args...)) {
+		log.Infof(format, args...)
+	} else {
+		log.Debugf(format, args...)
+	}
+}
+
+// decided records how the protocol of the port was decided, and reports whether that's news
+func decided(key, decision string) bool {
+	decisionsMu.Lock()
+	defer decisionsMu.Unlock()
+	if decisions[key] == decision {
+		return false
+	}
+	decisions[key] = decision
+	return true
+}
@@ -0,0 +1,140 @@
+package infer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProtocolTable(t *testing.T) {
+	defer SetProtocolTable(&ProtocolTable{})
+	SetProtocolTable(&ProtocolTable{
+		Rules: []ProtocolRule{{Ports: "8080", Protocol: "TCP"}, {Ports: "9000-9100", Protocol: "GRPC"}},
+		Hosts: []HostProtocolRules{
+			{Host: "*.db.tetrate.io", Rules: []ProtocolRule{{Ports: "9050", Protocol: "MYSQL"}}},
+			{Host: "*.tetrate.io", Rules: []ProtocolRule{{Ports: "9050", Protocol: "REDIS"}}},
+		},
+	})
+
+	for port, want := range map[uint32]string{8080: "tcp", 8000: "http", 9000: "grpc", 9100: "grpc", 9101: "tcp"} {
+		if got := Proto(port); got != want {
+			t.Errorf("Proto(%d) = %v, want %v", port, got, want)
+		}
+	}
+
+	endpoints := []*v1alpha3.ServiceEntry_Endpoint{
+		{Address: "1.1.1.1", Ports: map[string]uint32{"grpc-9050": 9050, "http-8000": 8000}},
+	}
+	tests := []struct {
+		host string
+		want []*v1alpha3.Port
+	}{
+		{
+			host: "a.db.tetrate.io",
+			want: []*v1alpha3.Port{
+				{Number: 8000, Name: "http-8000", Protocol: "HTTP"},
+				{Number: 9050, Name: "mysql-9050", Protocol: "MYSQL"},
+			},
+		},
+		{
+			host: "a.tetrate.io",
+			want: []*v1alpha3.Port{
+				{Number: 8000, Name: "http-8000", Protocol: "HTTP"},
+				{Number: 9050, Name: "redis-9050", Protocol: "REDIS"},
+			},
+		},
+		{
+			host: "a.tetrate.com",
+			want: []*v1alpha3.Port{
+				{Number: 8000, Name: "http-8000", Protocol: "HTTP"},
+				{Number: 9050, Name: "grpc-9050", Protocol: "GRPC"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			se := ServiceEntry(v1.OwnerReference{}, "", tt.host, endpoints)
+			if !reflect.DeepEqual(se.Spec.Ports, tt.want) {
+				t.Errorf("ServiceEntry() ports = %v, want %v", se.Spec.Ports, tt.want)
+			}
+			if got, want := se.Spec.Endpoints[0].Ports[tt.want[1].Name], uint32(9050); got != want {
+				t.Errorf("ServiceEntry() endpoint ports = %v, want %s to be %d", se.Spec.Endpoints[0].Ports, tt.want[1].Name, want)
+			}
+		})
+	}
+}
+
+func TestLoadProtocolTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protocols")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		want    *ProtocolTable
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			content: `
+rules:
+- ports: "9000-9100"
+  protocol: GRPC
+hosts:
+- host: "*.db.internal"
+  rules:
+  - ports: "5432"
+    protocol: TCP
+`,
+			want: &ProtocolTable{
+				Rules: []ProtocolRule{{Ports: "9000-9100", Protocol: "GRPC"}},
+				Hosts: []HostProtocolRules{{Host: "*.db.internal", Rules: []ProtocolRule{{Ports: "5432", Protocol: "TCP"}}}},
+			},
+		},
+		{name: "unknown protocol", content: "rules: [{ports: '9000', protocol: THRIFT}]", wantErr: true},
+		{name: "reversed range", content: "rules: [{ports: '9100-9000', protocol: GRPC}]", wantErr: true},
+		{name: "not a port", content: "rules: [{ports: 'http', protocol: HTTP}]", wantErr: true},
+		{name: "invalid host pattern", content: "hosts: [{host: '[', rules: []}]", wantErr: true},
+		{name: "unknown field", content: "rule: []", wantErr: true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, string(rune('a'+i)))
+			if err := ioutil.WriteFile(file, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadProtocolTable(file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadProtocolTable() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadProtocolTable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecided(t *testing.T) {
+	key := "decided.tetrate.io:9050"
+	for _, step := range []struct {
+		decision string
+		want     bool
+	}{
+		{decision: "MYSQL", want: true},
+		{decision: "MYSQL", want: false},
+		{decision: "REDIS", want: true},
+		{decision: "MYSQL", want: true},
+	} {
+		if got := decided(key, step.decision); got != step.want {
+			t.Errorf("decided(%q, %q) = %v, want %v", key, step.decision, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package infer
+
+import (
+	"io/ioutil"
+	"path"
+
+	"github.com/pkg/errors"
+	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"sigs.k8s.io/yaml"
+
+	"github.com/tetratelabs/istio-cloud-map/pkg/provider"
+)
+
+// ServiceEntryMatch selects hosts by glob patterns, as understood by path.Match, of their name and of the provider
+// and provider namespace of the service behind them. Empty patterns match everything. If Attributes are set, the
+// service must also have each of them.
+type ServiceEntryMatch struct {
+	Provider   string            `json:"provider,omitempty"`
+	Namespace  string            `json:"namespace,omitempty"`
+	Host       string            `json:"host,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// ServiceEntryRule sets the Location, ExportTo and SubjectAltNames of the ServiceEntries of the hosts it matches.
+// Fields the rule doesn't set are left as inferred.
+type ServiceEntryRule struct {
+	Match           ServiceEntryMatch `json:"match"`
+	Location        string            `json:"location,omitempty"` // MESH_EXTERNAL or MESH_INTERNAL
+	ExportTo        []string          `json:"exportTo,omitempty"`
+	SubjectAltNames []string          `json:"subjectAltNames,omitempty"`
+}
+
+// ServiceEntryRules are tried in order; only the first rule matching a host applies
+type ServiceEntryRules []ServiceEntryRule
+
+// LoadServiceEntryRules reads ServiceEntryRules from a YAML or JSON file
+func LoadServiceEntryRules(file string) (ServiceEntryRules, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read service entry rules %q", file)
+	}
+	var rules ServiceEntryRules
+	if err := yaml.UnmarshalStrict(data, &rules); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse service entry rules %q", file)
+	}
+	if err := rules.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid service entry rules %q", file)
+	}
+	return rules, nil
+}
+
+// Validate returns an error describing the first malformed rule
+func (rules ServiceEntryRules) Validate() error {
+	for i, r := range rules {
+		for _, p := range []string{r.Match.Provider, r.Match.Namespace, r.Match.Host} {
+			if _, err := path.Match(p, ""); err != nil {
+				return errors.Wrapf(err, "rule %d: invalid pattern %q", i, p)
+			}
+		}
+		if _, ok := v1alpha3.ServiceEntry_Location_value[r.Location]; len(r.Location) > 0 && !ok {
+			return errors.Errorf("rule %d: unknown location %q, must be MESH_EXTERNAL or MESH_INTERNAL", i, r.Location)
+		}
+	}
+	return nil
+}
+
+// Apply the first rule matching the host of the ServiceEntry and the service behind it
+func (rules ServiceEntryRules) Apply(se *ic.ServiceEntry, host string, meta provider.HostMeta) {
+	for _, r := range rules {
+		if !r.Match.matches(host, meta) {
+			continue
+		}
+		if len(r.Location) > 0 {
+			se.Spec.Location = v1alpha3.ServiceEntry_Location(v1alpha3.ServiceEntry_Location_value[r.Location])
+		}
+		if len(r.ExportTo) > 0 {
+			se.Spec.ExportTo = r.ExportTo
+		}
+		if len(r.SubjectAltNames) > 0 {
+			se.Spec.SubjectAltNames = r.SubjectAltNames
+		}
+		return
+	}
+}
+
+func (m ServiceEntryMatch) matches(host string, meta provider.HostMeta) bool {
+	if !glob(m.Provider, meta.Provider) || !glob(m.Namespace, meta.Namespace) || !glob(m.Host, host) {
+		return false
+	}
+	for k, v := range m.Attributes {
+		if w, ok := meta.Attributes[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// glob reports whether the name matches the pattern, which matches everything if empty
+func glob(pattern, name string) bool {
+	if len(pattern) == 0 {
+		return true
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
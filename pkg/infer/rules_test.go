@@ -0,0 +1,135 @@
+package infer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/tetratelabs/istio-cloud-map/pkg/provider"
+)
+
+func TestServiceEntryRules_Apply(t *testing.T) {
+	rules := ServiceEntryRules{
+		{
+			Match:    ServiceEntryMatch{Provider: "consul", Namespace: "team-*"},
+			Location: "MESH_INTERNAL",
+			ExportTo: []string{"."},
+		},
+		{
+			Match:    ServiceEntryMatch{Attributes: map[string]string{"internal": "true"}},
+			Location: "MESH_INTERNAL",
+		},
+		{
+			Match:           ServiceEntryMatch{Host: "*.tetrate.io"},
+			SubjectAltNames: []string{"spiffe://tetrate.io/web"},
+		},
+	}
+	endpoints := []*v1alpha3.ServiceEntry_Endpoint{EndpointWithPorts("1.1.1.1", 80)}
+
+	tests := []struct {
+		name                string
+		host                string
+		meta                provider.HostMeta
+		wantLocation        v1alpha3.ServiceEntry_Location
+		wantExportTo        []string
+		wantSubjectAltNames []string
+	}{
+		{
+			name:         "first matching rule applies",
+			host:         "web.tetrate.io",
+			meta:         provider.HostMeta{Provider: "consul", Namespace: "team-a"},
+			wantLocation: v1alpha3.ServiceEntry_MESH_INTERNAL,
+			wantExportTo: []string{"."},
+		},
+		{
+			name:                "host glob",
+			host:                "web.tetrate.io",
+			meta:                provider.HostMeta{Provider: "cloudmap", Namespace: "team-a"},
+			wantLocation:        v1alpha3.ServiceEntry_MESH_EXTERNAL,
+			wantSubjectAltNames: []string{"spiffe://tetrate.io/web"},
+		},
+		{
+			name:         "attributes",
+			host:         "web.tetrate.io",
+			meta:         provider.HostMeta{Provider: "cloudmap", Attributes: map[string]string{"internal": "true", "tls": "true"}},
+			wantLocation: v1alpha3.ServiceEntry_MESH_INTERNAL,
+		},
+		{
+			name:         "no rule matches",
+			host:         "web.tetrate.com",
+			meta:         provider.HostMeta{Provider: "consul", Namespace: "default"},
+			wantLocation: v1alpha3.ServiceEntry_MESH_EXTERNAL,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			se := ServiceEntry(v1.OwnerReference{}, "", tt.host, endpoints)
+			rules.Apply(se, tt.host, tt.meta)
+			if se.Spec.Location != tt.wantLocation {
+				t.Errorf("Location = %v, want %v", se.Spec.Location, tt.wantLocation)
+			}
+			if !reflect.DeepEqual(se.Spec.ExportTo, tt.wantExportTo) {
+				t.Errorf("ExportTo = %v, want %v", se.Spec.ExportTo, tt.wantExportTo)
+			}
+			if !reflect.DeepEqual(se.Spec.SubjectAltNames, tt.wantSubjectAltNames) {
+				t.Errorf("SubjectAltNames = %v, want %v", se.Spec.SubjectAltNames, tt.wantSubjectAltNames)
+			}
+		})
+	}
+}
+
+func TestLoadServiceEntryRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		want    ServiceEntryRules
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			content: `
+- match:
+    provider: consul
+    host: "*.internal"
+  location: MESH_INTERNAL
+  exportTo: ["."]
+  subjectAltNames: ["spiffe://cluster.local/ns/default/sa/web"]
+`,
+			want: ServiceEntryRules{{
+				Match:           ServiceEntryMatch{Provider: "consul", Host: "*.internal"},
+				Location:        "MESH_INTERNAL",
+				ExportTo:        []string{"."},
+				SubjectAltNames: []string{"spiffe://cluster.local/ns/default/sa/web"},
+			}},
+		},
+		{name: "unknown location", content: "[{match: {}, location: MESH_NEARBY}]", wantErr: true},
+		{name: "invalid pattern", content: "[{match: {namespace: '['}}]", wantErr: true},
+		{name: "unknown field", content: "[{matches: {}}]", wantErr: true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, string(rune('a'+i)))
+			if err := ioutil.WriteFile(file, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadServiceEntryRules(file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadServiceEntryRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadServiceEntryRules() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package infer
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/tetratelabs/istio-cloud-map/pkg/networking"
+)
+
+// WorkloadEntries moves the endpoints of ServiceEntries to WorkloadEntries their ServiceEntry selects, one per
+// instance, for Istio to give each instance its own identity and health
+type WorkloadEntries struct {
+	// NetworkLabel is the endpoint label naming the network of instances that don't say which network they're in
+	NetworkLabel string
+	// ServiceAccountLabel is the endpoint label naming the service account instances run as
+	ServiceAccountLabel string
+}
+
+// Select returns the WorkloadEntries of the ServiceEntry's endpoints, named after it and owned like it, and has the
+// ServiceEntry select them in their place. Only mesh-internal workloads can be selected, which must have IP
+// addresses: it returns none, leaving the ServiceEntry be, if it has no endpoints or any endpoint isn't an IP.
+func (w *WorkloadEntries) Select(se *ic.ServiceEntry, host string) []*unstructured.Unstructured {
+	if len(se.Spec.Endpoints) == 0 {
+		return nil
+	}
+	for _, ep := range se.Spec.Endpoints {
+		if net.ParseIP(ep.Address) == nil {
+			return nil
+		}
+	}
+	selector := WorkloadSelector(se.Name)
+	out := make([]*unstructured.Unstructured, 0, len(se.Spec.Endpoints))
+	for _, ep := range se.Spec.Endpoints {
+		out = append(out, w.workloadEntry(se, host, selector, ep))
+	}
+	if se.Annotations == nil {
+		se.Annotations = make(map[string]string)
+	}
+	se.Annotations[networking.WorkloadSelectorAnnotation] = selector
+	se.Spec.Location = v1alpha3.ServiceEntry_MESH_INTERNAL
+	se.Spec.Resolution = v1alpha3.ServiceEntry_STATIC
+	se.Spec.Addresses = nil
+	se.Spec.Endpoints = nil
+	return out
+}
+
+func (w *WorkloadEntries) workloadEntry(se *ic.ServiceEntry, host, selector string, ep *v1alpha3.ServiceEntry_Endpoint) *unstructured.Unstructured {
+	ports := make(map[string]interface{}, len(ep.Ports))
+	for name, port := range ep.Ports {
+		ports[name] = int64(port)
+	}
+	labels := make(map[string]interface{}, len(ep.Labels)+1)
+	for k, v := range ep.Labels {
+		labels[k] = v
+	}
+	labels[networking.WorkloadLabel] = selector
+	spec := map[string]interface{}{"address": ep.Address, "ports": ports, "labels": labels}
+	network := ep.Network
+	if len(network) == 0 && len(w.NetworkLabel) > 0 {
+		network = ep.Labels[w.NetworkLabel]
+	}
+	if len(network) > 0 {
+		spec["network"] = network
+	}
+	if len(ep.Locality) > 0 {
+		spec["locality"] = ep.Locality
+	}
+	if ep.Weight > 0 {
+		spec["weight"] = int64(ep.Weight)
+	}
+	if account := ep.Labels[w.ServiceAccountLabel]; len(w.ServiceAccountLabel) > 0 && len(account) > 0 {
+		spec["serviceAccount"] = account
+	}
+
+	we := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	we.SetAPIVersion(networking.WorkloadEntries.GroupVersion().String())
+	we.SetKind("WorkloadEntry")
+	we.SetName(WorkloadEntryName(se.Name, ep))
+	we.SetNamespace(se.Namespace)
+	we.SetLabels(map[string]string{networking.WorkloadLabel: selector})
+	we.SetAnnotations(map[string]string{HostAnnotation: host})
+	we.SetOwnerReferences(se.OwnerReferences)
+	return we
+}
+
+// WorkloadSelector returns the value of the networking.WorkloadLabel by which the ServiceEntry of the name selects its
+// WorkloadEntries. It's the name itself if it's a valid label value, or the name truncated and suffixed with its hash.
+func WorkloadSelector(name string) string {
+	if len(validation.IsValidLabelValue(name)) == 0 {
+		return name
+	}
+	return hashed(sanitize(name), name, validation.LabelValueMaxLength)
+}
+
+// WorkloadEntryName returns the name of the WorkloadEntry of the endpoint of the ServiceEntry of the name: that name
+// and the endpoint's address, suffixed with a hash of the address and ports, as instances can share an address
+func WorkloadEntryName(name string, ep *v1alpha3.ServiceEntry_Endpoint) string {
+	ports := make([]string, 0, len(ep.Ports))
+	for _, port := range ep.Ports {
+		ports = append(ports, strconv.Itoa(int(port)))
+	}
+	sort.Strings(ports)
+	key := name + "/" + ep.Address + ":" + strings.Join(ports, ",")
+	return hashed(sanitize(name+"-"+ep.Address), key, validation.DNS1123SubdomainMaxLength)
+}
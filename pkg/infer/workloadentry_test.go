@@ -0,0 +1,110 @@
+package infer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/tetratelabs/istio-cloud-map/pkg/networking"
+)
+
+func TestWorkloadEntries_Select(t *testing.T) {
+	w := &WorkloadEntries{NetworkLabel: "network", ServiceAccountLabel: "service-account"}
+	owner := v1.OwnerReference{Name: "test"}
+
+	// instances with names, or any instance without an IP, are left inline
+	for _, endpoints := range [][]*v1alpha3.ServiceEntry_Endpoint{nil, {Endpoint("1.1.1.1", 80), Endpoint("web.tetrate.io", 80)}} {
+		se := ServiceEntry(owner, "consul-", "web.tetrate.io", endpoints)
+		if got := w.Select(se, "web.tetrate.io"); got != nil {
+			t.Errorf("Select() of endpoints %v = %v, want none", endpoints, got)
+		}
+		if _, ok := se.Annotations[networking.WorkloadSelectorAnnotation]; ok || len(se.Spec.Endpoints) != len(endpoints) {
+			t.Errorf("Select() of endpoints %v changed the ServiceEntry to %v", endpoints, se)
+		}
+	}
+
+	zoned := Endpoint("1.1.1.1", 80)
+	zoned.Labels = map[string]string{"network": "vpc-1", "service-account": "web", "version": "v1"}
+	zoned.Locality = "us-east-1/us-east-1a"
+	zoned.Weight = 2
+	networked := Endpoint("2.2.2.2", 80)
+	networked.Network = "vpc-2"
+	networked.Labels = map[string]string{"network": "vpc-1"}
+	se := ServiceEntry(owner, "consul-", "web.tetrate.io", []*v1alpha3.ServiceEntry_Endpoint{zoned, networked})
+	se.Namespace = "default"
+	got := w.Select(se, "web.tetrate.io")
+	if len(got) != 2 {
+		t.Fatalf("Select() = %v, want a WorkloadEntry per endpoint", got)
+	}
+
+	// the ServiceEntry selects them in place of its endpoints
+	if se.Annotations[networking.WorkloadSelectorAnnotation] != se.Name {
+		t.Errorf("ServiceEntry selects %q, want its name %q", se.Annotations[networking.WorkloadSelectorAnnotation], se.Name)
+	}
+	if se.Spec.Endpoints != nil || se.Spec.Addresses != nil || se.Spec.Location != v1alpha3.ServiceEntry_MESH_INTERNAL ||
+		se.Spec.Resolution != v1alpha3.ServiceEntry_STATIC {
+		t.Errorf("selecting ServiceEntry = %v, want a mesh-internal static one without endpoints or addresses", se.Spec)
+	}
+
+	we := got[0]
+	if we.GetKind() != "WorkloadEntry" || we.GetAPIVersion() != "networking.istio.io/v1alpha3" || we.GetNamespace() != "default" ||
+		we.GetName() != WorkloadEntryName(se.Name, zoned) || we.GetAnnotations()[HostAnnotation] != "web.tetrate.io" ||
+		we.GetLabels()[networking.WorkloadLabel] != se.Name || !reflect.DeepEqual(we.GetOwnerReferences(), []v1.OwnerReference{owner}) {
+		t.Errorf("WorkloadEntry = %v, want one named, labelled and owned after its ServiceEntry", we)
+	}
+	want := map[string]interface{}{
+		"address":        "1.1.1.1",
+		"ports":          map[string]interface{}{"http-80": int64(80)},
+		"labels":         map[string]interface{}{"network": "vpc-1", "service-account": "web", "version": "v1", networking.WorkloadLabel: se.Name},
+		"network":        "vpc-1",
+		"locality":       "us-east-1/us-east-1a",
+		"weight":         int64(2),
+		"serviceAccount": "web",
+	}
+	if !reflect.DeepEqual(we.Object["spec"], want) {
+		t.Errorf("WorkloadEntry spec = %v, want %v", we.Object["spec"], want)
+	}
+	// the endpoint's network wins over the label
+	if network := got[1].Object["spec"].(map[string]interface{})["network"]; network != "vpc-2" {
+		t.Errorf("WorkloadEntry network = %v, want the endpoint's vpc-2", network)
+	}
+}
+
+func TestWorkloadSelector(t *testing.T) {
+	if got := WorkloadSelector("consul-web.service.consul"); got != "consul-web.service.consul" {
+		t.Errorf("WorkloadSelector() = %q, want the name", got)
+	}
+	long := strings.Repeat("a", 100) + ".tetrate.io"
+	got := WorkloadSelector(long)
+	if errs := validation.IsValidLabelValue(got); len(errs) > 0 {
+		t.Errorf("WorkloadSelector(%q) = %q, which isn't a valid label value: %v", long, got, errs)
+	}
+	if other := WorkloadSelector(strings.Repeat("a", 100) + ".tetrate.com"); other == got {
+		t.Errorf("WorkloadSelector() of different names = %q", got)
+	}
+}
+
+func TestWorkloadEntryName(t *testing.T) {
+	web := EndpointWithPorts("1.1.1.1", 80, 443)
+	api := EndpointWithPorts("1.1.1.1", 8080)
+	v6 := Endpoint("2001:db8::1", 80)
+	if WorkloadEntryName("web", web) == WorkloadEntryName("web", api) {
+		t.Error("WorkloadEntryName() of instances sharing an address are the same")
+	}
+	if got := WorkloadEntryName("web", web); got != WorkloadEntryName("web", EndpointWithPorts("1.1.1.1", 443, 80)) {
+		t.Errorf("WorkloadEntryName() = %q depends on the order of ports", got)
+	}
+	for _, ep := range []*v1alpha3.ServiceEntry_Endpoint{web, v6} {
+		name := WorkloadEntryName(strings.Repeat("a", 250), ep)
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+			t.Errorf("WorkloadEntryName() = %q, which isn't a valid name: %v", name, errs)
+		}
+	}
+	if got := WorkloadEntryName("web", v6); !strings.HasPrefix(got, "web-2001-db8-1-") {
+		t.Errorf("WorkloadEntryName() = %q, want it to spell out the address", got)
+	}
+}
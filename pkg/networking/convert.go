@@ -0,0 +1,182 @@
+package networking
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	icbeta "istio.io/client-go/pkg/apis/networking/v1beta1"
+	icbetaapi "istio.io/client-go/pkg/clientset/versioned/typed/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/tetratelabs/log"
+)
+
+// convert copies in, an object of one version, to out, the same kind of object in another version with the same
+// schema
+func convert(in, out runtime.Object) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal %T", in)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return errors.Wrapf(err, "failed to convert %T to %T", in, out)
+	}
+	// leave it to the client to say what version it's in, as if it was never converted
+	out.GetObjectKind().SetGroupVersionKind(schema.GroupVersionKind{})
+	return nil
+}
+
+// convertWatch converts the objects of the watch's events with the function. An event it can't convert becomes an
+// error, which ends the watch, so informers relist rather than silently miss the change.
+func convertWatch(w watch.Interface, err error, f func(runtime.Object) (runtime.Object, error)) (watch.Interface, error) {
+	if err != nil {
+		return nil, err
+	}
+	return watch.Filter(w, func(e watch.Event) (watch.Event, bool) {
+		if e.Type == watch.Error {
+			return e, true
+		}
+		obj, err := f(e.Object)
+		if err != nil {
+			log.Errorf("failed to convert %s watch event: %v", e.Type, err)
+			return watch.Event{Type: watch.Error, Object: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Code:    http.StatusInternalServerError,
+				Reason:  metav1.StatusReasonInternalError,
+				Message: err.Error(),
+			}}, true
+		}
+		e.Object = obj
+		return e, true
+	}), nil
+}
+
+// serviceEntries is a v1alpha3 ServiceEntry client of the v1beta1 API
+type serviceEntries struct {
+	c icbetaapi.ServiceEntryInterface
+}
+
+func (s serviceEntries) Create(se *ic.ServiceEntry) (*ic.ServiceEntry, error) {
+	in := &icbeta.ServiceEntry{}
+	if err := convert(se, in); err != nil {
+		return nil, err
+	}
+	return serviceEntry(s.c.Create(in))
+}
+
+func (s serviceEntries) Update(se *ic.ServiceEntry) (*ic.ServiceEntry, error) {
+	in := &icbeta.ServiceEntry{}
+	if err := convert(se, in); err != nil {
+		return nil, err
+	}
+	return serviceEntry(s.c.Update(in))
+}
+
+func (s serviceEntries) Delete(name string, options *metav1.DeleteOptions) error {
+	return s.c.Delete(name, options)
+}
+
+func (s serviceEntries) DeleteCollection(options *metav1.DeleteOptions, listOptions metav1.ListOptions) error {
+	return s.c.DeleteCollection(options, listOptions)
+}
+
+func (s serviceEntries) Get(name string, options metav1.GetOptions) (*ic.ServiceEntry, error) {
+	return serviceEntry(s.c.Get(name, options))
+}
+
+func (s serviceEntries) List(opts metav1.ListOptions) (*ic.ServiceEntryList, error) {
+	list, err := s.c.List(opts)
+	if err != nil {
+		return nil, err
+	}
+	out := &ic.ServiceEntryList{}
+	return out, convert(list, out)
+}
+
+func (s serviceEntries) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	w, err := s.c.Watch(opts)
+	return convertWatch(w, err, func(obj runtime.Object) (runtime.Object, error) {
+		out := &ic.ServiceEntry{}
+		return out, convert(obj, out)
+	})
+}
+
+func (s serviceEntries) Patch(name string, pt types.PatchType, data []byte, subresources ...string) (*ic.ServiceEntry, error) {
+	return serviceEntry(s.c.Patch(name, pt, data, subresources...))
+}
+
+func serviceEntry(se *icbeta.ServiceEntry, err error) (*ic.ServiceEntry, error) {
+	if err != nil {
+		return nil, err
+	}
+	out := &ic.ServiceEntry{}
+	return out, convert(se, out)
+}
+
+// destinationRules is a v1alpha3 DestinationRule client of the v1beta1 API
+type destinationRules struct {
+	c icbetaapi.DestinationRuleInterface
+}
+
+func (d destinationRules) Create(dr *ic.DestinationRule) (*ic.DestinationRule, error) {
+	in := &icbeta.DestinationRule{}
+	if err := convert(dr, in); err != nil {
+		return nil, err
+	}
+	return destinationRule(d.c.Create(in))
+}
+
+func (d destinationRules) Update(dr *ic.DestinationRule) (*ic.DestinationRule, error) {
+	in := &icbeta.DestinationRule{}
+	if err := convert(dr, in); err != nil {
+		return nil, err
+	}
+	return destinationRule(d.c.Update(in))
+}
+
+func (d destinationRules) Delete(name string, options *metav1.DeleteOptions) error {
+	return d.c.Delete(name, options)
+}
+
+func (d destinationRules) DeleteCollection(options *metav1.DeleteOptions, listOptions metav1.ListOptions) error {
+	return d.c.DeleteCollection(options, listOptions)
+}
+
+func (d destinationRules) Get(name string, options metav1.GetOptions) (*ic.DestinationRule, error) {
+	return destinationRule(d.c.Get(name, options))
+}
+
+func (d destinationRules) List(opts metav1.ListOptions) (*ic.DestinationRuleList, error) {
+	list, err := d.c.List(opts)
+	if err != nil {
+		return nil, err
+	}
+	out := &ic.DestinationRuleList{}
+	return out, convert(list, out)
+}
+
+func (d destinationRules) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	w, err := d.c.Watch(opts)
+	return convertWatch(w, err, func(obj runtime.Object) (runtime.Object, error) {
+		out := &ic.DestinationRule{}
+		return out, convert(obj, out)
+	})
+}
+
+func (d destinationRules) Patch(name string, pt types.PatchType, data []byte, subresources ...string) (*ic.DestinationRule, error) {
+	return destinationRule(d.c.Patch(name, pt, data, subresources...))
+}
+
+func destinationRule(dr *icbeta.DestinationRule, err error) (*ic.DestinationRule, error) {
+	if err != nil {
+		return nil, err
+	}
+	out := &ic.DestinationRule{}
+	return out, convert(dr, out)
+}
@@ -0,0 +1,118 @@
+// Package networking reads and writes Istio's networking API in the version chosen for it. The operator works with
+// v1alpha3 objects throughout; in other versions, whose schemas are the same, objects are converted on their way to
+// and from the API server, so clients, informers and listers all see v1alpha3 objects whichever version is served.
+package networking
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"istio.io/client-go/pkg/clientset/versioned"
+	icapi "istio.io/client-go/pkg/clientset/versioned/typed/networking/v1alpha3"
+	icinformer "istio.io/client-go/pkg/informers/externalversions/networking/v1alpha3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// Group is the API group of Istio's networking resources
+	Group = "networking.istio.io"
+
+	V1alpha3 = "v1alpha3"
+	V1beta1  = "v1beta1"
+	// Auto picks the newest version the API server serves
+	Auto = "auto"
+)
+
+// Versions are the versions of the networking API the operator can use, newest first
+var Versions = []string{V1beta1, V1alpha3}
+
+// API is Istio's networking API in one version
+type API struct {
+	Version string
+	client  versioned.Interface
+}
+
+// New returns the API in the given version, or, if it's Auto, in the newest version the API server serves
+func New(client versioned.Interface, version string) (*API, error) {
+	if version == Auto {
+		var err error
+		if version, err = Discover(client.Discovery()); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range Versions {
+		if v == version {
+			return &API{Version: version, client: client}, nil
+		}
+	}
+	return nil, errors.Errorf("unsupported %s version %q, must be %q or one of %v", Group, version, Auto, Versions)
+}
+
+// Discover returns the newest version of the networking API the API server serves
+func Discover(d discovery.DiscoveryInterface) (string, error) {
+	groups, err := d.ServerGroups()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to discover the API server's groups")
+	}
+	served := make(map[string]bool)
+	for _, g := range groups.Groups {
+		if g.Name != Group {
+			continue
+		}
+		for _, v := range g.Versions {
+			served[v.Version] = true
+		}
+	}
+	for _, v := range Versions {
+		if served[v] {
+			return v, nil
+		}
+	}
+	return "", errors.Errorf("the API server serves none of the %s versions %v, are Istio's CRDs installed?", Group, Versions)
+}
+
+// ServiceEntries returns a client of the ServiceEntries of the namespace
+func (a *API) ServiceEntries(namespace string) icapi.ServiceEntryInterface {
+	if a.Version == V1beta1 {
+		return serviceEntries{a.client.NetworkingV1beta1().ServiceEntries(namespace)}
+	}
+	return a.client.NetworkingV1alpha3().ServiceEntries(namespace)
+}
+
+// DestinationRules returns a client of the DestinationRules of the namespace
+func (a *API) DestinationRules(namespace string) icapi.DestinationRuleInterface {
+	if a.Version == V1beta1 {
+		return destinationRules{a.client.NetworkingV1beta1().DestinationRules(namespace)}
+	}
+	return a.client.NetworkingV1alpha3().DestinationRules(namespace)
+}
+
+// ServiceEntryInformer returns an informer of the ServiceEntries of the namespace, or all namespaces if empty
+func (a *API) ServiceEntryInformer(namespace string, resync time.Duration, indexers cache.Indexers) cache.SharedIndexInformer {
+	if a.Version == V1beta1 {
+		c := a.ServiceEntries(namespace)
+		lw := &cache.ListWatch{
+			ListFunc:  func(o metav1.ListOptions) (runtime.Object, error) { return c.List(o) },
+			WatchFunc: c.Watch,
+		}
+		return cache.NewSharedIndexInformer(lw, &ic.ServiceEntry{}, resync, indexers)
+	}
+	return icinformer.NewServiceEntryInformer(a.client, namespace, resync, indexers)
+}
+
+// DestinationRuleInformer returns an informer of the DestinationRules of the namespace, or all namespaces if empty
+func (a *API) DestinationRuleInformer(namespace string, resync time.Duration, indexers cache.Indexers) cache.SharedIndexInformer {
+	if a.Version == V1beta1 {
+		c := a.DestinationRules(namespace)
+		lw := &cache.ListWatch{
+			ListFunc:  func(o metav1.ListOptions) (runtime.Object, error) { return c.List(o) },
+			WatchFunc: c.Watch,
+		}
+		return cache.NewSharedIndexInformer(lw, &ic.DestinationRule{}, resync, indexers)
+	}
+	return icinformer.NewDestinationRuleInformer(a.client, namespace, resync, indexers)
+}
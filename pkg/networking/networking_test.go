@@ -0,0 +1,160 @@
+package networking
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"istio.io/client-go/pkg/clientset/versioned/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestDiscover(t *testing.T) {
+	tests := []struct {
+		name    string
+		served  []string
+		want    string
+		wantErr bool
+	}{
+		{name: "newest", served: []string{"networking.istio.io/v1alpha3", "networking.istio.io/v1beta1"}, want: V1beta1},
+		{name: "only v1alpha3", served: []string{"networking.istio.io/v1alpha3"}, want: V1alpha3},
+		{name: "unsupported", served: []string{"networking.istio.io/v2", "security.istio.io/v1beta1"}, wantErr: true},
+		{name: "none", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			d := client.Discovery().(*fakediscovery.FakeDiscovery)
+			for _, gv := range tt.served {
+				d.Resources = append(d.Resources, &metav1.APIResourceList{GroupVersion: gv})
+			}
+			got, err := Discover(d)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Discover() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Discover() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	if _, err := New(client, "v1"); err == nil {
+		t.Error("New() with an unsupported version succeeded, want an error")
+	}
+	client.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{{GroupVersion: "networking.istio.io/v1beta1"}}
+	if api, err := New(client, Auto); err != nil || api.Version != V1beta1 {
+		t.Errorf("New() = %v, %v, want the discovered version %q", api, err, V1beta1)
+	}
+}
+
+func TestAPI_v1beta1(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	api, err := New(client, V1beta1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	se := &ic.ServiceEntry{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Annotations: map[string]string{"a": "b"}},
+		Spec: v1alpha3.ServiceEntry{
+			Hosts:      []string{"web.tetrate.io"},
+			Ports:      []*v1alpha3.Port{{Number: 80, Name: "http", Protocol: "HTTP"}},
+			Endpoints:  []*v1alpha3.ServiceEntry_Endpoint{{Address: "1.1.1.1", Ports: map[string]uint32{"http": 80}}},
+			Resolution: v1alpha3.ServiceEntry_STATIC,
+			Location:   v1alpha3.ServiceEntry_MESH_INTERNAL,
+		},
+	}
+
+	// written in v1beta1
+	if _, err := api.ServiceEntries("default").Create(se); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	stored, err := client.NetworkingV1beta1().ServiceEntries("default").Get("web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("ServiceEntry wasn't written in v1beta1: %v", err)
+	}
+	if stored.Spec.Hosts[0] != "web.tetrate.io" || stored.Spec.Endpoints[0].Address != "1.1.1.1" ||
+		stored.Spec.Location.String() != "MESH_INTERNAL" || stored.Annotations["a"] != "b" {
+		t.Errorf("stored ServiceEntry = %v, want %v", stored, se)
+	}
+
+	// read back in v1alpha3
+	got, err := api.ServiceEntries("default").Get("web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if !proto.Equal(&got.Spec, &se.Spec) || got.Name != se.Name || got.Annotations["a"] != "b" {
+		t.Errorf("Get() = %v, want %v", got, se)
+	}
+
+	// informed in v1alpha3
+	stop := make(chan struct{})
+	defer close(stop)
+	informer := api.ServiceEntryInformer("", time.Second, cache.Indexers{})
+	go informer.Run(stop)
+	if !cache.WaitForCacheSync(stop, informer.HasSynced) {
+		t.Fatal("informer didn't sync")
+	}
+	obj, ok, err := informer.GetIndexer().GetByKey("default/web")
+	if err != nil || !ok {
+		t.Fatalf("informer doesn't have the ServiceEntry: %v", err)
+	}
+	if informed, ok := obj.(*ic.ServiceEntry); !ok || !proto.Equal(&informed.Spec, &se.Spec) {
+		t.Errorf("informed %#v, want %v", obj, se)
+	}
+
+	// and kept up to date
+	got.Spec.Hosts = []string{"api.tetrate.io"}
+	if _, err := api.ServiceEntries("default").Update(got); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		obj, _, _ := informer.GetIndexer().GetByKey("default/web")
+		if obj.(*ic.ServiceEntry).Spec.Hosts[0] == "api.tetrate.io" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("informer has %v, want it updated", obj)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConvertWatch(t *testing.T) {
+	source := watch.NewFake()
+	w, err := convertWatch(source, nil, func(obj runtime.Object) (runtime.Object, error) {
+		if obj.(*ic.ServiceEntry).Name == "bad" {
+			return nil, errors.New("can't convert")
+		}
+		return obj, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	go source.Add(&ic.ServiceEntry{ObjectMeta: metav1.ObjectMeta{Name: "good"}})
+	if e := <-w.ResultChan(); e.Type != watch.Added || e.Object.(*ic.ServiceEntry).Name != "good" {
+		t.Errorf("convertWatch() passed on %v, want the converted event", e)
+	}
+
+	// an event that can't be converted ends the watch rather than go missing
+	go source.Modify(&ic.ServiceEntry{ObjectMeta: metav1.ObjectMeta{Name: "bad"}})
+	e := <-w.ResultChan()
+	if e.Type != watch.Error {
+		t.Fatalf("convertWatch() passed on %v, want an error", e)
+	}
+	if status, ok := e.Object.(*metav1.Status); !ok || status.Status != metav1.StatusFailure {
+		t.Errorf("convertWatch() error is %v, want a failed status", e.Object)
+	}
+}
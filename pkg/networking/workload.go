@@ -0,0 +1,199 @@
+package networking
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/pkg/errors"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	icapi "istio.io/client-go/pkg/clientset/versioned/typed/networking/v1alpha3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// WorkloadEntries, and the workload selector of ServiceEntries, are served from Istio 1.6 on. The client library we
+// use predates both: WorkloadEntries are read and written as unstructured objects, and so are the ServiceEntries
+// selecting them, whose workload selector the typed clients would drop, and fail to read.
+
+const (
+	// WorkloadLabel labels the WorkloadEntries a ServiceEntry selects with the value it selects them by
+	WorkloadLabel = "istio-cloud-map/workload"
+	// WorkloadSelectorAnnotation records the WorkloadLabel value a ServiceEntry selects its WorkloadEntries by. The
+	// ServiceEntry clients of SelectingServiceEntries write it to its workload selector.
+	WorkloadSelectorAnnotation = "istio-cloud-map/workload-selector"
+)
+
+// WorkloadEntries is the resource of WorkloadEntries, which every version of Istio serving them serves in v1alpha3
+var WorkloadEntries = schema.GroupVersionResource{Group: Group, Version: V1alpha3, Resource: "workloadentries"}
+
+// ServesWorkloadEntries returns an error unless the API server serves WorkloadEntries
+func ServesWorkloadEntries(d discovery.DiscoveryInterface) error {
+	resources, err := d.ServerResourcesForGroupVersion(WorkloadEntries.GroupVersion().String())
+	if err != nil {
+		return errors.Wrapf(err, "failed to discover the resources of %s", WorkloadEntries.GroupVersion())
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == WorkloadEntries.Resource {
+			return nil
+		}
+	}
+	return errors.Errorf("the API server doesn't serve %s, WorkloadEntries need Istio 1.6 or later", WorkloadEntries)
+}
+
+// WorkloadEntryInformer returns an informer of the WorkloadEntries of the namespace, or all namespaces if empty
+func WorkloadEntryInformer(d dynamic.Interface, namespace string, resync time.Duration, indexers cache.Indexers) cache.SharedIndexInformer {
+	return dynamicinformer.NewFilteredDynamicInformer(d, WorkloadEntries, namespace, resync, indexers, nil).Informer()
+}
+
+// SelectingServiceEntries returns a client of the ServiceEntries of the namespace that sets the workload selector of
+// those with a WorkloadSelectorAnnotation
+func (a *API) SelectingServiceEntries(d dynamic.Interface, namespace string) icapi.ServiceEntryInterface {
+	gvr := a.serviceEntryResource()
+	return selectingServiceEntries{c: d.Resource(gvr).Namespace(namespace), apiVersion: gvr.GroupVersion().String()}
+}
+
+func (a *API) serviceEntryResource() schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: Group, Version: a.Version, Resource: "serviceentries"}
+}
+
+// SelectingServiceEntryInformer returns an informer of the ServiceEntries of the namespace, or all namespaces if
+// empty, that reads those with a workload selector
+func (a *API) SelectingServiceEntryInformer(d dynamic.Interface, namespace string, resync time.Duration, indexers cache.Indexers) cache.SharedIndexInformer {
+	c := a.SelectingServiceEntries(d, namespace)
+	lw := &cache.ListWatch{
+		ListFunc:  func(o metav1.ListOptions) (runtime.Object, error) { return c.List(o) },
+		WatchFunc: c.Watch,
+	}
+	return cache.NewSharedIndexInformer(lw, &ic.ServiceEntry{}, resync, indexers)
+}
+
+// selectingServiceEntries is a v1alpha3 ServiceEntry client writing unstructured ServiceEntries
+type selectingServiceEntries struct {
+	c          dynamic.ResourceInterface
+	apiVersion string
+}
+
+func (s selectingServiceEntries) Create(se *ic.ServiceEntry) (*ic.ServiceEntry, error) {
+	u, err := s.unstructured(se)
+	if err != nil {
+		return nil, err
+	}
+	return structured(s.c.Create(u, metav1.CreateOptions{}))
+}
+
+func (s selectingServiceEntries) Update(se *ic.ServiceEntry) (*ic.ServiceEntry, error) {
+	u, err := s.unstructured(se)
+	if err != nil {
+		return nil, err
+	}
+	return structured(s.c.Update(u, metav1.UpdateOptions{}))
+}
+
+func (s selectingServiceEntries) Delete(name string, options *metav1.DeleteOptions) error {
+	return s.c.Delete(name, options)
+}
+
+func (s selectingServiceEntries) DeleteCollection(options *metav1.DeleteOptions, listOptions metav1.ListOptions) error {
+	return s.c.DeleteCollection(options, listOptions)
+}
+
+func (s selectingServiceEntries) Get(name string, options metav1.GetOptions) (*ic.ServiceEntry, error) {
+	return structured(s.c.Get(name, options))
+}
+
+func (s selectingServiceEntries) List(opts metav1.ListOptions) (*ic.ServiceEntryList, error) {
+	list, err := s.c.List(opts)
+	if err != nil {
+		return nil, err
+	}
+	out := &ic.ServiceEntryList{ListMeta: metav1.ListMeta{
+		ResourceVersion: list.GetResourceVersion(),
+		Continue:        list.GetContinue(),
+	}}
+	for i := range list.Items {
+		se, err := toServiceEntry(&list.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		out.Items = append(out.Items, *se)
+	}
+	return out, nil
+}
+
+func (s selectingServiceEntries) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	w, err := s.c.Watch(opts)
+	return convertWatch(w, err, func(obj runtime.Object) (runtime.Object, error) {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return nil, errors.Errorf("watched %T, want an unstructured ServiceEntry", obj)
+		}
+		return toServiceEntry(u)
+	})
+}
+
+func (s selectingServiceEntries) Patch(name string, pt types.PatchType, data []byte, subresources ...string) (*ic.ServiceEntry, error) {
+	return structured(s.c.Patch(name, pt, data, metav1.PatchOptions{}, subresources...))
+}
+
+// unstructured returns the ServiceEntry as an unstructured object, along with the workload selector it records
+func (s selectingServiceEntries) unstructured(se *ic.ServiceEntry) (*unstructured.Unstructured, error) {
+	data, err := json.Marshal(se)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to marshal ServiceEntry %q", se.Name)
+	}
+	u := &unstructured.Unstructured{}
+	if err := json.Unmarshal(data, &u.Object); err != nil {
+		return nil, errors.Wrapf(err, "failed to convert ServiceEntry %q", se.Name)
+	}
+	u.SetAPIVersion(s.apiVersion)
+	u.SetKind("ServiceEntry")
+	if selector, ok := se.Annotations[WorkloadSelectorAnnotation]; ok {
+		labels := map[string]interface{}{WorkloadLabel: selector}
+		if err := unstructured.SetNestedMap(u.Object, labels, "spec", "workloadSelector", "labels"); err != nil {
+			return nil, errors.Wrapf(err, "failed to set the workload selector of ServiceEntry %q", se.Name)
+		}
+	}
+	return u, nil
+}
+
+func structured(u *unstructured.Unstructured, err error) (*ic.ServiceEntry, error) {
+	if err != nil {
+		return nil, err
+	}
+	return toServiceEntry(u)
+}
+
+// lenient unmarshals ServiceEntry specs with fields newer than the client library, such as the workload selector
+var lenient = &jsonpb.Unmarshaler{AllowUnknownFields: true}
+
+// toServiceEntry converts the unstructured ServiceEntry, leaving out the fields the client library doesn't know
+func toServiceEntry(u *unstructured.Unstructured) (*ic.ServiceEntry, error) {
+	out := &ic.ServiceEntry{}
+	meta, _, err := unstructured.NestedMap(u.Object, "metadata")
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid metadata of ServiceEntry %q", u.GetName())
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(meta, &out.ObjectMeta); err != nil {
+		return nil, errors.Wrapf(err, "failed to convert the metadata of ServiceEntry %q", u.GetName())
+	}
+	if spec, ok := u.Object["spec"]; ok {
+		data, err := json.Marshal(spec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to marshal the spec of ServiceEntry %q", u.GetName())
+		}
+		if err := lenient.Unmarshal(bytes.NewReader(data), &out.Spec); err != nil {
+			return nil, errors.Wrapf(err, "failed to convert the spec of ServiceEntry %q", u.GetName())
+		}
+	}
+	return out, nil
+}
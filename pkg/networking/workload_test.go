@@ -0,0 +1,110 @@
+package networking
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"istio.io/client-go/pkg/clientset/versioned/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestServesWorkloadEntries(t *testing.T) {
+	d := fake.NewSimpleClientset().Discovery().(*fakediscovery.FakeDiscovery)
+	d.Resources = []*metav1.APIResourceList{{GroupVersion: "networking.istio.io/v1alpha3", APIResources: []metav1.APIResource{{Name: "serviceentries"}}}}
+	if err := ServesWorkloadEntries(d); err == nil {
+		t.Error("ServesWorkloadEntries() without WorkloadEntries succeeded, want an error")
+	}
+	d.Resources[0].APIResources = append(d.Resources[0].APIResources, metav1.APIResource{Name: "workloadentries"})
+	if err := ServesWorkloadEntries(d); err != nil {
+		t.Errorf("ServesWorkloadEntries() error = %v", err)
+	}
+}
+
+func TestAPI_SelectingServiceEntries(t *testing.T) {
+	client := fakedynamic.NewSimpleDynamicClient(runtime.NewScheme())
+	api := &API{Version: V1beta1}
+	gvr := api.serviceEntryResource()
+	se := &ic.ServiceEntry{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Annotations: map[string]string{WorkloadSelectorAnnotation: "web"}},
+		Spec: v1alpha3.ServiceEntry{
+			Hosts:      []string{"web.tetrate.io"},
+			Ports:      []*v1alpha3.Port{{Number: 80, Name: "http", Protocol: "HTTP"}},
+			Resolution: v1alpha3.ServiceEntry_STATIC,
+			Location:   v1alpha3.ServiceEntry_MESH_INTERNAL,
+		},
+	}
+
+	// written in the API's version, selecting by the annotation
+	if _, err := api.SelectingServiceEntries(client, "default").Create(se); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	stored, err := client.Resource(gvr).Namespace("default").Get("web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("ServiceEntry wasn't written in %s: %v", api.Version, err)
+	}
+	if stored.GetAPIVersion() != "networking.istio.io/v1beta1" || stored.GetKind() != "ServiceEntry" {
+		t.Errorf("stored a %s %s, want a networking.istio.io/v1beta1 ServiceEntry", stored.GetAPIVersion(), stored.GetKind())
+	}
+	selector, _, _ := unstructured.NestedStringMap(stored.Object, "spec", "workloadSelector", "labels")
+	if len(selector) != 1 || selector[WorkloadLabel] != "web" {
+		t.Errorf("stored workload selector %v, want %s=web", selector, WorkloadLabel)
+	}
+	if hosts, _, _ := unstructured.NestedStringSlice(stored.Object, "spec", "hosts"); len(hosts) != 1 || hosts[0] != "web.tetrate.io" {
+		t.Errorf("stored hosts %v, want %v", hosts, se.Spec.Hosts)
+	}
+
+	// read back despite the workload selector
+	got, err := api.SelectingServiceEntries(client, "default").Get("web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if !proto.Equal(&got.Spec, &se.Spec) || got.Name != se.Name || got.Annotations[WorkloadSelectorAnnotation] != "web" {
+		t.Errorf("Get() = %v, want %v", got, se)
+	}
+
+	// informed
+	stop := make(chan struct{})
+	defer close(stop)
+	informer := api.SelectingServiceEntryInformer(client, "", time.Second, cache.Indexers{})
+	go informer.Run(stop)
+	if !cache.WaitForCacheSync(stop, informer.HasSynced) {
+		t.Fatal("informer didn't sync")
+	}
+	obj, ok, err := informer.GetIndexer().GetByKey("default/web")
+	if err != nil || !ok {
+		t.Fatalf("informer doesn't have the ServiceEntry: %v", err)
+	}
+	if informed, ok := obj.(*ic.ServiceEntry); !ok || !proto.Equal(&informed.Spec, &se.Spec) {
+		t.Errorf("informed %#v, want %v", obj, se)
+	}
+
+	// and kept up to date, without a selector once the annotation is gone
+	delete(got.Annotations, WorkloadSelectorAnnotation)
+	got.Spec.Hosts = []string{"api.tetrate.io"}
+	if _, err := api.SelectingServiceEntries(client, "default").Update(got); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	stored, _ = client.Resource(gvr).Namespace("default").Get("web", metav1.GetOptions{})
+	if _, found, _ := unstructured.NestedFieldNoCopy(stored.Object, "spec", "workloadSelector"); found {
+		t.Errorf("stored %v, want no workload selector", stored.Object["spec"])
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		obj, _, _ := informer.GetIndexer().GetByKey("default/web")
+		if obj.(*ic.ServiceEntry).Spec.Hosts[0] == "api.tetrate.io" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("informer has %v, want it updated", obj)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,168 @@
+package overlay
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"text/template"
+
+	"github.com/pkg/errors"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"sigs.k8s.io/yaml"
+
+	"github.com/tetratelabs/istio-cloud-map/pkg/infer"
+	"github.com/tetratelabs/istio-cloud-map/pkg/provider"
+)
+
+// Overlay customizes the ServiceEntries of the hosts matching a glob pattern, as understood by path.Match, with a
+// strategic-merge patch. ServiceEntry fields declare no merge keys, so lists in the patch replace those generated.
+type Overlay struct {
+	Host string `json:"host"`
+	// Patch is a YAML or JSON patch
+	Patch string `json:"patch,omitempty"`
+	// Template is a Go template rendering a YAML or JSON patch from Data
+	Template string `json:"template,omitempty"`
+}
+
+// Overlays are applied in order; every overlay matching a host applies, on top of the previous ones
+type Overlays []Overlay
+
+// Data is what templates are executed with, e.g. {{ .Service }} or {{ index .Meta "datacenter" }}
+type Data struct {
+	Host string
+	provider.HostMeta
+	// ServiceEntry is as generated so far, before the overlay applies
+	ServiceEntry *ic.ServiceEntry
+}
+
+// Load reads Overlays from a YAML or JSON file
+func Load(file string) (Overlays, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read overlays %q", file)
+	}
+	var overlays Overlays
+	if err := yaml.UnmarshalStrict(data, &overlays); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse overlays %q", file)
+	}
+	if err := overlays.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid overlays %q", file)
+	}
+	return overlays, nil
+}
+
+// Validate returns an error describing the first malformed overlay
+func (overlays Overlays) Validate() error {
+	for i, o := range overlays {
+		if _, err := path.Match(o.Host, ""); err != nil {
+			return errors.Wrapf(err, "overlay %d: invalid host pattern %q", i, o.Host)
+		}
+		switch {
+		case len(o.Patch) > 0 && len(o.Template) > 0:
+			return errors.Errorf("overlay %d: has both a patch and a template", i)
+		case len(o.Patch) > 0:
+			if _, err := toJSON([]byte(o.Patch)); err != nil {
+				return errors.Wrapf(err, "overlay %d", i)
+			}
+		case len(o.Template) > 0:
+			if _, err := o.template(); err != nil {
+				return errors.Wrapf(err, "overlay %d", i)
+			}
+		default:
+			return errors.Errorf("overlay %d: has neither a patch nor a template", i)
+		}
+	}
+	return nil
+}
+
+// Apply returns the host's ServiceEntry with the overlays matching the host applied, leaving the original untouched.
+// It's an error for the result not to be ours anymore, that is for the overlays to change its name, namespace, owners,
+// hosts or host annotation.
+func (overlays Overlays) Apply(se *ic.ServiceEntry, host string, meta provider.HostMeta) (*ic.ServiceEntry, error) {
+	out := se
+	for i, o := range overlays {
+		if ok, _ := path.Match(o.Host, host); !ok {
+			continue
+		}
+		patch, err := o.render(Data{Host: host, HostMeta: meta, ServiceEntry: out})
+		if err != nil {
+			return nil, errors.Wrapf(err, "overlay %d (%s)", i, o.Host)
+		}
+		if out, err = apply(out, patch); err != nil {
+			return nil, errors.Wrapf(err, "overlay %d (%s)", i, o.Host)
+		}
+	}
+	if err := owned(se, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// render returns the overlay's patch as JSON
+func (o Overlay) render(data Data) ([]byte, error) {
+	if len(o.Template) == 0 {
+		return toJSON([]byte(o.Patch))
+	}
+	t, err := o.template()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return nil, errors.Wrap(err, "failed to execute template")
+	}
+	return toJSON(buf.Bytes())
+}
+
+func (o Overlay) template() (*template.Template, error) {
+	t, err := template.New(o.Host).Option("missingkey=zero").Parse(o.Template)
+	return t, errors.Wrap(err, "failed to parse template")
+}
+
+// toJSON converts a YAML or JSON patch to JSON, checking it's an object
+func toJSON(patch []byte) ([]byte, error) {
+	out, err := yaml.YAMLToJSON(patch)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid patch")
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(out, &obj); err != nil {
+		return nil, errors.Errorf("invalid patch, it must be an object: %s", patch)
+	}
+	return out, nil
+}
+
+func apply(se *ic.ServiceEntry, patch []byte) (*ic.ServiceEntry, error) {
+	original, err := json.Marshal(se)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal ServiceEntry")
+	}
+	patched, err := strategicpatch.StrategicMergePatch(original, patch, ic.ServiceEntry{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to apply patch")
+	}
+	out := &ic.ServiceEntry{}
+	if err := json.Unmarshal(patched, out); err != nil {
+		return nil, errors.Wrap(err, "patch doesn't leave a valid ServiceEntry")
+	}
+	return out, nil
+}
+
+// owned returns an error if the overlaid ServiceEntry wouldn't be classified as the one generated
+func owned(generated, overlaid *ic.ServiceEntry) error {
+	switch {
+	case overlaid.Name != generated.Name || overlaid.Namespace != generated.Namespace:
+		return errors.Errorf("overlays renamed ServiceEntry %s/%s to %s/%s",
+			generated.Namespace, generated.Name, overlaid.Namespace, overlaid.Name)
+	case !reflect.DeepEqual(overlaid.OwnerReferences, generated.OwnerReferences):
+		return errors.Errorf("overlays changed the owners of ServiceEntry %q", generated.Name)
+	case !reflect.DeepEqual(overlaid.Spec.Hosts, generated.Spec.Hosts):
+		return errors.Errorf("overlays changed the hosts of ServiceEntry %q to %v", generated.Name, overlaid.Spec.Hosts)
+	case overlaid.Annotations[infer.HostAnnotation] != generated.Annotations[infer.HostAnnotation]:
+		return errors.Errorf("overlays changed the %s annotation of ServiceEntry %q", infer.HostAnnotation, generated.Name)
+	}
+	return nil
+}
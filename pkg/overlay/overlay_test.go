@@ -0,0 +1,179 @@
+package overlay
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/tetratelabs/istio-cloud-map/pkg/infer"
+	"github.com/tetratelabs/istio-cloud-map/pkg/provider"
+)
+
+func TestOverlays_Apply(t *testing.T) {
+	owner := v1.OwnerReference{APIVersion: "cloudmap.istio.io", Kind: "ServiceController", Name: "test"}
+	endpoints := []*v1alpha3.ServiceEntry_Endpoint{infer.EndpointWithPorts("1.1.1.1", 80)}
+	meta := provider.HostMeta{Provider: "consul", Namespace: "team-a", Service: "web", Meta: map[string]string{"datacenter": "dc1"}}
+
+	tests := []struct {
+		name            string
+		host            string
+		overlays        Overlays
+		wantLabels      map[string]string
+		wantAnnotations map[string]string
+		wantExportTo    []string
+		wantErr         bool
+	}{
+		{
+			name:     "no overlay matches",
+			host:     "web.tetrate.com",
+			overlays: Overlays{{Host: "*.tetrate.io", Patch: "metadata: {labels: {team: a}}"}},
+		},
+		{
+			name: "patch",
+			host: "web.tetrate.io",
+			overlays: Overlays{{Host: "*.tetrate.io", Patch: `
+metadata:
+  labels:
+    team: a
+spec:
+  exportTo: ["."]
+`}},
+			wantLabels:   map[string]string{"team": "a"},
+			wantExportTo: []string{"."},
+		},
+		{
+			name: "template with provider metadata",
+			host: "web.tetrate.io",
+			overlays: Overlays{{Host: "*", Template: `
+metadata:
+  annotations:
+    service: "{{ .Provider }}/{{ .Namespace }}/{{ .Service }}"
+    datacenter: "{{ index .Meta "datacenter" }}"
+    partition: "{{ index .Meta "partition" }}"
+    first-port: "{{ (index .ServiceEntry.Spec.Ports 0).Name }}"
+`}},
+			wantAnnotations: map[string]string{
+				"service": "consul/team-a/web", "datacenter": "dc1", "partition": "", "first-port": "http-80",
+			},
+		},
+		{
+			name: "every matching overlay applies in order",
+			host: "web.tetrate.io",
+			overlays: Overlays{
+				{Host: "*", Patch: "metadata: {labels: {team: a, tier: web}}"},
+				{Host: "web.*", Patch: "metadata: {labels: {team: b}}"},
+			},
+			wantLabels: map[string]string{"team": "b", "tier": "web"},
+		},
+		{
+			name:     "renaming is an error",
+			host:     "web.tetrate.io",
+			overlays: Overlays{{Host: "*", Patch: "metadata: {name: other}"}},
+			wantErr:  true,
+		},
+		{
+			name:     "changing owners is an error",
+			host:     "web.tetrate.io",
+			overlays: Overlays{{Host: "*", Patch: "metadata: {ownerReferences: null}"}},
+			wantErr:  true,
+		},
+		{
+			name:     "changing the host annotation is an error",
+			host:     "web.tetrate.io",
+			overlays: Overlays{{Host: "*", Patch: "metadata: {annotations: {istio-cloud-map/host: other.tetrate.io}}"}},
+			wantErr:  true,
+		},
+		{
+			name:     "changing hosts is an error",
+			host:     "web.tetrate.io",
+			overlays: Overlays{{Host: "*", Patch: "spec: {hosts: [other.tetrate.io]}"}},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			se := infer.ServiceEntry(owner, "", tt.host, endpoints)
+			original := se.DeepCopy()
+			got, err := tt.overlays.Apply(se, tt.host, meta)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Apply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(se, original) {
+				t.Errorf("Apply() changed the original ServiceEntry to %v", se)
+			}
+			if tt.wantErr {
+				return
+			}
+			delete(got.Annotations, infer.HostAnnotation) // as generated
+			if len(got.Labels)+len(tt.wantLabels) > 0 && !reflect.DeepEqual(got.Labels, tt.wantLabels) {
+				t.Errorf("Apply() labels = %v, want %v", got.Labels, tt.wantLabels)
+			}
+			if len(got.Annotations)+len(tt.wantAnnotations) > 0 && !reflect.DeepEqual(got.Annotations, tt.wantAnnotations) {
+				t.Errorf("Apply() annotations = %v, want %v", got.Annotations, tt.wantAnnotations)
+			}
+			if !reflect.DeepEqual(got.Spec.ExportTo, tt.wantExportTo) {
+				t.Errorf("Apply() exportTo = %v, want %v", got.Spec.ExportTo, tt.wantExportTo)
+			}
+			if !reflect.DeepEqual(got.Spec.Endpoints, original.Spec.Endpoints) {
+				t.Errorf("Apply() endpoints = %v, want them untouched %v", got.Spec.Endpoints, original.Spec.Endpoints)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overlays")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		want    Overlays
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			content: `
+- host: "*.internal"
+  patch: |
+    metadata: {labels: {team: a}}
+- host: "*"
+  template: |
+    metadata: {labels: {provider: "{{ .Provider }}"}}
+`,
+			want: Overlays{
+				{Host: "*.internal", Patch: "metadata: {labels: {team: a}}\n"},
+				{Host: "*", Template: "metadata: {labels: {provider: \"{{ .Provider }}\"}}\n"},
+			},
+		},
+		{name: "both", content: "[{host: '*', patch: 'a: b', template: 'a: b'}]", wantErr: true},
+		{name: "neither", content: "[{host: '*'}]", wantErr: true},
+		{name: "patch isn't an object", content: "[{host: '*', patch: '[a]'}]", wantErr: true},
+		{name: "invalid template", content: "[{host: '*', template: '{{ .Provider'}]", wantErr: true},
+		{name: "invalid host pattern", content: "[{host: '[', patch: 'a: b'}]", wantErr: true},
+		{name: "unknown field", content: "[{hosts: '*', patch: 'a: b'}]", wantErr: true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, string(rune('a'+i)))
+			if err := ioutil.WriteFile(file, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := Load(file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Load() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
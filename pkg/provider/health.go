@@ -0,0 +1,26 @@
+package provider
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// HealthReporter is implemented by watchers that know whether their provider can be reached
+type HealthReporter interface {
+	// Healthy returns why the provider couldn't be synced the last time it was tried, or nil if it was
+	Healthy() error
+}
+
+// HealthHandler serves the health of the watcher: OK if it's healthy, or doesn't report its health, and Service
+// Unavailable with the reason otherwise
+func HealthHandler(w Watcher) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		if hr, ok := w.(HealthReporter); ok {
+			if err := hr.Healthy(); err != nil {
+				http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(rw, "ok")
+	})
+}
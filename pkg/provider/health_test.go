@@ -0,0 +1,48 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fakeWatcher struct{}
+
+func (fakeWatcher) Run(context.Context) {}
+func (fakeWatcher) Store() Store        { return NewStore() }
+func (fakeWatcher) Prefix() string      { return "fake-" }
+
+type reportingWatcher struct {
+	fakeWatcher
+	err error
+}
+
+func (w reportingWatcher) Healthy() error { return w.err }
+
+func TestHealthHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		watcher  Watcher
+		wantCode int
+		wantBody string
+	}{
+		{"doesn't report", fakeWatcher{}, http.StatusOK, "ok"},
+		{"healthy", reportingWatcher{}, http.StatusOK, "ok"},
+		{"unhealthy", reportingWatcher{err: errors.New("connection refused")}, http.StatusServiceUnavailable, "connection refused"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			HealthHandler(tt.watcher).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if rec.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantCode)
+			}
+			if got := strings.TrimSpace(rec.Body.String()); got != tt.wantBody {
+				t.Errorf("got body %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
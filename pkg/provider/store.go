@@ -6,6 +6,9 @@ import (
 	"istio.io/api/networking/v1alpha3"
 )
 
+// HealthStatusLabel is the endpoint label providers that know the health of the instance behind an endpoint report it with
+const HealthStatusLabel = "istio-cloud-map/health-status"
+
 type (
 	// Store describes a set of Istio endpoint objects from Cloud Map/Consul stored by the hostnames that own them.
 	// It is asynchronously accessed by a provider and the synchronizer
@@ -13,11 +16,26 @@ type (
 		// Hosts are all hosts Cloud Map/Consul has told us about
 		Hosts() map[string][]*v1alpha3.ServiceEntry_Endpoint
 		Set(hosts map[string][]*v1alpha3.ServiceEntry_Endpoint)
+		// Meta is what Cloud Map/Consul has told us about the services behind the hosts
+		Meta() map[string]HostMeta
+		SetMeta(meta map[string]HostMeta)
+	}
+
+	// HostMeta describes the service behind a host
+	HostMeta struct {
+		Provider  string            `json:"provider"`       // e.g. "cloudmap" or "consul"
+		Namespace string            `json:"namespace"`      // of the provider the service is in, if it has any
+		Service   string            `json:"service"`        // name of the service in the provider
+		Meta      map[string]string `json:"meta,omitempty"` // anything else the provider knows, e.g. Consul's datacenter
+		// Attributes are those every instance of the service shares, e.g. Consul service meta or Cloud Map instance
+		// attributes
+		Attributes map[string]string `json:"attributes,omitempty"`
 	}
 
 	store struct {
 		m     *sync.RWMutex
 		hosts map[string][]*v1alpha3.ServiceEntry_Endpoint // maps host->Endpoints
+		meta  map[string]HostMeta
 	}
 )
 
@@ -25,6 +43,7 @@ type (
 func NewStore() Store {
 	return &store{
 		hosts: make(map[string][]*v1alpha3.ServiceEntry_Endpoint),
+		meta:  make(map[string]HostMeta),
 		m:     &sync.RWMutex{},
 	}
 }
@@ -41,6 +60,44 @@ func (s *store) Set(hosts map[string][]*v1alpha3.ServiceEntry_Endpoint) {
 	s.hosts = copyMap(hosts)
 }
 
+func (s *store) Meta() map[string]HostMeta {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	out := make(map[string]HostMeta, len(s.meta))
+	for k, v := range s.meta {
+		out[k] = v
+	}
+	return out
+}
+
+func (s *store) SetMeta(meta map[string]HostMeta) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.meta = make(map[string]HostMeta, len(meta))
+	for k, v := range meta {
+		s.meta[k] = v
+	}
+}
+
+// SharedAttributes returns the attributes every one of the instances has with the same value
+func SharedAttributes(instances ...map[string]string) map[string]string {
+	if len(instances) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(instances[0]))
+	for k, v := range instances[0] {
+		out[k] = v
+	}
+	for _, attrs := range instances[1:] {
+		for k, v := range out {
+			if w, ok := attrs[k]; !ok || w != v {
+				delete(out, k)
+			}
+		}
+	}
+	return out
+}
+
 func copyMap(m map[string][]*v1alpha3.ServiceEntry_Endpoint) map[string][]*v1alpha3.ServiceEntry_Endpoint {
 	out := make(map[string][]*v1alpha3.ServiceEntry_Endpoint, len(m))
 	for k, v := range m {
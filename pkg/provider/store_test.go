@@ -1,6 +1,7 @@
 package provider
 
 import (
+	"reflect"
 	"testing"
 
 	"istio.io/api/networking/v1alpha3"
@@ -20,4 +21,29 @@ func Test_store(t *testing.T) {
 			t.Errorf("We were able to affect the original input: %v", st.Hosts())
 		}
 	})
+	t.Run("Meta is read only", func(t *testing.T) {
+		in := map[string]HostMeta{"tetrate.io": {Provider: "consul", Service: "web"}}
+		st := NewStore()
+		st.SetMeta(in)
+		in["tetrate.io"] = HostMeta{Provider: "cloudmap"}
+		out := st.Meta()
+		out["other.io"] = HostMeta{}
+		if got := st.Meta(); len(got) != 1 || got["tetrate.io"].Provider != "consul" {
+			t.Errorf("We were able to affect the stored meta: %v", got)
+		}
+	})
+}
+
+func TestSharedAttributes(t *testing.T) {
+	got := SharedAttributes(
+		map[string]string{"tls": "true", "version": "v1", "zone": "a"},
+		map[string]string{"tls": "true", "version": "v2"},
+		map[string]string{"tls": "true", "version": "v1"},
+	)
+	if want := map[string]string{"tls": "true"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SharedAttributes() = %v, want %v", got, want)
+	}
+	if got := SharedAttributes(); got != nil {
+		t.Errorf("SharedAttributes() of no instances = %v, want nil", got)
+	}
 }
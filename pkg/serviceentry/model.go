@@ -15,12 +15,12 @@
 package serviceentry
 
 import (
-	"reflect"
 	"sync"
 
 	"github.com/golang/protobuf/proto"
 	"istio.io/client-go/pkg/apis/networking/v1alpha3"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 
 	"github.com/tetratelabs/log"
 )
@@ -43,7 +43,7 @@ type (
 		// Insert adds a ServiceEntry to the store (detecting who it belongs to)
 		Insert(se *v1alpha3.ServiceEntry) error
 
-		// Update updates a ServiceEntry's claimed hosts in the store
+		// Update updates a ServiceEntry's claimed hosts, spec, labels and annotations in the store
 		Update(old, newse *v1alpha3.ServiceEntry) error
 
 		// Delete removes a ServiceEntry from the store
@@ -118,7 +118,7 @@ func (s *store) Insert(se *v1alpha3.ServiceEntry) error {
 }
 
 func (s *store) Update(old, se *v1alpha3.ServiceEntry) error {
-	if proto.Equal(&old.Spec, &se.Spec) {
+	if proto.Equal(&old.Spec, &se.Spec) && labels.Equals(old.Labels, se.Labels) && labels.Equals(old.Annotations, se.Annotations) {
 		log.Infof("skipping update, no change")
 		return nil
 	}
@@ -181,7 +181,7 @@ func owner(self v1.OwnerReference, refs []v1.OwnerReference) Owner {
 		return None
 	}
 	for _, ref := range refs {
-		if reflect.DeepEqual(ref, self) {
+		if SameOwner(ref, self) {
 			return Us
 		}
 	}
@@ -189,6 +189,13 @@ func owner(self v1.OwnerReference, refs []v1.OwnerReference) Owner {
 	return Them
 }
 
+// SameOwner reports whether the owner references refer to the same controller. Every run of the operator gets an
+// owner with a UID of its own, so references are compared by API version, kind and name (the operator's ID) alone,
+// and what a previous run created is still ours.
+func SameOwner(a, b v1.OwnerReference) bool {
+	return a.APIVersion == b.APIVersion && a.Kind == b.Kind && a.Name == b.Name
+}
+
 func copyMap(m map[string]*v1alpha3.ServiceEntry) map[string]*v1alpha3.ServiceEntry {
 	out := make(map[string]*v1alpha3.ServiceEntry, len(m))
 	for k, v := range m {
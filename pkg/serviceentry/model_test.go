@@ -49,6 +49,22 @@ var (
 		},
 	}
 
+	// created by a previous run of the operator, whose owner had another UID
+	usBeforeRestart = &ic.ServiceEntry{
+		ObjectMeta: v1.ObjectMeta{
+			OwnerReferences: []v1.OwnerReference{{
+				APIVersion: baseOwner.APIVersion,
+				Kind:       baseOwner.Kind,
+				Name:       baseOwner.Name,
+				UID:        "previous-run",
+				Controller: &t,
+			}},
+		},
+		Spec: v1alpha3.ServiceEntry{
+			Hosts: []string{"1.restarted", "2.restarted"},
+		},
+	}
+
 	them = &ic.ServiceEntry{
 		v1.TypeMeta{},
 		v1.ObjectMeta{
@@ -109,6 +125,12 @@ func TestInsert(t *testing.T) {
 			[]string{"no.owners", "1.us", "2.us"},
 			[]string{"1.them", "2.them", "3.them"},
 		},
+		{
+			"us, before a restart",
+			[]*ic.ServiceEntry{usBeforeRestart},
+			[]string{"1.restarted", "2.restarted"},
+			[]string{},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -266,6 +288,12 @@ func TestClassify(t *testing.T) {
 			[]string{"no.owners", "1.us", "2.us"},
 			[]string{"1.them", "2.them", "3.them"},
 		},
+		{
+			"us, before a restart",
+			[]*ic.ServiceEntry{usBeforeRestart},
+			[]string{"1.restarted", "2.restarted"},
+			[]string{},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -0,0 +1,113 @@
+package vip
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Annotation records the virtual IP allocated to the host of a ServiceEntry, so allocations survive restarts
+const Annotation = "istio-cloud-map/vip"
+
+// Allocator assigns hosts stable virtual IPs from an IPv4 CIDR. A host is first offered the address its name hashes
+// to, then the next free ones, so it usually gets the same address even if its allocation is lost.
+type Allocator struct {
+	first uint32 // first usable address
+	size  uint32 // number of usable addresses
+
+	m     sync.Mutex // guards both maps
+	hosts map[string]uint32
+	ips   map[uint32]string
+}
+
+// NewAllocator returns an allocator of the usable addresses of the CIDR, that is all but its network and broadcast
+// addresses
+func NewAllocator(cidr string) (*Allocator, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid virtual IP CIDR %q", cidr)
+	}
+	ip := network.IP.To4()
+	ones, bits := network.Mask.Size()
+	if ip == nil || bits != 32 {
+		return nil, errors.Errorf("invalid virtual IP CIDR %q, only IPv4 is supported", cidr)
+	}
+	if ones > 30 {
+		return nil, errors.Errorf("virtual IP CIDR %q is too small, it must be /30 or larger", cidr)
+	}
+	return &Allocator{
+		first: binary.BigEndian.Uint32(ip) + 1,
+		size:  uint32(1)<<uint(bits-ones) - 2,
+		hosts: make(map[string]uint32),
+		ips:   make(map[uint32]string),
+	}, nil
+}
+
+// Reserve records that the host holds the address, as persisted on its ServiceEntry. It returns false if the
+// address isn't one of ours, or another host holds it.
+func (a *Allocator) Reserve(host, address string) bool {
+	ip := net.ParseIP(address).To4()
+	if ip == nil {
+		return false
+	}
+	n := binary.BigEndian.Uint32(ip)
+	if n < a.first || n-a.first >= a.size {
+		return false
+	}
+
+	a.m.Lock()
+	defer a.m.Unlock()
+	if holder, ok := a.ips[n]; ok {
+		return holder == host
+	}
+	if _, ok := a.hosts[host]; ok {
+		return false // the host already has another address
+	}
+	a.hosts[host] = n
+	a.ips[n] = host
+	return true
+}
+
+// Allocate returns the host's address, allocating it one if it has none
+func (a *Allocator) Allocate(host string) (string, error) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if n, ok := a.hosts[host]; ok {
+		return toIP(n), nil
+	}
+	if uint32(len(a.ips)) >= a.size {
+		return "", errors.Errorf("no virtual IPs left for %q, all %d are allocated", host, a.size)
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(host))
+	offset := h.Sum32() % a.size
+	for {
+		n := a.first + offset
+		if _, taken := a.ips[n]; !taken {
+			a.hosts[host] = n
+			a.ips[n] = host
+			return toIP(n), nil
+		}
+		offset = (offset + 1) % a.size
+	}
+}
+
+// Release reclaims the host's address, if it has one
+func (a *Allocator) Release(host string) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if n, ok := a.hosts[host]; ok {
+		delete(a.hosts, host)
+		delete(a.ips, n)
+	}
+}
+
+func toIP(n uint32) string {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip.String()
+}
@@ -0,0 +1,76 @@
+package vip
+
+import (
+	"testing"
+)
+
+func TestNewAllocator(t *testing.T) {
+	for cidr, wantErr := range map[string]bool{
+		"240.240.0.0/16": false,
+		"10.0.0.0/30":    false,
+		"10.0.0.0/31":    true,
+		"fd00::/64":      true,
+		"not a cidr":     true,
+	} {
+		if _, err := NewAllocator(cidr); (err != nil) != wantErr {
+			t.Errorf("NewAllocator(%q) error = %v, wantErr %v", cidr, err, wantErr)
+		}
+	}
+}
+
+func TestAllocator(t *testing.T) {
+	a, err := NewAllocator("10.0.0.0/29") // 6 usable addresses, 10.0.0.1 to 10.0.0.6
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := a.Allocate("a.tetrate.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != "10.0.0.6" {
+		t.Errorf("Allocate() = %v, want the address the host hashes to, 10.0.0.6", first)
+	}
+	if again, _ := a.Allocate("a.tetrate.io"); again != first {
+		t.Errorf("Allocate() gave the same host %v then %v", first, again)
+	}
+
+	// an allocation that's lost, e.g. on restart, is usually the same when made again
+	b, _ := NewAllocator("10.0.0.0/29")
+	if got, _ := b.Allocate("a.tetrate.io"); got != first {
+		t.Errorf("Allocate() on a new allocator = %v, want %v", got, first)
+	}
+
+	// persisted allocations are kept
+	if !a.Reserve("b.tetrate.io", "10.0.0.1") {
+		t.Errorf("Reserve() of a free address failed")
+	}
+	if a.Reserve("c.tetrate.io", first) {
+		t.Errorf("Reserve() of an address held by another host succeeded")
+	}
+	if a.Reserve("c.tetrate.io", "10.0.0.7") || a.Reserve("c.tetrate.io", "192.168.0.1") {
+		t.Errorf("Reserve() of an address outside of the usable range succeeded")
+	}
+
+	seen := map[string]bool{}
+	for _, host := range []string{"a.tetrate.io", "b.tetrate.io", "c", "d", "e", "f"} {
+		ip, err := a.Allocate(host)
+		if err != nil {
+			t.Fatalf("Allocate(%q) failed: %v", host, err)
+		}
+		if seen[ip] {
+			t.Errorf("Allocate(%q) = %v, which is already allocated", host, ip)
+		}
+		seen[ip] = true
+	}
+	if _, err := a.Allocate("g"); err == nil {
+		t.Errorf("Allocate() succeeded with every address allocated")
+	}
+
+	// released addresses are reclaimed
+	released, _ := a.Allocate("c")
+	a.Release("c")
+	if got, err := a.Allocate("g"); err != nil || got != released {
+		t.Errorf("Allocate() after Release() = %v, %v, want %v", got, err, released)
+	}
+}